@@ -2,6 +2,8 @@ package cmdutil
 
 import (
 	"strconv"
+	"strings"
+	"time"
 	"unicode"
 )
 
@@ -14,6 +16,25 @@ func ConvInt(s string) (int, bool) {
 	return n, true
 }
 
+// Parse duration string, allowing a 'd' (days) unit in addition to
+// the units accepted by time.ParseDuration.
+// Ex. "30d", "12h", "90m"
+func ConvDuration(s string) (time.Duration, bool) {
+	if strings.HasSuffix(s, "d") {
+		ndays, ok := ConvInt(strings.TrimSuffix(s, "d"))
+		if !ok {
+			return 0, false
+		}
+		return time.Duration(ndays) * 24 * time.Hour, true
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return d, true
+}
+
 func RemoveDups(args []string) []string {
 	var retArgs []string
 	argsMap := map[string]bool{}
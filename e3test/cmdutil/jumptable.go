@@ -2,16 +2,41 @@ package cmdutil
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 )
 
+// Named arg -K=V
+type Narg struct {
+	K string
+	V string
+}
+
 type Req struct {
 	Opts  map[string]string
 	Args  []string
 	Nargs map[string]string
+
+	// Named args in statement order, including repeated nargs.
+	NargList []Narg
+
+	// Pipeline variables, shared by all statements in the pipeline.
+	Vars map[string]string
+
+	// Canceled when the pipeline is stopped, Ex. another statement failed.
+	Ctx context.Context
+}
+
+// Return request context, never nil.
+func (req *Req) Context() context.Context {
+	if req.Ctx == nil {
+		return context.Background()
+	}
+	return req.Ctx
 }
 
 type Resp struct {
@@ -33,6 +58,26 @@ func (resp *Resp) String() string {
 	return b.String()
 }
 
+// Error caused by an invalid request, such as an unknown command or
+// invalid args, as opposed to a failure while running a valid request.
+type ReqError struct {
+	Msg string
+}
+
+func (e *ReqError) Error() string {
+	return e.Msg
+}
+
+func NewReqError(format string, a ...interface{}) error {
+	return &ReqError{fmt.Sprintf(format, a...)}
+}
+
+// Return true if err is or wraps a ReqError.
+func IsReqError(err error) bool {
+	var re *ReqError
+	return errors.As(err, &re)
+}
+
 type Handler func(req *Req, r io.Reader, w io.Writer) (*Resp, error)
 
 type JumpTbl map[string]Handler
@@ -53,9 +98,14 @@ func (jt JumpTbl) Exec(verb string, req *Req, r io.Reader, w io.Writer) (*Resp,
 		w = os.Stdout
 	}
 
+	// Blank statement does nothing
+	if verb == "" {
+		return &Resp{}, nil
+	}
+
 	doFunc, _ := jt[verb]
 	if doFunc == nil {
-		return &Resp{}, nil
+		return nil, NewReqError("unknown command '%s'", verb)
 	}
 
 	return doFunc(req, r, w)
@@ -0,0 +1,31 @@
+package cmdutil
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsReqError(t *testing.T) {
+	reqErr := NewReqError("unknown command '%s'", "x")
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"req error", reqErr, true},
+		{"wrapped req error", fmt.Errorf("statement 1 (%w)", reqErr), true},
+		{"twice wrapped req error", fmt.Errorf("pipeline (%w)", fmt.Errorf("statement 1 (%w)", reqErr)), true},
+		{"other error", errors.New("db error"), false},
+		{"req error as text", fmt.Errorf("statement 1 (%s)", reqErr), false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		got := IsReqError(tt.err)
+		if got != tt.want {
+			t.Errorf("%s: IsReqError() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"crypto/subtle"
+	"e3/cmdutil"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HTTP server authentication.
+//
+// Requests authenticate with an api token, sent in the header:
+//   Authorization: Bearer {token}
+//
+// Tokens are defined in the conf file, one per user, with the user's role:
+//   token.{name}={token}:{role}
+// Ex.
+//   token.rob=5d41402abc4b2a76:writer
+//
+// Each role may run the verbs of the roles before it:
+// reader - load, search, find, ...
+// writer - new, update, map, ...
+// admin  - createdb, purge, ...
+//
+// With no tokens defined, all requests are denied.
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleReader
+	RoleWriter
+	RoleAdmin
+)
+
+var _roleNames = map[Role]string{
+	RoleNone:   "none",
+	RoleReader: "reader",
+	RoleWriter: "writer",
+	RoleAdmin:  "admin",
+}
+
+func (role Role) String() string {
+	return _roleNames[role]
+}
+
+func ParseRole(s string) (Role, error) {
+	for role, name := range _roleNames {
+		if role != RoleNone && name == s {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role '%s'", s)
+}
+
+// Minimum role needed to run each verb over http.
+// Verbs not listed can't be run over http, Ex. edit runs an editor on the
+// server.
+var _verbRoles = map[string]Role{
+	"echo":      RoleReader,
+	"set":       RoleReader,
+	"load":      RoleReader,
+	"search":    RoleReader,
+	"find":      RoleReader,
+	"history":   RoleReader,
+	"diff":      RoleReader,
+	"links":     RoleReader,
+	"backlinks": RoleReader,
+	"trash":     RoleReader,
+	"filter":    RoleReader,
+	"sort":      RoleReader,
+	"head":      RoleReader,
+	"uniq":      RoleReader,
+	"count":     RoleReader,
+	"table":     RoleReader,
+
+	"new":     RoleWriter,
+	"update":  RoleWriter,
+	"map":     RoleWriter,
+	"revert":  RoleWriter,
+	"delete":  RoleWriter,
+	"restore": RoleWriter,
+	"bgindex": RoleWriter,
+
+	"createdb": RoleAdmin,
+	"migrate":  RoleAdmin,
+	"purge":    RoleAdmin,
+	"dump":     RoleAdmin,
+}
+
+// Api token user.
+type apiUser struct {
+	Name  string
+	Token string
+	Role  Role
+}
+
+// Return api token users defined in opts as token.{name}={token}:{role}
+func parseAPIUsers(opts map[string]string) ([]*apiUser, error) {
+	var users []*apiUser
+	for k, v := range opts {
+		if !strings.HasPrefix(k, "token.") {
+			continue
+		}
+		name := strings.TrimPrefix(k, "token.")
+
+		i := strings.LastIndex(v, ":")
+		if name == "" || i <= 0 {
+			return nil, fmt.Errorf("invalid token setting '%s', expected token.{name}={token}:{role}", k)
+		}
+		role, err := ParseRole(v[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid token setting '%s' (%s)", k, err)
+		}
+		users = append(users, &apiUser{name, v[:i], role})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users, nil
+}
+
+// Return user of the request's bearer token, nil if there is no token or
+// it doesn't match any user.
+func (e3c *E3C) authUser(r *http.Request) (*apiUser, error) {
+	users, err := parseAPIUsers(e3c.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	if token == "" {
+		return nil, nil
+	}
+
+	var u *apiUser
+	for _, user := range users {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(user.Token)) == 1 {
+			u = user
+		}
+	}
+	return u, nil
+}
+
+// Authenticate request, writing 401, 403 or 500 error if the request has no
+// valid token or its user doesn't have role.
+// Returns nil if request wasn't authorized.
+func (e3c *E3C) httpAuth(w http.ResponseWriter, r *http.Request, role Role) *apiUser {
+	u, err := e3c.authUser(r)
+	if err != nil {
+		e3c.logger.Printf("Auth error (%s)\n", err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("auth settings error"))
+		return nil
+	}
+	if u == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid api token"))
+		return nil
+	}
+	if u.Role < role {
+		writeJSONError(w, http.StatusForbidden, fmt.Errorf("user %s (%s) not permitted, %s role required", u.Name, u.Role, role))
+		return nil
+	}
+	return u
+}
+
+// Error of a statement the user's role isn't permitted to run.
+type permitError struct {
+	error
+}
+
+// Check that role may run all verbs in stmts.
+func stmtsPermitted(stmts []string, role Role) error {
+	for _, stmt := range stmts {
+		verb, _, nargs := parseStmt(stmt)
+		if verb == "" {
+			continue
+		}
+
+		// bgindex -watch runs until the server stops, the server's -bgindex
+		// option keeps the index updated instead.
+		if verb == "bgindex" && cmdutil.FlagOn(nargs, "watch") {
+			return errors.New("'bgindex -watch' not permitted over http, use the -bgindex option")
+		}
+
+		verbRole, ok := _verbRoles[verb]
+		if !ok {
+			return fmt.Errorf("'%s' not permitted over http", verb)
+		}
+
+		// restore -dump restores a whole dump.
+		if verb == "restore" && cmdutil.FlagOn(nargs, "dump") {
+			verbRole = RoleAdmin
+		}
+		if role < verbRole {
+			return fmt.Errorf("'%s' not permitted, %s role required", verb, verbRole)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Statements are checked again once their variables are expanded, as the
+// statements as sent may pass the check.
+func TestPipelineVarsPermitted(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		scmd    string
+		role    Role
+		wantErr bool
+	}{
+		{"set -a=-dump , restore $a", RoleWriter, true},
+		{"set -v=echo , $v hi", RoleReader, false},
+		{"set -v=dump , $v", RoleWriter, true},
+		{"set -a=x , echo $a", RoleReader, false},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		pr := RunPipelineStmts(context.Background(), tt.scmd, strings.NewReader(""), &b, nil, nil, nil, tt.role, logger)
+
+		var perr *permitError
+		denied := errors.As(pr.Err, &perr)
+		if denied != tt.wantErr {
+			t.Errorf("%s as %s: denied %v, want %v (%v)", tt.scmd, tt.role, denied, tt.wantErr, pr.Err)
+			continue
+		}
+		if denied && pr.ErrIndex != 1 {
+			t.Errorf("%s as %s: denied statement %d, want 1", tt.scmd, tt.role, pr.ErrIndex)
+		}
+	}
+
+	// Passes the check before expansion.
+	err := stmtsPermitted(expandPipeline("set -a=-dump , restore $a", nil), RoleWriter)
+	if err != nil {
+		t.Errorf("unexpanded restore $a denied (%s)", err)
+	}
+}
+
+func TestStmtsPermitted(t *testing.T) {
+	tests := []struct {
+		stmt string
+		role Role // least role permitted, RoleNone if not permitted over http
+	}{
+		{"echo hi", RoleReader},
+		{`load "-1"`, RoleReader},
+		{"find -assigned=rob", RoleReader},
+		{"", RoleReader},
+		{"update", RoleWriter},
+		{`delete "-1"`, RoleWriter},
+		{`restore "-1"`, RoleWriter},
+		{"restore", RoleWriter},
+		{"restore -dump", RoleAdmin},
+		{"dump", RoleAdmin},
+		{"purge -all", RoleAdmin},
+		{"createdb", RoleAdmin},
+		{"bgindex", RoleWriter},
+		{"bgindex -watch", RoleNone},
+		{"edit", RoleNone},
+		{"nosuchverb", RoleNone},
+	}
+
+	for _, tt := range tests {
+		for _, role := range []Role{RoleReader, RoleWriter, RoleAdmin} {
+			err := stmtsPermitted([]string{tt.stmt}, role)
+			want := tt.role != RoleNone && role >= tt.role
+			if (err == nil) != want {
+				t.Errorf("'%s' as %s: permitted %v, want %v (%v)", tt.stmt, role, err == nil, want, err)
+			}
+		}
+	}
+
+	// Any statement not permitted denies the pipeline.
+	err := stmtsPermitted([]string{"echo hi", "dump"}, RoleWriter)
+	if err == nil {
+		t.Errorf("echo hi , dump permitted as writer")
+	}
+}
+
+func TestParseAPIUsers(t *testing.T) {
+	tests := []struct {
+		opts    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{map[string]string{}, "", false},
+		{map[string]string{"token.rob": "t:1:writer", "token.ann": "t2:reader", "other": "x"}, "ann=t2:reader,rob=t:1:writer", false},
+		{map[string]string{"token.rob": "t1"}, "", true},
+		{map[string]string{"token.rob": ":writer"}, "", true},
+		{map[string]string{"token.": "t1:writer"}, "", true},
+		{map[string]string{"token.rob": "t1:owner"}, "", true},
+		{map[string]string{"token.rob": "t1:none"}, "", true},
+	}
+
+	for _, tt := range tests {
+		users, err := parseAPIUsers(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: error %v, want error %v", tt.opts, err, tt.wantErr)
+			continue
+		}
+		var us []string
+		for _, u := range users {
+			us = append(us, u.Name+"="+u.Token+":"+u.Role.String())
+		}
+		if got := strings.Join(us, ","); got != tt.want {
+			t.Errorf("%v: users %s, want %s", tt.opts, got, tt.want)
+		}
+	}
+}
@@ -2,29 +2,87 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"e3/cmdutil"
 	"e3/store"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"unicode"
 )
 
-func RunPipelineStmts(scmd string, r io.Reader, w io.Writer, st *store.Store, opts, aliases map[string]string, logger *log.Logger) {
-	e3c := E3C{st, opts, aliases, logger}
+// Result of running a pipeline statement.
+type StmtResult struct {
+	Stmt string
+	Resp *cmdutil.Resp
+	Err  error
+}
+
+// Result of running a pipeline.
+// Stmts holds the result of each statement, in order.
+// ErrIndex is the index of the first statement that failed, -1 if none.
+// Other statements may fail after it, as the pipeline is stopped.
+type PipelineResult struct {
+	Stmts    []*StmtResult
+	NumStmts int
+	Err      error
+	ErrIndex int
+}
+
+// Return number of statements that ran successfully.
+func (pr *PipelineResult) Completed() int {
+	ncompleted := 0
+	for _, sr := range pr.Stmts {
+		if sr.Err == nil {
+			ncompleted++
+		}
+	}
+	return ncompleted
+}
+
+// Return result of the first failing statement, nil if pipeline succeeded.
+func (pr *PipelineResult) Failed() *StmtResult {
+	if pr.Err == nil || pr.ErrIndex < 0 {
+		return nil
+	}
+	return pr.Stmts[pr.ErrIndex]
+}
+
+func newJumpTbl(e3c *E3C) cmdutil.JumpTbl {
 	jt := cmdutil.NewJumpTbl()
 	jt.Handle("createdb", e3c.Createdb)
+	jt.Handle("migrate", e3c.Migrate)
 	jt.Handle("new", e3c.New)
 	jt.Handle("load", e3c.Load)
 	jt.Handle("update", e3c.Update)
 	jt.Handle("search", e3c.Search)
 	jt.Handle("find", e3c.Find)
 	jt.Handle("map", e3c.Map)
+	jt.Handle("filter", e3c.Filter)
+	jt.Handle("sort", e3c.Sort)
+	jt.Handle("head", e3c.Head)
+	jt.Handle("uniq", e3c.Uniq)
+	jt.Handle("count", e3c.Count)
+	jt.Handle("table", e3c.Table)
 	jt.Handle("edit", e3c.Edit)
 	jt.Handle("echo", e3c.Echo)
+	jt.Handle("set", e3c.Set)
 	jt.Handle("bgindex", e3c.BgIndex)
+	jt.Handle("history", e3c.History)
+	jt.Handle("diff", e3c.Diff)
+	jt.Handle("revert", e3c.Revert)
+	jt.Handle("links", e3c.Links)
+	jt.Handle("backlinks", e3c.Backlinks)
+	jt.Handle("delete", e3c.Delete)
+	jt.Handle("trash", e3c.Trash)
+	jt.Handle("restore", e3c.Restore)
+	jt.Handle("purge", e3c.Purge)
+	jt.Handle("dump", e3c.Dump)
 
 	//	aliases := map[string]string{
 	//		"assignto":  "map -assigned=$1, update",
@@ -34,12 +92,11 @@ func RunPipelineStmts(scmd string, r io.Reader, w io.Writer, st *store.Store, op
 	//		"listnodes": "load -outputfmt=table",
 	//	}
 
-	var out io.ReadWriter
-	in := r
-	if in == nil {
-		in = os.Stdin
-	}
+	return jt
+}
 
+// Parse pipeline cmd into statements, with aliases expanded.
+func expandPipeline(scmd string, aliases map[string]string) []string {
 	stmts := parsePipelineStmts(scmd)
 
 	// Expand aliases until no more aliases to expand
@@ -56,36 +113,272 @@ func RunPipelineStmts(scmd string, r io.Reader, w io.Writer, st *store.Store, op
 		}
 	}
 
-	for _, stmt := range stmts {
+	return stmts
+}
+
+// Error of statements not run because the pipeline was stopped.
+var errStmtCanceled = errors.New("statement canceled")
+
+// Pipeline being run.
+type pipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	jt     cmdutil.JumpTbl
+	opts   map[string]string
+	logger *log.Logger
+
+	// Role statements are checked against after variables are expanded,
+	// RoleNone to run statements unchecked.
+	role Role
+
+	// Variables set by set statements.
+	vars map[string]string
+
+	// Statements that may write to the store, and whether a writing
+	// statement waits for the writing statements before it, see runStmt().
+	writes       []bool
+	serialWrites bool
+
+	pr   *PipelineResult
+	mu   sync.Mutex
+	done []chan struct{}
+}
+
+// Run pipeline statements, passing output of each statement as input to the
+// next. Output of the last statement is written to w.
+//
+// Statements run concurrently, each in its own goroutine, streaming output
+// to the next statement through a pipe. When a statement fails, the pipeline
+// is stopped: the other statements' pipes are closed and ctx passed to them
+// is canceled. Output already written to w is not taken back.
+//
+// A statement referencing variables ($prev, set vars) or setting them
+// waits for all statements before it to finish, buffering its input
+// meanwhile. Other statements start right away, so a statement that doesn't
+// read its input may run before the statements before it finish.
+//
+// sqlite allows one writer at a time, so with sqlite a statement that may
+// write to the store waits the same way if a statement before it may write
+// too, Ex. "map -links+=... , update -atomic", where update's transaction
+// would otherwise hold the write lock map's links wait for.
+//
+// Unless role is RoleNone, each statement is checked to be permitted to
+// role once its variables are expanded, right before it runs, as a variable
+// can change what a statement does, Ex. "set -a=-dump , restore $a".
+func RunPipelineStmts(ctx context.Context, scmd string, r io.Reader, w io.Writer, st *store.Store, opts, aliases map[string]string, role Role, logger *log.Logger) *PipelineResult {
+	e3c := &E3C{st, opts, aliases, logger}
+
+	if r == nil {
+		r = os.Stdin
+	}
+	if w == nil {
+		w = os.Stdout
+	}
+
+	stmts := expandPipeline(scmd, aliases)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := &pipeline{
+		ctx:    ctx,
+		cancel: cancel,
+		jt:     newJumpTbl(e3c),
+		opts:   opts,
+		logger: logger,
+		role:   role,
+		vars:   map[string]string{},
+		pr:     &PipelineResult{NumStmts: len(stmts), ErrIndex: -1},
+		done:   make([]chan struct{}, len(stmts)),
+
+		serialWrites: st != nil && st.Driver == "sqlite3",
+	}
+
+	for i, stmt := range stmts {
+		p.pr.Stmts = append(p.pr.Stmts, &StmtResult{Stmt: stmt})
+		p.writes = append(p.writes, stmtWrites(stmt))
+		p.done[i] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	in := r
+	for i := range stmts {
+		var pr *io.PipeReader
+		var pw *io.PipeWriter
+		if i < len(stmts)-1 {
+			pr, pw = io.Pipe()
+		}
+
+		wg.Add(1)
+		go func(i int, in io.Reader, pw *io.PipeWriter) {
+			defer wg.Done()
+			if pw == nil {
+				p.runStmt(i, in, w, pw)
+			} else {
+				p.runStmt(i, in, pw, pw)
+			}
+		}(i, in, pw)
+
+		in = pr
+	}
+	wg.Wait()
+
+	return p.pr
+}
+
+// Record statement i failing with err, and stop the pipeline if it's the
+// first statement to fail.
+func (p *pipeline) fail(i int, err error) {
+	p.pr.Stmts[i].Err = err
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pr.Err == nil {
+		p.pr.Err = fmt.Errorf("error running statement '%s' (%w)", p.pr.Stmts[i].Stmt, err)
+		p.pr.ErrIndex = i
+		p.logger.Printf("%s\n", p.pr.Err)
+		p.cancel()
+	}
+}
+
+// Run statement i, reading input from r and writing output to w.
+// pw is the pipe to the next statement, nil for the last statement.
+func (p *pipeline) runStmt(i int, r io.Reader, w io.Writer, pw *io.PipeWriter) {
+	defer close(p.done[i])
+	sr := p.pr.Stmts[i]
+
+	// Input pipe from the previous statement, nil for the first statement.
+	pr, _ := r.(*io.PipeReader)
+	if i == 0 {
+		pr = nil
+	}
+
+	stop := func(err error) {
+		p.fail(i, err)
+		if pr != nil {
+			pr.CloseWithError(err)
+		}
+		if pw != nil {
+			pw.CloseWithError(err)
+		}
+	}
+
+	verb, _, _ := parseStmt(sr.Stmt)
+	usesVars := verb == "set" || refsVars(sr.Stmt)
+	vars := p.vars
+	if usesVars || p.waitsForWrites(i) {
 		var b bytes.Buffer
-		out = &b
+		_, err := io.Copy(&b, r)
+		if err != nil {
+			stop(err)
+			return
+		}
+		r = &b
+
+		for j := 0; j < i; j++ {
+			<-p.done[j]
+		}
+		if p.ctx.Err() != nil {
+			stop(errStmtCanceled)
+			return
+		}
 
-		resp, err := execStmt(stmt, jt, in, out, opts)
+		if usesVars {
+			vars = p.stmtVars(i)
+		}
+	}
+
+	// Statements without variables are expanded too, for their $$.
+	stmt, err := expandVars(sr.Stmt, vars)
+	if err != nil {
+		stop(err)
+		return
+	}
+	sr.Stmt = stmt
+	if verb == "set" {
+		vars = p.vars
+	}
+
+	if p.role != RoleNone {
+		err := stmtsPermitted([]string{sr.Stmt}, p.role)
 		if err != nil {
-			fmt.Println("error(s) occured, check logs.")
-			s := fmt.Sprintf("error running statement '%s' (%s)", stmt, err)
-			logger.Fatalf(s)
+			stop(&permitError{err})
+			return
 		}
+	}
 
-		logger.Printf("$ %s\n", stmt)
-		logger.Printf("> %s\n", resp)
+	p.logger.Printf("$ %s\n", sr.Stmt)
+	resp, err := execStmt(p.ctx, sr.Stmt, p.jt, r, w, p.opts, vars)
+	sr.Resp = resp
+	if err != nil {
+		stop(err)
+		return
+	}
+	p.logger.Printf("> %s\n", resp)
 
-		in = out
+	if pw != nil {
+		pw.Close()
+	}
+	// Let the previous statements finish writing any unread input.
+	if pr != nil {
+		io.Copy(ioutil.Discard, pr)
 	}
+}
 
-	if w == nil {
-		w = os.Stdout
+// Return whether statement i may write to the store, and has to wait for
+// the writing statements before it to finish.
+func (p *pipeline) waitsForWrites(i int) bool {
+	if !p.serialWrites || !p.writes[i] {
+		return false
+	}
+	for j := 0; j < i; j++ {
+		if p.writes[j] {
+			return true
+		}
 	}
-	io.Copy(w, out)
+	return false
 }
 
-func execStmt(stmt string, jt cmdutil.JumpTbl, r io.Reader, w io.Writer, opts map[string]string) (*cmdutil.Resp, error) {
-	verb, args, nargs := parseStmt(stmt)
+// Return whether stmt may write to the store: verbs not limited to the reader
+// role, and verbs taken from variables, as they're not known yet.
+func stmtWrites(stmt string) bool {
+	verb, _, _ := parseStmt(stmt)
+	role, ok := _verbRoles[verb]
+	return !ok || role > RoleReader
+}
+
+// Return variables for statement i: set vars, and $prev vars from the
+// result of the last statement before i, set statements aside.
+// All statements before i must be done.
+func (p *pipeline) stmtVars(i int) map[string]string {
+	vars := map[string]string{}
+	for k, v := range p.vars {
+		vars[k] = v
+	}
+
+	for j := i - 1; j >= 0; j-- {
+		sr := p.pr.Stmts[j]
+		verb, _, _ := parseStmt(sr.Stmt)
+		if verb != "set" {
+			addPrevVars(vars, sr.Resp)
+			break
+		}
+	}
+
+	return vars
+}
+
+func execStmt(ctx context.Context, stmt string, jt cmdutil.JumpTbl, r io.Reader, w io.Writer, opts, vars map[string]string) (*cmdutil.Resp, error) {
+	verb, args, nargList := parseStmtNargs(stmt)
 
 	req := &cmdutil.Req{
-		Opts:  opts,
-		Args:  args,
-		Nargs: nargs,
+		Opts:     opts,
+		Args:     args,
+		Nargs:    nargsMap(nargList),
+		NargList: nargList,
+		Vars:     vars,
+		Ctx:      ctx,
 	}
 
 	return jt.Exec(verb, req, r, w)
@@ -156,10 +449,11 @@ func parsePipelineStmts(scmd string) []string {
 	return stmts
 }
 
-func parseStmt(stmt string) (string, []string, map[string]string) {
+// Parse statement into verb, args and named args, in statement order.
+func parseStmtNargs(stmt string) (string, []string, []cmdutil.Narg) {
 	var verb string
 	var args []string
-	nargs := map[string]string{}
+	var nargs []cmdutil.Narg
 
 	runes := []rune(stmt)
 	i := 0
@@ -202,7 +496,7 @@ func parseStmt(stmt string) (string, []string, map[string]string) {
 		if nargK != "" {
 			if unicode.IsSpace(c) {
 				// -nargkey by itself is same as -nargkey=""
-				nargs[nargK] = ""
+				nargs = append(nargs, cmdutil.Narg{K: nargK, V: ""})
 				nargK = ""
 			} else if c == '=' {
 				nargKSet = nargK
@@ -217,7 +511,7 @@ func parseStmt(stmt string) (string, []string, map[string]string) {
 			if openQuote != ' ' {
 				// -nargkey="val"
 				if c == openQuote {
-					nargs[nargKSet] = nargV
+					nargs = append(nargs, cmdutil.Narg{K: nargKSet, V: nargV})
 					nargKSet = ""
 					nargV = ""
 
@@ -229,7 +523,7 @@ func parseStmt(stmt string) (string, []string, map[string]string) {
 				openQuote = c
 			} else if unicode.IsSpace(c) {
 				// -nargkey=val
-				nargs[nargKSet] = nargV
+				nargs = append(nargs, cmdutil.Narg{K: nargKSet, V: nargV})
 				nargKSet = ""
 				nargV = ""
 			} else {
@@ -303,7 +597,7 @@ func parseStmt(stmt string) (string, []string, map[string]string) {
 		nargKSet = nargK
 	}
 	if nargKSet != "" {
-		nargs[nargKSet] = nargV
+		nargs = append(nargs, cmdutil.Narg{K: nargKSet, V: nargV})
 		nargKSet = ""
 		nargV = ""
 	}
@@ -311,6 +605,21 @@ func parseStmt(stmt string) (string, []string, map[string]string) {
 	return verb, args, nargs
 }
 
+func parseStmt(stmt string) (string, []string, map[string]string) {
+	verb, args, nargList := parseStmtNargs(stmt)
+	return verb, args, nargsMap(nargList)
+}
+
+// Return named args as map, a later narg replaces an earlier one with the
+// same key.
+func nargsMap(nargList []cmdutil.Narg) map[string]string {
+	nargs := map[string]string{}
+	for _, narg := range nargList {
+		nargs[narg.K] = narg.V
+	}
+	return nargs
+}
+
 func quoteArgs(args []string) []string {
 	for i, arg := range args {
 		args[i] = fmt.Sprintf("\"%s\"", arg)
@@ -353,6 +662,7 @@ func expandAliases(stmts []string, aliases map[string]string) ([]string, bool) {
 // args = args list
 //
 // Replace all $n in cmd with args[$n] where n is an int from 1 to 9.
+// Any other $ is left as is, for pipeline variables.
 // Return transformed cmd and remaining unreferenced args.
 // Ex.
 // expandAliasArgs("load $1 $2 $3 -outputfmt=$4", ["a", "b", "c", "d", "e"]
@@ -373,6 +683,8 @@ func expandAliasArgs(scmd string, args []string) (string, []string) {
 					expandedCmd += args[i]
 					usedArgs[i] = true
 				}
+			} else {
+				expandedCmd += "$" + string(c)
 			}
 			paramMode = false
 			continue
@@ -386,6 +698,9 @@ func expandAliasArgs(scmd string, args []string) (string, []string) {
 
 		expandedCmd += string(c)
 	}
+	if paramMode {
+		expandedCmd += "$"
+	}
 
 	unrefArgs := []string{}
 	for i, _ := range args {
@@ -396,3 +711,134 @@ func expandAliasArgs(scmd string, args []string) (string, []string) {
 
 	return expandedCmd, unrefArgs
 }
+
+// Add $prev vars for the statement response:
+// $prev.code = resp.Code
+// $prev.status = resp.Status
+// $prev.args = space separated resp.Args
+// $prev.nargs.{k} = resp.Nargs[k]
+func addPrevVars(vars map[string]string, resp *cmdutil.Resp) {
+	if resp == nil {
+		resp = &cmdutil.Resp{}
+	}
+
+	vars["prev.code"] = fmt.Sprintf("%d", resp.Code)
+	vars["prev.status"] = resp.Status
+	vars["prev.args"] = strings.Join(resp.Args, " ")
+	for k, v := range resp.Nargs {
+		vars["prev.nargs."+k] = v
+	}
+}
+
+func isVarNameStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+func isVarNameChar(c rune) bool {
+	return c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// Piece of a statement: text, or a $name variable reference.
+type varToken struct {
+	Text string
+	Name string
+}
+
+// Split stmt into text and $name variable references.
+// $$ is text "$", and a $ not followed by a name is left as is.
+func scanVars(stmt string) []varToken {
+	var toks []varToken
+	var b strings.Builder
+	runes := []rune(stmt)
+
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if c != '$' {
+			b.WriteRune(c)
+			continue
+		}
+
+		if i+1 < len(runes) && runes[i+1] == '$' {
+			b.WriteRune('$')
+			i++
+			continue
+		}
+		if i+1 >= len(runes) || !isVarNameStart(runes[i+1]) {
+			b.WriteRune(c)
+			continue
+		}
+
+		j := i + 1
+		for j < len(runes) && isVarNameChar(runes[j]) {
+			j++
+		}
+		// Trailing dots end a sentence, not the name
+		for runes[j-1] == '.' {
+			j--
+		}
+
+		if b.Len() > 0 {
+			toks = append(toks, varToken{Text: b.String()})
+			b.Reset()
+		}
+		toks = append(toks, varToken{Name: string(runes[i+1 : j])})
+		i = j - 1
+	}
+	if b.Len() > 0 {
+		toks = append(toks, varToken{Text: b.String()})
+	}
+
+	return toks
+}
+
+// Replace all $name in stmt with the value returned by fn(name).
+// $$ is replaced with $, and a $ not followed by a name is left as is.
+func replaceVars(stmt string, fn func(name string) (string, error)) (string, error) {
+	var b strings.Builder
+	for _, tok := range scanVars(stmt) {
+		if tok.Name == "" {
+			b.WriteString(tok.Text)
+			continue
+		}
+
+		v, err := fn(tok.Name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// Return true if stmt references any variables.
+func refsVars(stmt string) bool {
+	for _, tok := range scanVars(stmt) {
+		if tok.Name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace all $name in stmt with the value of pipeline variable name.
+// $$ is replaced with $, and a $ not followed by a name is left as is.
+// Values are replaced as is, quote the $name if the value may contain spaces.
+// Ex.
+// expandVars("load $prev.args -outputfmt=$fmt", {"prev.args": "1 2", "fmt": "table"})
+// Returns:
+//   "load 1 2 -outputfmt=table"
+//
+// Returns error if a variable isn't defined. $prev.nargs.{k} is blank
+// if the previous statement didn't return narg k.
+func expandVars(stmt string, vars map[string]string) (string, error) {
+	return replaceVars(stmt, func(name string) (string, error) {
+		v, ok := vars[name]
+		if !ok {
+			_, hasPrev := vars["prev.code"]
+			if !hasPrev || !strings.HasPrefix(name, "prev.nargs.") {
+				return "", cmdutil.NewReqError("undefined variable '$%s'", name)
+			}
+		}
+		return v, nil
+	})
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{
+		"prev.code": "2",
+		"prev.args": "1 2",
+		"fmt":       "table",
+	}
+
+	tests := []struct {
+		stmt    string
+		want    string
+		refs    bool
+		wantErr bool
+	}{
+		{"load $prev.args -outputfmt=$fmt", "load 1 2 -outputfmt=table", true, false},
+		{"echo $$x", "echo $x", false, false},
+		{"echo $$x $prev.code", "echo $x 2", true, false},
+		{"echo $$$fmt", "echo $table", true, false},
+		{"echo 5$ $ $1", "echo 5$ $ $1", false, false},
+		{"echo $fmt.", "echo table.", true, false},
+		{"echo $prev.nargs.okIDs", "echo ", true, false},
+		{"echo $undefined", "", true, true},
+	}
+
+	for _, tt := range tests {
+		if got := refsVars(tt.stmt); got != tt.refs {
+			t.Errorf("refsVars(%q) = %v, want %v", tt.stmt, got, tt.refs)
+		}
+
+		got, err := expandVars(tt.stmt, vars)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandVars(%q): expected error, got %q", tt.stmt, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandVars(%q): %s", tt.stmt, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandVars(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+// $$ is an escaped $ whether or not the statement references variables.
+func TestPipelineVarEscape(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		scmd string
+		want string
+	}{
+		{"echo $$x", "$x\n"},
+		{"set -a=1 , echo $$x $a", "$x 1\n"},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		pr := RunPipelineStmts(context.Background(), tt.scmd, strings.NewReader(""), &b, nil, nil, nil, RoleNone, logger)
+		if pr.Err != nil {
+			t.Errorf("%s: %s", tt.scmd, pr.Err)
+			continue
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: output %q, want %q", tt.scmd, b.String(), tt.want)
+		}
+	}
+}
+
+// With sqlite, map's links wait for no update -atomic transaction, as
+// update waits for map to finish.
+func TestPipelineSerialWrites(t *testing.T) {
+	e3c := testE3C(t)
+	to := newTestNode(t, e3c, "-title=To")
+	var ids []string
+	for i := 0; i < 20; i++ {
+		// Long enough for map's output to reach update before map is done.
+		ids = append(ids, q(newTestNode(t, e3c, "-title=From -body="+strings.Repeat("x", 1000))))
+	}
+
+	_, pr := runCmd(e3c, "load "+strings.Join(ids, " ")+` , map -title=Linked -links+="blocks:`+to+`" , update -atomic`, "")
+	if pr.Err != nil {
+		t.Fatal(pr.Err)
+	}
+	if pr.Stmts[1].Resp.Code != len(ids) || pr.Stmts[2].Resp.Code != len(ids) {
+		t.Errorf("linked %d nodes, updated %d, want %d", pr.Stmts[1].Resp.Code, pr.Stmts[2].Resp.Code, len(ids))
+	}
+	_, pr = mustRunCmd(t, e3c, "backlinks "+q(to), "")
+	if pr.Stmts[0].Resp.Code != len(ids) {
+		t.Errorf("%d backlinks, want %d", pr.Stmts[0].Resp.Code, len(ids))
+	}
+
+	tests := []struct {
+		stmts []string
+		want  []bool
+	}{
+		{[]string{"load 1", "map -title=x", "update -atomic"}, []bool{false, false, true}},
+		{[]string{"update", "echo", "update"}, []bool{false, false, true}},
+		{[]string{"update", "set -v=update", "$v"}, []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		p := &pipeline{serialWrites: true}
+		for _, stmt := range tt.stmts {
+			p.writes = append(p.writes, stmtWrites(stmt))
+		}
+		for i := range tt.stmts {
+			if got := p.waitsForWrites(i); got != tt.want[i] {
+				t.Errorf("%s: statement %d waits %v, want %v", strings.Join(tt.stmts, " , "), i, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Line diff operation.
+// Op is one of ' ' (line in both), '-' (line removed), '+' (line added)
+type diffLine struct {
+	Op   byte
+	Line string
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Return line diff of a to b, using the longest common subsequence of lines.
+// The subsequence is found in space linear in the number of lines, by
+// splitting a in halves and b where the halves' subsequences meet
+// (Hirschberg's algorithm).
+func diffLines(a, b []string) []diffLine {
+	return appendDiffLines(nil, a, b)
+}
+
+func appendDiffLines(dls []diffLine, a, b []string) []diffLine {
+	// Lines common to the start and end of a and b are in the subsequence.
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		dls = append(dls, diffLine{' ', a[n]})
+		n++
+	}
+	a, b = a[n:], b[n:]
+	m := 0
+	for m < len(a) && m < len(b) && a[len(a)-1-m] == b[len(b)-1-m] {
+		m++
+	}
+	common := a[len(a)-m:]
+	a, b = a[:len(a)-m], b[:len(b)-m]
+
+	switch {
+	case len(a) == 0 || len(b) == 0:
+		for _, line := range a {
+			dls = append(dls, diffLine{'-', line})
+		}
+		for _, line := range b {
+			dls = append(dls, diffLine{'+', line})
+		}
+	case len(a) == 1:
+		k := 0
+		for k < len(b) && b[k] != a[0] {
+			k++
+		}
+		if k == len(b) {
+			dls = append(dls, diffLine{'-', a[0]})
+		}
+		for j, line := range b {
+			if j == k {
+				dls = append(dls, diffLine{' ', line})
+			} else {
+				dls = append(dls, diffLine{'+', line})
+			}
+		}
+	default:
+		mid := len(a) / 2
+		fwd := lcsLens(a[:mid], b)
+		bwd := lcsLens(reversedLines(a[mid:]), reversedLines(b))
+
+		// Split b at the first k where the lcs of a[:mid] and b[:k] and the
+		// lcs of a[mid:] and b[k:] add up to the longest, so removed lines
+		// come before added ones.
+		k := 0
+		for j := range fwd {
+			if fwd[j]+bwd[len(b)-j] > fwd[k]+bwd[len(b)-k] {
+				k = j
+			}
+		}
+		dls = appendDiffLines(dls, a[:mid], b[:k])
+		dls = appendDiffLines(dls, a[mid:], b[k:])
+	}
+
+	for _, line := range common {
+		dls = append(dls, diffLine{' ', line})
+	}
+	return dls
+}
+
+// Return lengths of the longest common subsequences of a and each prefix
+// of b: ls[j] = length of lcs of a and b[:j].
+func lcsLens(a, b []string) []int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else if prev[j+1] >= cur[j] {
+				cur[j+1] = prev[j+1]
+			} else {
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+func reversedLines(lines []string) []string {
+	rev := make([]string, len(lines))
+	for i, line := range lines {
+		rev[len(lines)-1-i] = line
+	}
+	return rev
+}
+
+// Write field diff of a to b.
+// Writes nothing if a and b are the same.
+func writeFieldDiff(w io.Writer, field, a, b string) {
+	if a == b {
+		return
+	}
+
+	fmt.Fprintf(w, "%s:\n", field)
+	for _, dl := range diffLines(splitLines(a), splitLines(b)) {
+		fmt.Fprintf(w, "%c %s", dl.Op, ensureNewlineEnd(dl.Line))
+	}
+}
+
+func ensureNewlineEnd(s string) string {
+	if !strings.HasSuffix(s, "\n") {
+		s = s + "\n"
+	}
+	return s
+}
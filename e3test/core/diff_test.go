@@ -0,0 +1,95 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func diffString(dls []diffLine) string {
+	var b strings.Builder
+	for _, dl := range dls {
+		fmt.Fprintf(&b, "%c%s", dl.Op, dl.Line)
+	}
+	return b.String()
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"a\n", "a\n", " a\n"},
+		{"a\n", "", "-a\n"},
+		{"", "a\n", "+a\n"},
+		{"a\nb\n", "c\nd\n", "-a\n-b\n+c\n+d\n"},
+		{"x\nc\ny\n", "p\nc\nq\n", "-x\n+p\n c\n-y\n+q\n"},
+		{"a\nb\nc\nd\n", "a\nc\nd\ne\n", " a\n-b\n c\n d\n+e\n"},
+		{"a\nb\na\n", "b\na\nb\n", "-a\n b\n a\n+b\n"},
+	}
+
+	for _, tt := range tests {
+		got := diffString(diffLines(splitLines(tt.a), splitLines(tt.b)))
+		if got != tt.want {
+			t.Errorf("diff %q %q:\n%s\nwant:\n%s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Length of the longest common subsequence of a and b, from the full table.
+func lcsLen(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+// Diffs take a to b, keeping a longest common subsequence of lines.
+func TestDiffLinesLCS(t *testing.T) {
+	lines := func(bs []byte) []string {
+		var ls []string
+		for _, c := range bs {
+			ls = append(ls, fmt.Sprintf("%d\n", c%4))
+		}
+		return ls
+	}
+
+	f := func(x, y []byte) bool {
+		a, b := lines(x), lines(y)
+		var gotA, gotB []string
+		ncommon := 0
+		for _, dl := range diffLines(a, b) {
+			if dl.Op != '+' {
+				gotA = append(gotA, dl.Line)
+			}
+			if dl.Op != '-' {
+				gotB = append(gotB, dl.Line)
+			}
+			if dl.Op == ' ' {
+				ncommon++
+			}
+		}
+		return strings.Join(gotA, "") == strings.Join(a, "") &&
+			strings.Join(gotB, "") == strings.Join(b, "") &&
+			ncommon == lcsLen(a, b)
+	}
+
+	err := quick.Check(f, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Error(err)
+	}
+}
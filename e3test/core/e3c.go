@@ -2,20 +2,21 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"e3/cmdutil"
+	"e3/datafmt"
 	"e3/osutil"
 	"e3/store"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
-
-	"github.com/golang/protobuf/proto"
+	"syscall"
+	"time"
 )
 
 type E3C struct {
@@ -87,43 +88,136 @@ func (e3c *E3C) Createdb(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.R
 	return &cmdutil.Resp{}, nil
 }
 
-func pberr(err error) error {
-	return fmt.Errorf("protobuf error (%s)", err)
-}
+// Apply pending schema migrations, in a single transaction.
+//
+// migrate -dryrun
+//   Lists pending migrations and their sql, without applying them.
+//
+// Input request:
+// Nargs["dryrun"] = list pending migrations only
+//
+// Return response:
+// sout = list of migrations applied, or pending with -dryrun
+// Code = number of migrations applied, or pending with -dryrun
+// Nargs["version"] = database schema version
+func (e3c *E3C) Migrate(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	dryrun := cmdutil.FlagOn(req.Nargs, "dryrun")
+
+	var ms []*store.Migration
+	var err error
+	if dryrun {
+		ms, err = e3c.st.PendingMigrations()
+	} else {
+		ms, err = e3c.st.Migrate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("migrate error (%s)", err)
+	}
+
+	for _, m := range ms {
+		fmt.Fprintf(w, "%d: %s\n", m.Version, m.Desc)
+		if dryrun {
+			for _, stmt := range m.DriverStmts(e3c.st.Driver) {
+				fmt.Fprintf(w, "  %s;\n", stmt)
+			}
+		}
+	}
 
-func readNodeList(r io.Reader, nfmt string) (*store.NodeList, error) {
-	bs, err := ioutil.ReadAll(r)
+	version, err := e3c.st.DBSchemaVersion()
 	if err != nil {
-		return nil, fmt.Errorf("update: error reading from input (%s)", err)
+		return nil, err
+	}
+
+	status := fmt.Sprintf("%d migrations applied", len(ms))
+	if dryrun {
+		status = fmt.Sprintf("%d migrations pending", len(ms))
+	}
+	resp := &cmdutil.Resp{
+		Code:   len(ms),
+		Status: status,
+		Nargs: map[string]string{
+			"version": fmt.Sprintf("%d", version),
+		},
 	}
+	return resp, nil
+}
 
-	nl := &store.NodeList{}
-	if nfmt == "" || nfmt == "recj" {
-		nl = store.NodeListFromRecjString(string(bs))
-	} else if nfmt == "protobuf" || nfmt == "pb" {
-		err := proto.Unmarshal(bs, nl)
+// Return node reader for input stream.
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["map"] = csv header to field mapping, Ex. -map=Summary:title,Owner:assigned
+func nodeReader(r io.Reader, nargs map[string]string) (store.NodeReader, error) {
+	nfmt := nargs["inputfmt"]
+	switch nfmt {
+	case "", "recj":
+		return store.NewRecjNodeReader(r), nil
+	case "protobuf", "pb":
+		return store.NewPbNodeReader(r), nil
+	case "json":
+		return store.NewJSONNodeReader(r), nil
+	case "ndjson":
+		return store.NewNDJSONNodeReader(r), nil
+	case "csv":
+		colmap, err := store.ParseCsvColMap(nargs["map"])
 		if err != nil {
-			return nil, pberr(err)
+			return nil, err
 		}
+		return store.NewCSVNodeReader(r, colmap), nil
 	}
 
-	return nl, nil
+	return nil, cmdutil.NewReqError("unknown input format '%s'", nfmt)
+}
+
+// Read node list from input stream, see nodeReader().
+func readNodeList(r io.Reader, nargs map[string]string) (*store.NodeList, error) {
+	nr, err := nodeReader(r, nargs)
+	if err != nil {
+		return nil, err
+	}
+	return store.ReadAllNodes(nr)
 }
 
-func writeNodeList(w io.Writer, nl *store.NodeList, nfmt string) error {
-	if nfmt == "" || nfmt == "recj" {
-		nl.WriteRecjString(w)
-	} else if nfmt == "table" {
-		nl.WriteTableString(w, []string{"id", "assigned", "title", "tags"})
-	} else if nfmt == "protobuf" || nfmt == "pb" {
-		bs, err := proto.Marshal(nl)
+// Return node writer for output stream.
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs["cols"] = csv list of table or csv columns, Ex. -cols=id,title,tags
+func nodeWriter(w io.Writer, nargs map[string]string) (store.NodeWriter, error) {
+	nfmt := nargs["outputfmt"]
+	switch nfmt {
+	case "", "recj":
+		return store.NewRecjNodeWriter(w), nil
+	case "table":
+		cols := []string{"id", "assigned", "title", "tags"}
+		if nargs["cols"] != "" {
+			var err error
+			cols, err = store.ParseCsvCols(nargs["cols"])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return store.NewTableNodeWriter(w, cols), nil
+	case "protobuf", "pb":
+		return store.NewPbNodeWriter(w), nil
+	case "json":
+		return store.NewJSONNodeWriter(w), nil
+	case "ndjson":
+		return store.NewNDJSONNodeWriter(w), nil
+	case "csv":
+		cols, err := store.ParseCsvCols(nargs["cols"])
 		if err != nil {
-			return pberr(err)
+			return nil, err
 		}
-		w.Write(bs)
+		return store.NewCSVNodeWriter(w, cols), nil
 	}
 
-	return nil
+	return nil, cmdutil.NewReqError("unknown output format '%s'", nfmt)
+}
+
+// Write node list to output stream, see nodeWriter().
+func writeNodeList(w io.Writer, nl *store.NodeList, nargs map[string]string) error {
+	nw, err := nodeWriter(w, nargs)
+	if err != nil {
+		return err
+	}
+	return store.WriteAllNodes(nw, nl.Items)
 }
 
 // Cmd-line:
@@ -133,11 +227,13 @@ func writeNodeList(w io.Writer, nl *store.NodeList, nfmt string) error {
 // e new 10                     <--- 10 new blank nodes
 // e new -title="Node Title"    <--- 1 new node with title
 // e new 10 -title="Node Title" <--- 10 new nodes with title
+// e new -title=Fix -.due=2024-06-01 <--- 1 new node with custom field due
 //
 // Input request:
-// Nargs["outputfmt"] = {recj|table|pb}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
 // Args = [num nodes]
 // Nargs = {field1: val, field2: val, ...}
+// Nargs[".{name}"] = custom field value
 //
 // Return response:
 // Code = 0
@@ -153,9 +249,23 @@ func (e3c *E3C) New(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 		}
 	}
 
+	fields := map[string]string{}
+	for k, v := range req.Nargs {
+		if !strings.HasPrefix(k, store.CustomFieldPrefix) {
+			continue
+		}
+		if !store.IsCustomField(k) {
+			return nil, cmdutil.NewReqError("new: invalid custom field name '%s'", k)
+		}
+		fields[k] = v
+	}
+
 	nl := store.NodeList{}
 	for i := 0; i < numNodes; i++ {
 		n := &store.Node{}
+		for field, v := range fields {
+			n.SetFieldVal(field, v)
+		}
 		n.Alias = req.Nargs["alias"]
 		n.Title = req.Nargs["title"]
 		n.Assigned = req.Nargs["assigned"]
@@ -173,7 +283,7 @@ func (e3c *E3C) New(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 		nl.Items = append(nl.Items, n)
 	}
 
-	err := writeNodeList(w, &nl, req.Nargs["outputfmt"])
+	err := writeNodeList(w, &nl, req.Nargs)
 	if err != nil {
 		return nil, err
 	}
@@ -186,9 +296,12 @@ func (e3c *E3C) New(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 }
 
 // Load node IDs and return recj (record-jar) text representation.
+// Each node's basehash is set to its stored hash, for update to detect
+// nodes changed by someone else in the meantime.
+//
 // Input request:
 // Nargs["limit"] = n
-// Nargs["outputfmt"] = {recj|table|pb}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
 // Args = list of node IDs
 //
 // Return response:
@@ -207,39 +320,26 @@ func (e3c *E3C) Load(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 		return &cmdutil.Resp{}, nil
 	}
 
-	var ns []*store.Node
+	if ids[0] == "*" || ids[0] == "-" {
+		return e3c.loadAll(req, w)
+	}
+
 	var errIDs []string
 	var okIDs []string
-	var err error
 	var eb store.ErrorBag
 
-	if ids[0] == "*" || ids[0] == "-" {
-		nlimit, _ := cmdutil.ConvInt(req.Nargs["limit"])
-		var qlimit string
-		if nlimit > 0 {
-			qlimit = fmt.Sprintf("limit %d", nlimit)
-		}
-		ns, err = e3c.st.LoadNodes("id <> ''", "id desc", qlimit)
-		if err != nil {
-			eb.Add(err)
-		}
-	} else {
-		for _, id := range ids {
-			n, err := e3c.st.LoadNodeByID(id)
-			if err != nil {
-				errIDs = append(errIDs, id)
-				eb.Add(fmt.Errorf("error loading node ID %s (%s)\n", id, err))
-				continue
-			}
+	ns, err := e3c.st.LoadNodesByIDs(ids)
+	if err != nil {
+		errIDs = ids
+		eb.Add(fmt.Errorf("error loading node IDs %s (%s)\n", strings.Join(ids, ","), err))
+	}
 
-			if n != nil {
-				okIDs = append(okIDs, id)
-				ns = append(ns, n)
-			}
-		}
+	for _, n := range ns {
+		n.Basehash = n.Hash
+		okIDs = append(okIDs, n.ID)
 	}
 
-	err = writeNodeList(w, &store.NodeList{ns}, req.Nargs["outputfmt"])
+	err = writeNodeList(w, &store.NodeList{Items: ns}, req.Nargs)
 	if err != nil {
 		return nil, err
 	}
@@ -259,12 +359,53 @@ func (e3c *E3C) Load(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 	return resp, nil
 }
 
+// Stream all nodes to output, a batch at a time.
+func (e3c *E3C) loadAll(req *cmdutil.Req, w io.Writer) (*cmdutil.Resp, error) {
+	nw, err := nodeWriter(w, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	nlimit, _ := cmdutil.ConvInt(req.Nargs["limit"])
+	nloaded := 0
+	err = e3c.st.EachNode(nlimit, func(n *store.Node) error {
+		nloaded++
+		n.Basehash = n.Hash
+		return nw.Write(n)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load error (%s)", err)
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cmdutil.Resp{Code: nloaded}, nil
+}
+
 // Update nodes contents.
 //
+// Nodes written by load carry the hash of the node when it was loaded
+// (basehash). A node whose stored hash has changed since then, was saved by
+// someone else in between, and isn't updated unless its changes merge.
+// The base hash is checked by the update itself, so of two concurrent
+// updates from the same base, only the first is saved. A node deleted since
+// loaded is a conflict too.
+//
+// load 1 , map -tags+=urgent , update -merge
+//
 // Input request:
 // sin = nodes recj text representation containing updates
-// Nargs["inputfmt"] = {recj|pb}
-// Nargs["force"]
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["force"] = save nodes even if up to date, or changed since loaded
+// Nargs["merge"] = three-way merge nodes changed since loaded, with the
+//                  base revision they were loaded from: title, alias and
+//                  assigned merge if changed on one side only, tags merge
+//                  as sets, body merges by lines
+// Nargs["atomic"] = save all nodes in a single transaction, if any node
+//                   fails to save, none of the nodes are saved
 //
 // Return response:
 // Code = number of nodes successfully updated
@@ -272,6 +413,8 @@ func (e3c *E3C) Load(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 // Vals = list of node IDs successfully updated
 // Nargs["okIDs"] = list of node IDs successfully loaded
 // Nargs["skippedIDs"] = list of node IDs of up to date nodes
+// Nargs["mergedIDs"] = list of node IDs updated by merging
+// Nargs["conflictIDs"] = list of node IDs changed since loaded, not updated
 // Nargs["errIDs"] = list of node IDs failed to load
 //
 // Return Error: contains newline delimited error messages for each node
@@ -279,45 +422,98 @@ func (e3c *E3C) Load(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 func (e3c *E3C) Update(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
 	var errIDs []string
 	var skippedIDs []string
+	var mergedIDs []string
+	var conflictIDs []string
 	var okIDs []string
 	var berr bytes.Buffer
 
-	nl, err := readNodeList(r, req.Nargs["inputfmt"])
+	nr, err := nodeReader(r, req.Nargs)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, n := range nl.Items {
-		if strings.TrimSpace(n.Title) == "" {
-			if n.ID != "" {
-				skippedIDs = append(skippedIDs, n.ID)
+	atomic := cmdutil.FlagOn(req.Nargs, "atomic")
+	force := cmdutil.FlagOn(req.Nargs, "force")
+	merge := cmdutil.FlagOn(req.Nargs, "merge")
+
+	// Nodes are saved as they're read from input.
+	updateNodes := func(st *store.Store) error {
+		for {
+			n, err := nr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(&berr, "error reading input (%s)\n", err)
+				return err
 			}
-			e3c.logger.Printf("Node %s '%s' has no title. Skipped.\n", n.ID, n.Alias)
-			continue
-		}
 
-		n.Hash = n.HashString()
+			if strings.TrimSpace(n.Title) == "" {
+				if n.ID != "" {
+					skippedIDs = append(skippedIDs, n.ID)
+				}
+				e3c.logger.Printf("Node %s '%s' has no title. Skipped.\n", n.ID, n.Alias)
+				continue
+			}
+
+			n.Hash = n.HashString()
+
+			// --force bypasses the hash 'up to date' and base hash checks
+			if !force {
+				uptodate, _ := st.NodeIsUpToDate(n.ID, n.Hash)
+				if uptodate {
+					skippedIDs = append(skippedIDs, n.ID)
+					e3c.logger.Printf("Node %s '%s' already up to date. Skipped.\n", n.ID, n.Alias)
+					continue
+				}
+			}
+
+			var merged bool
+			if !force && n.ID != "" && n.Basehash != "" {
+				merged, err = saveBasehash(st, n, merge)
+			} else {
+				_, err = st.SaveNode(n)
+			}
+			if errors.Is(err, store.ErrNodeChanged) {
+				conflictIDs = append(conflictIDs, n.ID)
+				fmt.Fprintf(&berr, "conflict node %s '%s' (%s)\n", n.ID, n.Alias, err)
 
-		// --force bypasses the hash 'up to date' check
-		if !cmdutil.FlagOn(req.Nargs, "force") {
-			uptodate, _ := e3c.st.NodeIsUpToDate(n.ID, n.Hash)
-			if uptodate {
-				skippedIDs = append(skippedIDs, n.ID)
-				e3c.logger.Printf("Node %s '%s' already up to date. Skipped.\n", n.ID, n.Alias)
+				if atomic {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				if n.ID != "" {
+					errIDs = append(errIDs, n.ID)
+				}
+				fmt.Fprintf(&berr, "error saving node %s '%s' (%s)\n", n.ID, n.Alias, err)
+
+				// Abort transaction, no nodes are saved.
+				if atomic {
+					return err
+				}
 				continue
 			}
-		}
 
-		_, err := e3c.st.SaveNode(n)
-		if err != nil {
-			if n.ID != "" {
-				errIDs = append(errIDs, n.ID)
+			if merged {
+				mergedIDs = append(mergedIDs, n.ID)
 			}
-			fmt.Fprintf(&berr, "error saving node %s '%s' (%s)", n.ID, n.Alias, err)
+			okIDs = append(okIDs, n.ID)
+			e3c.logger.Printf("Updated node %s '%s'\n", n.ID, n.Alias)
 		}
+		return nil
+	}
 
-		okIDs = append(okIDs, n.ID)
-		e3c.logger.Printf("Updated node %s '%s'\n", n.ID, n.Alias)
+	if atomic {
+		err = e3c.st.WithTx(updateNodes)
+		if err != nil {
+			fmt.Fprintf(&berr, "update rolled back, %d nodes not saved\n", len(okIDs))
+			okIDs = nil
+		}
+	} else {
+		// Nodes saved before a read error stay saved.
+		updateNodes(e3c.st)
 	}
 
 	resp := &cmdutil.Resp{
@@ -325,9 +521,11 @@ func (e3c *E3C) Update(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Res
 		Status: strings.Join(okIDs, ","),
 		Args:   okIDs,
 		Nargs: map[string]string{
-			"okIDs":      strings.Join(okIDs, ","),
-			"skippedIDs": strings.Join(skippedIDs, ","),
-			"errIDs":     strings.Join(errIDs, ","),
+			"okIDs":       strings.Join(okIDs, ","),
+			"skippedIDs":  strings.Join(skippedIDs, ","),
+			"mergedIDs":   strings.Join(mergedIDs, ","),
+			"conflictIDs": strings.Join(conflictIDs, ","),
+			"errIDs":      strings.Join(errIDs, ","),
 		},
 	}
 
@@ -339,9 +537,71 @@ func (e3c *E3C) Update(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Res
 	return resp, nil
 }
 
+// Save node n if it wasn't changed since it was loaded from its base hash.
+// If it was, and merge is set, merge n's changes with the stored node and
+// save the merged node.
+// Checking the hash and saving is a single conditional update, a node
+// saved concurrently is never overwritten.
+// Returns true if n was merged, and an error wrapping store.ErrNodeChanged
+// if n conflicts with the stored node.
+func saveBasehash(st *store.Store, n *store.Node, merge bool) (bool, error) {
+	_, err := st.SaveNodeIfHash(n, n.Basehash)
+	if !errors.Is(err, store.ErrNodeChanged) || !merge {
+		return false, err
+	}
+
+	err = st.WithTx(func(tx *store.Store) error {
+		cur, err := tx.LoadNodeByID(n.ID)
+		if err != nil {
+			return err
+		}
+		if cur == nil {
+			return fmt.Errorf("node deleted since loaded (%w)", store.ErrNodeChanged)
+		}
+
+		base, err := loadBaseRev(tx, n.ID, n.Basehash)
+		if err != nil {
+			return err
+		}
+		if base == nil {
+			return fmt.Errorf("base revision not found (%w)", store.ErrNodeChanged)
+		}
+
+		err = mergeNode(n, base, cur)
+		if err != nil {
+			return fmt.Errorf("merge failed, %s (%w)", err, store.ErrNodeChanged)
+		}
+		n.Hash = n.HashString()
+
+		// Merged with cur, so saved only if cur wasn't changed meanwhile.
+		_, err = tx.SaveNodeIfHash(n, cur.Hash)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Return latest revision of node ID with hash, nil if there is none.
+func loadBaseRev(st *store.Store, id, hash string) (*store.Node, error) {
+	nrs, err := st.LoadNodeRevs(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(nrs) - 1; i >= 0; i-- {
+		if nrs[i].Node.Hash == hash {
+			return nrs[i].Node, nil
+		}
+	}
+	return nil, nil
+}
+
 // Search nodes and return recj text representation of nodes found.
+// Custom fields are searched by name, Ex. search Fields.priority:high
+//
 // Input request:
-// Nargs["outputfmt"] = {recj|table|pb}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
 // Nargs["limit"] = n
 // Args[0] = search request string
 //
@@ -377,17 +637,13 @@ func (e3c *E3C) Search(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Res
 	}
 
 	q := b.String()
-	ns, err := e3c.st.SearchNodes(q)
+	nlimit, _ := cmdutil.ConvInt(req.Nargs["limit"])
+	ns, err := e3c.st.SearchNodes(q, nlimit, 0)
 	if err != nil {
 		return nil, fmt.Errorf("find error (%s)\n", err)
 	}
 
-	nlimit, _ := cmdutil.ConvInt(req.Nargs["limit"])
-	if nlimit > 0 && nlimit < len(ns) {
-		ns = ns[:nlimit]
-	}
-
-	err = writeNodeList(w, &store.NodeList{ns}, req.Nargs["outputfmt"])
+	err = writeNodeList(w, &store.NodeList{Items: ns}, req.Nargs)
 	if err != nil {
 		return nil, err
 	}
@@ -404,8 +660,22 @@ func (e3c *E3C) Search(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Res
 	return resp, nil
 }
 
-// Find nodes and return recj text representation of nodes found.
+// Find nodes matching field predicates and return recj text representation
+// of nodes found.
+//
+// find -assigned=rob -tags=urgent -updated>=2024-01-01 -title~=^Bug
+//   Returns nodes assigned to rob, tagged urgent, updated on or after
+//   2024-01-01, with title matching regex ^Bug.
+//
+// find -.priority=high -orderby=.due
+//   Returns nodes with custom field priority high, by custom field due.
+//
 // Input request:
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs["limit"] = n
+// Nargs["orderby"] = csv list of fields, each optionally followed by asc|desc
+// Nargs["cols"] = csv list of table or csv columns
+// Nargs[{field}{op}] = val, where op is one of =, !=, <, <=, >, >=, ~=
 //
 // Return response:
 // sout = found nodes recj text representation
@@ -413,11 +683,77 @@ func (e3c *E3C) Search(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Res
 // Status = csv text list of node IDs found
 // Vals = list of node IDs found
 func (e3c *E3C) Find(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
-	return &cmdutil.Resp{}, nil
+	conds, err := parseNodeConds(req.Nargs, "outputfmt", "cols", "limit", "orderby")
+	if err != nil {
+		return nil, cmdutil.NewReqError("find error (%s)", err)
+	}
+
+	var qorderby string
+	if req.Nargs["orderby"] != "" {
+		qorderby, err = store.ParseNodeOrderBy(req.Nargs["orderby"])
+		if err != nil {
+			return nil, cmdutil.NewReqError("find error (%s)", err)
+		}
+	}
+
+	nlimit, _ := cmdutil.ConvInt(req.Nargs["limit"])
+	ns, err := e3c.st.FindNodes(conds, qorderby, nlimit, 0)
+	if err != nil {
+		return nil, fmt.Errorf("find error (%s)", err)
+	}
+
+	err = writeNodeList(w, &store.NodeList{Items: ns}, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var foundIDs []string
+	for _, n := range ns {
+		foundIDs = append(foundIDs, n.ID)
+	}
+	resp := &cmdutil.Resp{
+		Code:   len(ns),
+		Status: strings.Join(foundIDs, ","),
+		Args:   foundIDs,
+	}
+	return resp, nil
 }
 
+// Default number of nodes committed to the search index per batch.
+const defaultIndexBatchSize = 100
+
+// Default polling interval of bgindex -watch.
+const defaultIndexInterval = 10 * time.Second
+
+// Max wait between polls when indexing keeps failing.
+const maxIndexBackoff = 5 * time.Minute
+
 // Reindex any new/updated nodes since the last indexing request.
+// Nodes that no longer exist are removed from the index.
+//
+// bgindex            <--- index changed nodes once
+// bgindex -watch     <--- keep indexing changed nodes until SIGINT/SIGTERM
+//
+// Input request:
+// Nargs["batchsize"] = number of nodes per index batch,
+//                      default is the indexbatchsize= setting, or 100
+// Nargs["watch"]
+// Nargs["interval"] = -watch polling interval, Ex. 30s, 5m
+//                     default is the indexinterval= setting, or 10s
+//
+// Return response:
+// Code = number of nodes indexed
 func (e3c *E3C) BgIndex(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	batchSize := e3c.indexBatchSize(req.Nargs)
+
+	if cmdutil.FlagOn(req.Nargs, "watch") {
+		ctx, cancel := osutil.SignalContext(req.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		e3c.WatchIndex(ctx, e3c.indexInterval(req.Nargs), batchSize)
+		return &cmdutil.Resp{}, nil
+	}
+
 	ids, err := e3c.st.QueryChangedNodes()
 	if err != nil {
 		return nil, fmt.Errorf("error querying nodechange (%s)\n", err)
@@ -428,100 +764,172 @@ func (e3c *E3C) BgIndex(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Re
 		return &cmdutil.Resp{}, nil
 	}
 
-	fmt.Fprintf(w, "Indexing %d nodes...\n", len(ids))
+	logf := func(format string, v ...interface{}) {
+		fmt.Fprintf(w, format, v...)
+	}
+	nindexed, _ := e3c.indexNodeIDs(req.Context(), ids, batchSize, logf)
+
+	resp := &cmdutil.Resp{
+		Code:   nindexed,
+		Status: fmt.Sprintf("%d nodes indexed", nindexed),
+	}
+	return resp, nil
+}
 
-	for _, id := range ids {
-		n, err := e3c.st.LoadNodeByID(id)
+// Poll for changed nodes every interval and index them, until ctx is done.
+// Polling backs off while indexing fails, up to maxIndexBackoff.
+// A batch being indexed when ctx is done is completed before returning.
+// interval or batchSize <= 0 uses the indexinterval= and indexbatchsize=
+// settings, or their defaults.
+func (e3c *E3C) WatchIndex(ctx context.Context, interval time.Duration, batchSize int) {
+	if interval <= 0 {
+		interval = e3c.indexInterval(nil)
+	}
+	if batchSize <= 0 {
+		batchSize = e3c.indexBatchSize(nil)
+	}
+
+	logger := e3c.st.Logger
+	logger.Printf("Watching for changed nodes every %s...\n", interval)
+
+	wait := interval
+	for {
+		var nindexed int
+		ids, err := e3c.st.QueryChangedNodes()
 		if err != nil {
-			fmt.Fprintf(w, "Skipped %s - error loading node (%s)\n", id, err)
-			continue
+			err = fmt.Errorf("error querying nodechange (%s)", err)
+		} else if len(ids) > 0 {
+			nindexed, err = e3c.indexNodeIDs(ctx, ids, batchSize, logger.Printf)
 		}
 
-		if n == nil {
-			fmt.Fprintf(w, "Skipped %s - node ID doesn't exist\n", id)
-
-			err = e3c.st.ClearNodeChanged(id)
-			if err != nil {
-				fmt.Fprintf(w, "Error clearing nodechange %s (%s)\n", id, err)
+		if err != nil {
+			wait *= 2
+			if wait > maxIndexBackoff {
+				wait = maxIndexBackoff
+			}
+			logger.Printf("bgindex: %s, retrying in %s\n", err, wait)
+		} else {
+			wait = interval
+			if nindexed > 0 {
+				logger.Printf("bgindex: %d nodes indexed\n", nindexed)
 			}
-			continue
 		}
 
-		err = e3c.st.IndexNode(n)
-		if err != nil {
-			fmt.Fprintf(w, "Skipped %s %s - error indexing node (%s)\n", n.ID, n.Alias, err)
-			continue
+		select {
+		case <-ctx.Done():
+			logger.Printf("bgindex: stopped\n")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (e3c *E3C) indexInterval(nargs map[string]string) time.Duration {
+	for _, s := range []string{nargs["interval"], e3c.opts["indexinterval"]} {
+		d, ok := cmdutil.ConvDuration(s)
+		if ok && d > 0 {
+			return d
+		}
+	}
+	return defaultIndexInterval
+}
+
+// Index changed node ids in batches of batchSize.
+// Stops before the next batch if ctx is done.
+// Returns number of nodes indexed, and error if any batch failed.
+func (e3c *E3C) indexNodeIDs(ctx context.Context, ids []string, batchSize int, logf func(format string, v ...interface{})) (int, error) {
+	logf("Indexing %d nodes...\n", len(ids))
+
+	var eb store.ErrorBag
+	nindexed := 0
+	for i := 0; i < len(ids); i += batchSize {
+		if ctx.Err() != nil {
+			break
 		}
 
-		fmt.Fprintf(w, "Node %s %s added to index\n", n.ID, n.Alias)
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
 
-		err = e3c.st.ClearNodeChanged(id)
+		nadded, nremoved, err := e3c.indexBatch(ids[i:end])
 		if err != nil {
-			fmt.Fprintf(w, "Error clearing nodechange %s (%s)\n", id, err)
+			logf("Skipped %d nodes - %s\n", end-i, err)
+			eb.Add(err)
 			continue
 		}
+		nindexed += nadded
+
+		logf("%d nodes added to index, %d removed\n", nadded, nremoved)
 	}
 
-	return &cmdutil.Resp{}, nil
+	if eb.HasErrors() {
+		return nindexed, eb
+	}
+	return nindexed, nil
 }
 
-// Launch external editor to edit input stream.
-// This copies input stream to tmp file and passes it to an external program
-// such as vim to edit the input text.
-// The saved text is copied to the output stream.
-//
-// Input request:
-// sin = text to edit
-//
-// Return response:
-// sout = saved edited text
-func (e3c *E3C) Edit(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
-	ftmp, err := ioutil.TempFile("", "_e3")
-	if err != nil {
-		return nil, fmt.Errorf("error creating node tmp file (%s)", err)
+func (e3c *E3C) indexBatchSize(nargs map[string]string) int {
+	batchSize, _ := cmdutil.ConvInt(nargs["batchsize"])
+	if batchSize <= 0 {
+		batchSize, _ = cmdutil.ConvInt(e3c.opts["indexbatchsize"])
+	}
+	if batchSize <= 0 {
+		batchSize = defaultIndexBatchSize
 	}
+	return batchSize
+}
 
-	// input -> tmpfile
-	_, err = io.Copy(ftmp, r)
+// Index changed node ids as one batch, removing any missing nodes from the
+// index, then clear the nodes' changed status.
+// Returns number of nodes added to and removed from index.
+func (e3c *E3C) indexBatch(ids []string) (int, int, error) {
+	ns, err := e3c.st.LoadNodesByIDs(ids)
 	if err != nil {
-		return nil, fmt.Errorf("edit2: error writing input to tmp file %s (%s)", ftmp.Name(), err)
+		return 0, 0, fmt.Errorf("error loading nodes (%s)", err)
 	}
-	ftmp.Close()
-	e3c.logger.Printf("Generated new node tmp file %s\n", ftmp.Name())
 
-	err = osutil.RunCommand("gvim", "-f", ftmp.Name())
-	if err != nil {
-		return nil, fmt.Errorf("error running external editor (%s)", err)
+	found := map[string]bool{}
+	for _, n := range ns {
+		found[n.ID] = true
+	}
+	var delIDs []string
+	for _, id := range ids {
+		if !found[id] {
+			delIDs = append(delIDs, id)
+		}
 	}
 
-	ftmp, err = os.Open(ftmp.Name())
+	err = e3c.st.IndexNodes(ns, delIDs)
 	if err != nil {
-		return nil, fmt.Errorf("edit2: error opening edited tmp file (%s)", err)
+		return 0, 0, err
 	}
 
-	_, err = io.Copy(w, ftmp)
+	err = e3c.st.ClearNodesChanged(ids)
 	if err != nil {
-		return nil, fmt.Errorf("edit2: error writing edits to output (%s)", err)
+		return len(ns), len(delIDs), fmt.Errorf("error clearing nodechange (%s)", err)
 	}
-	ftmp.Close()
 
-	return &cmdutil.Resp{}, nil
+	return len(ns), len(delIDs), nil
 }
 
 // Pass input stream directly to output stream.
+//
+// echo $prev.nargs.okIDs
+//   With args, writes the args instead of the input.
+//
+// Input request:
+// Args = text to write, space separated
 func (e3c *E3C) Echo(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
-	var b bytes.Buffer
-	_, err := io.Copy(&b, r)
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = io.Copy(os.Stdout, &b)
-	if err != nil {
-		return &cmdutil.Resp{}, err
+	if len(req.Args) > 0 {
+		_, err := fmt.Fprintln(w, strings.Join(req.Args, " "))
+		if err != nil {
+			return nil, err
+		}
+		return &cmdutil.Resp{Args: req.Args}, nil
 	}
 
-	_, err = io.Copy(w, &b)
+	_, err := io.Copy(w, r)
 	if err != nil {
 		return &cmdutil.Resp{}, err
 	}
@@ -529,52 +937,49 @@ func (e3c *E3C) Echo(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 	return &cmdutil.Resp{}, nil
 }
 
-// Apply operation to all input nodes.
-// Used primarily to set multiple fields for each input node.
+// Set pipeline variables, referenced by later statements as $name.
+// Input is passed to output, and $prev vars are left unchanged.
 //
-// map .assigned=robtwister tags+="new tag",tag2 tags-=oldtag
-//   This will set field assigned to the value 'robtwister',
-//   add 'new tag', and 'tag2' to node tags,
-//   remove 'oldtag' from node tags (if it's present).
+// set who=rob tag=urgent , find -assigned=$who -tags=$tag
+// set -who="rob twister"
 //
 // Input request:
-// sin = input nodes recj text representation
-// Nargs["inputfmt"] = {recj|pb}
-// Nargs["outputfmt"] = {recj|table|pb}
-// Nargs[{field}] = val to assign to
-//
-// Return response:
-// sout = updated nodes recj text representation
-func (e3c *E3C) Map(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
-	nl, err := readNodeList(r, req.Nargs["inputfmt"])
-	if err != nil {
-		return nil, err
+// sin = input passed to output
+// Args = list of name=value
+// Nargs[name] = value
+func (e3c *E3C) Set(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	vars := map[string]string{}
+	for _, arg := range req.Args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, cmdutil.NewReqError("set: invalid arg '%s', expected name=value", arg)
+		}
+		vars[arg[:i]] = arg[i+1:]
+	}
+	for k, v := range req.Nargs {
+		vars[k] = v
 	}
 
-	for _, n := range nl.Items {
-		for k, v := range req.Nargs {
-			switch k {
-			case "alias":
-				n.Alias = v
-			case "title":
-				n.Title = v
-			case "title+":
-				n.Title += v
-			case "assigned":
-				n.Assigned = v
-			case "body":
-				n.Body = v
-			case "body+":
-				n.Body += v
-			case "tags+":
-				n.ProcessCsvTags(v, n.AddTag)
-			case "tags-":
-				n.ProcessCsvTags(v, n.RemoveTag)
+	for name := range vars {
+		runes := []rune(name)
+		valid := len(runes) > 0 && isVarNameStart(runes[0]) && !strings.HasPrefix(name, "prev.")
+		for _, c := range runes {
+			if !isVarNameChar(c) {
+				valid = false
 			}
 		}
+		if !valid {
+			return nil, cmdutil.NewReqError("set: invalid variable name '%s'", name)
+		}
+	}
+
+	if req.Vars != nil {
+		for k, v := range vars {
+			req.Vars[k] = v
+		}
 	}
 
-	err = writeNodeList(w, nl, req.Nargs["outputfmt"])
+	_, err := io.Copy(w, r)
 	if err != nil {
 		return nil, err
 	}
@@ -582,32 +987,875 @@ func (e3c *E3C) Map(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp,
 	return &cmdutil.Resp{}, nil
 }
 
-func (e3c *E3C) HttpRoot(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// Apply operations to all input nodes.
+// Used primarily to set multiple fields for each input node.
+// Operations are applied in the order given.
+//
+// map -assigned=robtwister -tags+="new tag",tag2 -tags-=oldtag
+//   This will set field assigned to the value 'robtwister',
+//   add 'new tag', and 'tag2' to node tags,
+//   remove 'oldtag' from node tags (if it's present).
+//
+// map -title/s=^TODO:/DONE:/ -body/s=/foo/bar/gi
+//   Replaces 'TODO:' at the start of the title with 'DONE:',
+//   and every 'foo' in the body, in any case, with 'bar'.
+//
+// map -title="{{.Alias}}: {{.Title}}"
+//   Sets the title from the node's alias and title.
+//
+// map -if tags=urgent -assigned=rob
+//   Assigns only nodes tagged urgent to rob, other nodes are passed
+//   on unchanged.
+//
+// map -links+=blocks:ID1,ref:ID2 -links-=parent:ID3
+//   This will link each input node to ID1 (blocks) and ID2 (ref),
+//   and remove its parent link to ID3.
+//   Links are saved to the store directly, input nodes must already exist.
+//
+// Input request:
+// sin = input nodes recj text representation
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs[{field}{op}] = operation, see mapOp
+// Nargs["if"] = field predicate nodes must satisfy to be mapped (see Find),
+//               or if blank, Args are the predicates
+//
+// Return response:
+// sout = updated nodes recj text representation
+// Code = number of nodes mapped, or with links set
+// Nargs["mappedIDs"] = list of node IDs satisfying -if guards
+// Nargs["okIDs"] = list of node IDs with links successfully set
+// Nargs["errIDs"] = list of node IDs with links failing to be set
+//
+// Return Error: contains newline delimited error messages for each link
+//               failing to be set, Ex. link target node doesn't exist
+func (e3c *E3C) Map(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	ops, err := parseMapOps(req.NargList)
+	if err != nil {
+		return nil, cmdutil.NewReqError("map error (%s)", err)
+	}
+	guards, err := parseMapGuards(req)
+	if err != nil {
+		return nil, cmdutil.NewReqError("map error (%s)", err)
+	}
+
+	addLinks, err := store.ParseLinkTargets(req.Nargs["links+"])
+	if err != nil {
+		return nil, cmdutil.NewReqError("map error (%s)", err)
+	}
+	removeLinks, err := store.ParseLinkTargets(req.Nargs["links-"])
+	if err != nil {
+		return nil, cmdutil.NewReqError("map error (%s)", err)
+	}
+	mapLinks := len(addLinks) > 0 || len(removeLinks) > 0
 
-	fmt.Println("Headers:")
-	fmt.Println(r.Header)
+	nr, nw, err := nodeStreams(r, w, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappedIDs []string
+	var okIDs []string
+	var errIDs []string
+	var eb store.ErrorBag
+
+	err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+		if !store.MatchAll(guards, n) {
+			return true, nw.Write(n)
+		}
+		mappedIDs = append(mappedIDs, n.ID)
+
+		if mapLinks {
+			err := e3c.mapLinks(n, addLinks, removeLinks)
+			if err != nil {
+				errIDs = append(errIDs, n.ID)
+				eb.Add(err)
+			} else {
+				okIDs = append(okIDs, n.ID)
+			}
+		}
+
+		for _, op := range ops {
+			err := op.apply(n)
+			if err != nil {
+				return false, fmt.Errorf("map error node %s (%s)", n.ID, err)
+			}
+		}
 
-	bs, err := ioutil.ReadAll(r.Body)
+		return true, nw.Write(n)
+	})
 	if err != nil {
-		fmt.Println("err: ", err)
+		return nil, err
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &cmdutil.Resp{
+		Code: len(mappedIDs),
+		Nargs: map[string]string{
+			"mappedIDs": strings.Join(mappedIDs, ","),
+		},
+	}
+	if mapLinks {
+		resp.Code = len(okIDs)
+		resp.Status = strings.Join(okIDs, ",")
+		resp.Args = okIDs
+		resp.Nargs["okIDs"] = strings.Join(okIDs, ",")
+		resp.Nargs["errIDs"] = strings.Join(errIDs, ",")
+	}
+	if eb.HasErrors() {
+		return resp, eb
+	}
+	return resp, nil
+}
+
+// Add and remove links from node n.
+func (e3c *E3C) mapLinks(n *store.Node, addLinks, removeLinks []*store.NodeLink) error {
+	if n.ID == "" {
+		return fmt.Errorf("can't link node '%s' with no ID, update it first", n.Title)
+	}
+
+	var eb store.ErrorBag
+	for _, l := range removeLinks {
+		err := e3c.st.RemoveNodeLink(n.ID, l.ToID, l.Rel)
+		if err != nil {
+			eb.Add(fmt.Errorf("error removing link %s %s:%s (%s)", n.ID, l.Rel, l.ToID, err))
+		}
+	}
+	for _, l := range addLinks {
+		err := e3c.st.AddNodeLink(n.ID, l.ToID, l.Rel)
+		if err != nil {
+			eb.Add(fmt.Errorf("error adding link %s %s:%s (%s)", n.ID, l.Rel, l.ToID, err))
+		}
+	}
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
+// List revisions of nodes.
+//
+// history {node IDs}
+//
+// Input request:
+// Nargs["outputfmt"] = {recj|table}
+// Args = list of node IDs
+//
+// Return response:
+// sout = revisions recj text representation, one record per revision
+// Code = number of revisions listed
+// Status = csv text list of node IDs with revisions
+// Vals = list of node IDs with revisions
+func (e3c *E3C) History(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	var recjs datafmt.Recjs
+	var okIDs []string
+	var eb store.ErrorBag
+
+	for _, id := range cmdutil.RemoveDups(req.Args) {
+		nrs, err := e3c.st.LoadNodeRevs(id)
+		if err != nil {
+			eb.Add(fmt.Errorf("error loading revisions of node ID %s (%s)", id, err))
+			continue
+		}
+		if len(nrs) > 0 {
+			okIDs = append(okIDs, id)
+		}
+
+		for _, nr := range nrs {
+			recj := datafmt.NewRecj()
+			recj.AddField("id", nr.Node.ID)
+			recj.AddField("rev", fmt.Sprintf("%d", nr.Rev))
+			recj.AddField("savedt", nr.Savedt)
+			recj.AddField("hash", nr.Node.Hash)
+			recj.AddField("alias", nr.Node.Alias)
+			recj.AddField("title", nr.Node.Title)
+			recj.AddField("assigned", nr.Node.Assigned)
+			recj.AddField("tags", strings.Join(nr.Node.Tags, store.TagSep()))
+			recjs = append(recjs, recj)
+		}
+	}
+
+	switch req.Nargs["outputfmt"] {
+	case "", "recj":
+		recjs.WriteString(w)
+	case "table":
+		recjs.WriteTableString(w, []string{"id", "rev", "savedt", "title"})
+	default:
+		return nil, cmdutil.NewReqError("unknown output format '%s'", req.Nargs["outputfmt"])
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   len(recjs),
+		Status: strings.Join(okIDs, ","),
+		Args:   okIDs,
+	}
+	if eb.HasErrors() {
+		return resp, eb
+	}
+	return resp, nil
+}
+
+// Load revision of node.
+// rev <= 0 is relative to the latest revision: 0 is the latest,
+// -1 the one before it, and so on.
+func (e3c *E3C) loadNodeRev(id string, rev int) (*store.NodeRev, error) {
+	if rev <= 0 {
+		nrs, err := e3c.st.LoadNodeRevs(id)
+		if err != nil {
+			return nil, err
+		}
+
+		i := len(nrs) - 1 + rev
+		if i < 0 {
+			return nil, fmt.Errorf("node %s has no revision %d (%d revisions)", id, rev, len(nrs))
+		}
+		return nrs[i], nil
+	}
+
+	nr, err := e3c.st.LoadNodeRev(id, rev)
+	if err != nil {
+		return nil, err
+	}
+	if nr == nil {
+		return nil, fmt.Errorf("node %s has no revision %d", id, rev)
+	}
+	return nr, nil
+}
+
+func revArg(args []string, i int, defaultRev int) (int, error) {
+	if len(args) <= i {
+		return defaultRev, nil
+	}
+
+	rev, ok := cmdutil.ConvInt(args[i])
+	if !ok {
+		return 0, cmdutil.NewReqError("invalid revision '%s'", args[i])
+	}
+	return rev, nil
+}
+
+// Show field differences between two revisions of a node.
+//
+// diff {node ID} {rev1} {rev2}
+//
+// diff ID        <--- previous revision to latest revision
+// diff ID 3      <--- revision 3 to latest revision
+// diff ID 3 5    <--- revision 3 to revision 5
+//
+// Input request:
+// Args[0] = node ID
+// Args[1] = from revision number
+// Args[2] = to revision number
+//
+// Return response:
+// sout = diff text, listing each changed field with removed lines
+//        prefixed by '-' and added lines prefixed by '+'
+// Code = number of fields changed
+func (e3c *E3C) Diff(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	if len(req.Args) == 0 {
+		return nil, cmdutil.NewReqError("diff: node ID required")
+	}
+	id := req.Args[0]
+
+	rev1, err := revArg(req.Args, 1, -1)
+	if err != nil {
+		return nil, err
+	}
+	rev2, err := revArg(req.Args, 2, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	nr1, err := e3c.loadNodeRev(id, rev1)
+	if err != nil {
+		return nil, fmt.Errorf("diff: %s", err)
+	}
+	nr2, err := e3c.loadNodeRev(id, rev2)
+	if err != nil {
+		return nil, fmt.Errorf("diff: %s", err)
+	}
+
+	n1 := nr1.Node
+	n2 := nr2.Node
+
+	fmt.Fprintf(w, "--- %s rev %d (%s)\n", id, nr1.Rev, nr1.Savedt)
+	fmt.Fprintf(w, "+++ %s rev %d (%s)\n", id, nr2.Rev, nr2.Savedt)
+
+	fields := [][]string{
+		{"alias", n1.Alias, n2.Alias},
+		{"title", n1.Title, n2.Title},
+		{"assigned", n1.Assigned, n2.Assigned},
+		{"tags", strings.Join(n1.Tags, store.TagSep()), strings.Join(n2.Tags, store.TagSep())},
+	}
+	for _, name := range customFieldNames(n1, n2) {
+		field := store.CustomFieldPrefix + name
+		fields = append(fields, []string{field, n1.FieldVal(field), n2.FieldVal(field)})
+	}
+	fields = append(fields, []string{"body", n1.Body, n2.Body})
+
+	nchanged := 0
+	for _, f := range fields {
+		if f[1] != f[2] {
+			nchanged++
+		}
+		writeFieldDiff(w, f[0], f[1], f[2])
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   nchanged,
+		Status: fmt.Sprintf("%d fields changed", nchanged),
+	}
+	return resp, nil
+}
+
+// Return node contents as of an earlier revision.
+// Pass the output to update to restore the node to that revision.
+//
+// revert {node ID} {rev}
+//
+// revert ID 3 , update    <--- restore node to revision 3
+// revert ID , update      <--- restore node to the previous revision
+//
+// Input request:
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Args[0] = node ID
+// Args[1] = revision number
+//
+// Return response:
+// sout = node recj text representation as of revision
+// Code = revision number
+func (e3c *E3C) Revert(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	if len(req.Args) == 0 {
+		return nil, cmdutil.NewReqError("revert: node ID required")
+	}
+	id := req.Args[0]
+
+	rev, err := revArg(req.Args, 1, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	nr, err := e3c.loadNodeRev(id, rev)
+	if err != nil {
+		return nil, fmt.Errorf("revert: %s", err)
+	}
+
+	// Keep current node's dates, only contents are reverted.
+	n := nr.Node
+	cur, err := e3c.st.LoadNodeByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("revert: error loading node ID %s (%s)", id, err)
+	}
+	if cur != nil {
+		n.Createdt = cur.Createdt
+		n.Updatedt = cur.Updatedt
+	}
+
+	err = writeNodeList(w, &store.NodeList{Items: []*store.Node{n}}, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   nr.Rev,
+		Status: fmt.Sprintf("%s rev %d", id, nr.Rev),
+		Args:   []string{id},
+	}
+	return resp, nil
+}
+
+// Load nodes linked from node IDs.
+//
+// links {node IDs} -rel={relation}
+//
+// links ID -rel=blocks    <--- nodes blocked by node ID
+//
+// Input request:
+// Nargs["rel"] = relation, blank for all relations
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Args = list of node IDs
+//
+// Return response:
+// sout = linked nodes recj text representation
+// Code = number of linked nodes
+// Status = csv text list of linked node IDs
+// Vals = list of linked node IDs
+// Nargs["missingIDs"] = list of link target IDs with no existing node
+func (e3c *E3C) Links(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	return e3c.writeLinkedNodes(req, w, false)
+}
+
+// Load nodes linking to node IDs.
+//
+// backlinks {node IDs} -rel={relation}
+//
+// backlinks ID -rel=parent    <--- child nodes of node ID
+//
+// Input request:
+// Nargs["rel"] = relation, blank for all relations
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Args = list of node IDs
+//
+// Return response:
+// sout = linking nodes recj text representation
+// Code = number of linking nodes
+// Status = csv text list of linking node IDs
+// Vals = list of linking node IDs
+// Nargs["missingIDs"] = list of link source IDs with no existing node
+func (e3c *E3C) Backlinks(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	return e3c.writeLinkedNodes(req, w, true)
+}
+
+func (e3c *E3C) writeLinkedNodes(req *cmdutil.Req, w io.Writer, back bool) (*cmdutil.Resp, error) {
+	var ns []*store.Node
+	var linkedIDs []string
+	var missingIDs []string
+	var eb store.ErrorBag
+
+	rel := req.Nargs["rel"]
+	seen := map[string]bool{}
+
+	for _, id := range cmdutil.RemoveDups(req.Args) {
+		var ls []*store.NodeLink
+		var err error
+		if back {
+			ls, err = e3c.st.LoadNodeBacklinks(id, rel)
+		} else {
+			ls, err = e3c.st.LoadNodeLinks(id, rel)
+		}
+		if err != nil {
+			eb.Add(fmt.Errorf("error loading links of node ID %s (%s)", id, err))
+			continue
+		}
+
+		for _, l := range ls {
+			linkedID := l.ToID
+			if back {
+				linkedID = l.FromID
+			}
+			if seen[linkedID] {
+				continue
+			}
+			seen[linkedID] = true
+
+			n, err := e3c.st.LoadNodeByID(linkedID)
+			if err != nil {
+				eb.Add(fmt.Errorf("error loading linked node ID %s (%s)", linkedID, err))
+				continue
+			}
+			if n == nil {
+				missingIDs = append(missingIDs, linkedID)
+				e3c.logger.Printf("Link %s refers to missing node %s\n", l, linkedID)
+				continue
+			}
+
+			linkedIDs = append(linkedIDs, linkedID)
+			ns = append(ns, n)
+		}
+	}
+
+	err := writeNodeList(w, &store.NodeList{Items: ns}, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   len(linkedIDs),
+		Status: strings.Join(linkedIDs, ","),
+		Args:   linkedIDs,
+		Nargs: map[string]string{
+			"missingIDs": strings.Join(missingIDs, ","),
+		},
+	}
+	if eb.HasErrors() {
+		return resp, eb
+	}
+	return resp, nil
+}
+
+// Return node IDs given in args, or if none, IDs of nodes in input stream.
+func inputNodeIDs(req *cmdutil.Req, r io.Reader) ([]string, error) {
+	if len(req.Args) > 0 {
+		return cmdutil.RemoveDups(req.Args), nil
+	}
+
+	nl, err := readNodeList(r, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, n := range nl.Items {
+		if n.ID != "" {
+			ids = append(ids, n.ID)
+		}
+	}
+	return cmdutil.RemoveDups(ids), nil
+}
+
+// Delete nodes, moving them to the trash.
+//
+// delete {node IDs}
+// load ID1 ID2 , delete
+//
+// Input request:
+// sin = nodes recj text representation, used if no node IDs in args
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Args = list of node IDs
+//
+// Return response:
+// Code = number of nodes deleted
+// Status = csv text list of node IDs deleted
+// Vals = list of node IDs deleted
+// Nargs["okIDs"] = list of node IDs deleted
+// Nargs["errIDs"] = list of node IDs failed to delete
+//
+// Return Error: contains newline delimited error messages for each node
+//               failing to delete
+func (e3c *E3C) Delete(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	ids, err := inputNodeIDs(req, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var okIDs []string
+	var errIDs []string
+	var eb store.ErrorBag
+
+	for _, id := range ids {
+		ok, err := e3c.st.TrashNode(id)
+		if err != nil {
+			errIDs = append(errIDs, id)
+			eb.Add(fmt.Errorf("error deleting node ID %s (%s)", id, err))
+			continue
+		}
+		if !ok {
+			errIDs = append(errIDs, id)
+			eb.Add(fmt.Errorf("error deleting node ID %s (node doesn't exist)", id))
+			continue
+		}
+
+		okIDs = append(okIDs, id)
+		e3c.logger.Printf("Deleted node %s\n", id)
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   len(okIDs),
+		Status: strings.Join(okIDs, ","),
+		Args:   okIDs,
+		Nargs: map[string]string{
+			"okIDs":  strings.Join(okIDs, ","),
+			"errIDs": strings.Join(errIDs, ","),
+		},
+	}
+	if eb.HasErrors() {
+		return resp, eb
+	}
+	return resp, nil
+}
+
+// List deleted nodes in the trash, most recently deleted first.
+//
+// Input request:
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+//
+// Return response:
+// sout = trashed nodes recj text representation
+// Code = number of trashed nodes
+// Status = csv text list of trashed node IDs
+// Vals = list of trashed node IDs
+func (e3c *E3C) Trash(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	tns, err := e3c.st.LoadTrashedNodes()
+	if err != nil {
+		return nil, fmt.Errorf("error loading trash (%s)", err)
+	}
+
+	var ns []*store.Node
+	var ids []string
+	for _, tn := range tns {
+		ns = append(ns, tn.Node)
+		ids = append(ids, tn.Node.ID)
+	}
+
+	err = writeNodeList(w, &store.NodeList{Items: ns}, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   len(ids),
+		Status: strings.Join(ids, ","),
+		Args:   ids,
+	}
+	return resp, nil
+}
+
+// Write dump of the whole store: every node with its tags, custom fields,
+// dates and hash, followed by the node revisions, links and trashed nodes.
+// The dump is ndjson, see store.Dump() for its records.
+//
+// dump
+//
+// Return response:
+// sout = dump records
+// Code = number of nodes dumped
+// Status = number of nodes, revisions, links and trashed nodes dumped
+func (e3c *E3C) Dump(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	ds, err := e3c.st.Dump(w)
+	if err != nil {
+		return nil, fmt.Errorf("dump error (%s)", err)
+	}
+
+	e3c.logger.Printf("Dumped %s\n", ds)
+
+	resp := &cmdutil.Resp{
+		Code:   ds.Nodes,
+		Status: ds.String(),
+	}
+	return resp, nil
+}
+
+// Restore deleted nodes from the trash, or with -dump, restore a dump
+// written by dump.
+//
+// restore {node IDs}
+// restore -dump < e3.dump
+//   Restores the dump into an empty store, keeping the nodes' original
+//   IDs, dates and hashes, then rebuilds the search index.
+//
+// Input request:
+// Args = list of node IDs
+// sin = dump, with -dump
+// Nargs["dump"] = restore dump from sin instead of nodes from the trash
+// Nargs["batchsize"] = dump restore: nodes indexed per batch
+//
+// Return response:
+// Code = number of nodes restored
+// Status = csv text list of node IDs restored
+// Vals = list of node IDs restored
+// Nargs["okIDs"] = list of node IDs restored
+// Nargs["errIDs"] = list of node IDs failed to restore
+//
+// Dump restore response:
+// sout = restore summary
+// Code = number of nodes restored
+// Status = number of nodes, revisions, links and trashed nodes restored
+//
+// Return Error: contains newline delimited error messages for each node
+//               failing to restore
+func (e3c *E3C) Restore(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	if cmdutil.FlagOn(req.Nargs, "dump") {
+		if len(req.Args) > 0 {
+			return nil, cmdutil.NewReqError("restore: -dump takes no node IDs")
+		}
+		return e3c.restoreDump(req, r, w)
+	}
+	if len(req.Args) == 0 {
+		return nil, cmdutil.NewReqError("restore: node IDs required, or -dump to restore a dump")
+	}
+
+	var okIDs []string
+	var errIDs []string
+	var eb store.ErrorBag
+
+	for _, id := range cmdutil.RemoveDups(req.Args) {
+		ok, err := e3c.st.RestoreTrashedNode(id)
+		if err != nil {
+			errIDs = append(errIDs, id)
+			eb.Add(fmt.Errorf("error restoring node ID %s (%s)", id, err))
+			continue
+		}
+		if !ok {
+			errIDs = append(errIDs, id)
+			eb.Add(fmt.Errorf("error restoring node ID %s (not in trash)", id))
+			continue
+		}
+
+		okIDs = append(okIDs, id)
+		e3c.logger.Printf("Restored node %s\n", id)
+	}
+
+	resp := &cmdutil.Resp{
+		Code:   len(okIDs),
+		Status: strings.Join(okIDs, ","),
+		Args:   okIDs,
+		Nargs: map[string]string{
+			"okIDs":  strings.Join(okIDs, ","),
+			"errIDs": strings.Join(errIDs, ","),
+		},
+	}
+	if eb.HasErrors() {
+		return resp, eb
+	}
+	return resp, nil
+}
+
+// Restore dump read from r, then index the restored nodes.
+func (e3c *E3C) restoreDump(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	ds, err := e3c.st.RestoreDump(r)
+	if err != nil {
+		return nil, fmt.Errorf("restore error (%s)", err)
+	}
+
+	fmt.Fprintf(w, "Restored %s.\n", ds)
+	e3c.logger.Printf("Restored dump: %s\n", ds)
+
+	resp := &cmdutil.Resp{
+		Code:   ds.Nodes,
+		Status: ds.String(),
+	}
+
+	if len(ds.NodeIDs) == 0 {
+		return resp, nil
+	}
+
+	// The restored nodes are marked changed, so nodes this fails to index
+	// are left for bgindex.
+	logf := func(format string, v ...interface{}) {
+		fmt.Fprintf(w, format, v...)
+	}
+	_, err = e3c.indexNodeIDs(req.Context(), ds.NodeIDs, e3c.indexBatchSize(req.Nargs), logf)
+	if err != nil {
+		return resp, fmt.Errorf("dump restored, but not fully indexed, run bgindex (%s)", err)
+	}
+	return resp, nil
+}
+
+// Permanently delete nodes from the trash.
+//
+// purge -older=30d    <--- nodes deleted more than 30 days ago
+// purge -all          <--- all nodes in the trash
+//
+// Input request:
+// Nargs["older"] = duration, Ex. 30d, 12h
+// Nargs["all"]
+//
+// Return response:
+// Code = number of nodes purged
+// Status = csv text list of node IDs purged
+// Vals = list of node IDs purged
+func (e3c *E3C) Purge(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	before := time.Now()
+
+	if req.Nargs["older"] != "" {
+		d, ok := cmdutil.ConvDuration(req.Nargs["older"])
+		if !ok {
+			return nil, cmdutil.NewReqError("purge: invalid duration '%s'", req.Nargs["older"])
+		}
+		before = before.Add(-d)
+	} else if !cmdutil.FlagOn(req.Nargs, "all") {
+		return nil, cmdutil.NewReqError("purge: specify -older={duration} or -all")
+	}
+
+	ids, err := e3c.st.PurgeTrash(before)
+	if err != nil {
+		return nil, fmt.Errorf("purge error (%s)", err)
+	}
+
+	fmt.Fprintf(w, "Purged %d nodes.\n", len(ids))
+
+	resp := &cmdutil.Resp{
+		Code:   len(ids),
+		Status: strings.Join(ids, ","),
+		Args:   ids,
+	}
+	return resp, nil
+}
+
+// Any path without a handler, responds with 404 and the api endpoints.
+func (e3c *E3C) HttpRoot(w http.ResponseWriter, r *http.Request) {
+	if e3c.httpAuth(w, r, RoleReader) == nil {
 		return
 	}
-	fmt.Println("Body:")
-	fmt.Println(string(bs))
+
+	writeJSONError(w, http.StatusNotFound, fmt.Errorf("no endpoint %s, use /cmd, /nodes, /search or /tags", r.URL.Path))
 }
 
+// Pipeline error returned by /cmd as json.
+type httpCmdError struct {
+	Error     string
+	Stmt      string
+	StmtIndex int
+	Completed int
+	NumStmts  int
+	Code      int
+	Status    string
+	Nargs     map[string]string
+}
+
+// Run pipeline cmd from url query.
+// Responds with the pipeline output, or if a statement fails, with a json
+// httpCmdError and status:
+// 400 Bad Request - no cmd, unknown command or invalid args
+// 401 Unauthorized - missing or invalid api token
+// 403 Forbidden - token role doesn't permit a pipeline verb, no statement
+//                 is run unless the verb came from a $var, in which case
+//                 the statements before it have run
+// 422 Unprocessable Entity - statement failed for some of the nodes,
+//                            Nargs["okIDs"] and Nargs["errIDs"] show which
+// 500 Internal Server Error - statement failed for any other reason
 func (e3c *E3C) HttpCmd(w http.ResponseWriter, r *http.Request) {
+	u := e3c.httpAuth(w, r, RoleReader)
+	if u == nil {
+		return
+	}
+
 	scmd, err := url.QueryUnescape(r.URL.RawQuery)
 	if err != nil {
-		fmt.Println("unescape error: ", err)
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unescape error (%s)", err))
 		return
 	}
 	if scmd == "" {
-		fmt.Println("No command.")
+		writeJSONError(w, http.StatusBadRequest, errors.New("no command"))
+		return
+	}
+
+	// Check every statement before running any. Statements are checked
+	// again once their variables are expanded.
+	err = stmtsPermitted(expandPipeline(scmd, e3c.aliases), u.Role)
+	if err != nil {
+		e3c.logger.Printf("Denied cmd for user %s: '%s' (%s)\n", u.Name, scmd, err)
+		writeJSONError(w, http.StatusForbidden, err)
 		return
 	}
 
-	fmt.Printf("Running cmd: '%s'\n", scmd)
-	RunPipelineStmts(scmd, r.Body, w, e3c.st, e3c.opts, e3c.aliases, e3c.logger)
+	e3c.logger.Printf("Running cmd for user %s: '%s'\n", u.Name, scmd)
+
+	var b bytes.Buffer
+	pr := RunPipelineStmts(r.Context(), scmd, r.Body, &b, e3c.st, e3c.opts, e3c.aliases, u.Role, e3c.logger)
+
+	sr := pr.Failed()
+	if sr == nil {
+		io.Copy(w, &b)
+		return
+	}
+
+	herr := httpCmdError{
+		Error:     pr.Err.Error(),
+		Stmt:      sr.Stmt,
+		StmtIndex: pr.ErrIndex,
+		Completed: pr.Completed(),
+		NumStmts:  pr.NumStmts,
+	}
+	status := http.StatusInternalServerError
+	var perr *permitError
+	if errors.As(sr.Err, &perr) {
+		status = http.StatusForbidden
+	} else if cmdutil.IsReqError(sr.Err) {
+		status = http.StatusBadRequest
+	}
+	if sr.Resp != nil {
+		herr.Code = sr.Resp.Code
+		herr.Status = sr.Resp.Status
+		herr.Nargs = sr.Resp.Nargs
+		if sr.Resp.Nargs["errIDs"] != "" {
+			status = http.StatusUnprocessableEntity
+		}
+	}
+	writeJSON(w, status, herr)
 }
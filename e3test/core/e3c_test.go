@@ -0,0 +1,373 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"e3/store"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return E3C with a new sqlite store in a temp dir.
+func testE3C(t *testing.T) *E3C {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "e3test")
+	if err != nil {
+		t.Fatalf("error creating temp dir (%s)", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	logger := log.New(ioutil.Discard, "", 0)
+	st := store.NewStore("sqlite3", filepath.Join(dir, "test.db"), filepath.Join(dir, "index"), logger)
+	t.Cleanup(func() { st.Close() })
+	err = st.InitTables()
+	if err != nil {
+		t.Fatalf("error creating tables (%s)", err)
+	}
+
+	return NewE3C(st, map[string]string{}, map[string]string{}, logger)
+}
+
+// Run pipeline with input in, return its output and result.
+func runCmd(e3c *E3C, scmd, in string) (string, *PipelineResult) {
+	var b bytes.Buffer
+	pr := RunPipelineStmts(context.Background(), scmd, strings.NewReader(in), &b, e3c.st, e3c.opts, e3c.aliases, RoleNone, e3c.logger)
+	return b.String(), pr
+}
+
+// Run pipeline, failing the test if it fails.
+func mustRunCmd(t *testing.T, e3c *E3C, scmd, in string) (string, *PipelineResult) {
+	t.Helper()
+
+	out, pr := runCmd(e3c, scmd, in)
+	if pr.Err != nil {
+		t.Fatalf("%s: %s", scmd, pr.Err)
+	}
+	return out, pr
+}
+
+// Create node with new args, return its ID.
+func newTestNode(t *testing.T, e3c *E3C, newArgs string) string {
+	t.Helper()
+
+	_, pr := mustRunCmd(t, e3c, "new "+newArgs+" , update", "")
+	ids := pr.Stmts[1].Resp.Args
+	if len(ids) != 1 {
+		t.Fatalf("new %s: created %v", newArgs, ids)
+	}
+	return ids[0]
+}
+
+// Return id quoted as a statement arg, as IDs start with '-'.
+func q(id string) string {
+	return `"` + id + `"`
+}
+
+func loadTestNode(t *testing.T, e3c *E3C, id string) *store.Node {
+	t.Helper()
+
+	n, err := e3c.st.LoadNodeByID(id)
+	if err != nil || n == nil {
+		t.Fatalf("error loading node %s: %v (%v)", id, n, err)
+	}
+	return n
+}
+
+func TestUpdateConflict(t *testing.T) {
+	e3c := testE3C(t)
+	id := newTestNode(t, e3c, `-title=One -body="line 1"`)
+
+	// Two copies loaded from the same base.
+	loaded, _ := mustRunCmd(t, e3c, "load "+q(id), "")
+	if !strings.Contains(loaded, "basehash: ") {
+		t.Fatalf("loaded node without basehash:\n%s", loaded)
+	}
+	byA := strings.Replace(loaded, "title: One", "title: One by A", 1)
+	byB := strings.Replace(loaded, "title: One", "title: One by B", 1)
+	bodyByB := strings.Replace(loaded, "line 1", "line 1 by B", 1)
+
+	_, pr := mustRunCmd(t, e3c, "update", byA)
+	if pr.Stmts[0].Resp.Code != 1 {
+		t.Fatalf("first update saved %d nodes", pr.Stmts[0].Resp.Code)
+	}
+
+	tests := []struct {
+		name      string
+		scmd      string
+		in        string
+		wantNarg  string // resp narg listing id
+		wantTitle string
+		wantBody  string
+	}{
+		{"conflict", "update", byB, "conflictIDs", "One by A", "line 1\n"},
+		{"conflicting merge", "update -merge", byB, "conflictIDs", "One by A", "line 1\n"},
+		{"merge", "update -merge", bodyByB, "mergedIDs", "One by A", "line 1 by B\n"},
+		{"force", "update -force", byB, "okIDs", "One by B", "line 1\n"},
+	}
+
+	for _, tt := range tests {
+		_, pr := runCmd(e3c, tt.scmd, tt.in)
+		resp := pr.Stmts[0].Resp
+		if resp == nil || resp.Nargs[tt.wantNarg] != id {
+			t.Errorf("%s: response %v, want %s in %s (%v)", tt.name, resp, id, tt.wantNarg, pr.Err)
+			continue
+		}
+		if (tt.wantNarg == "conflictIDs") != (pr.Err != nil) {
+			t.Errorf("%s: error %v", tt.name, pr.Err)
+		}
+
+		n := loadTestNode(t, e3c, id)
+		if n.Title != tt.wantTitle || n.Body != tt.wantBody {
+			t.Errorf("%s: node title %q body %q, want %q %q", tt.name, n.Title, n.Body, tt.wantTitle, tt.wantBody)
+		}
+	}
+}
+
+// Nodes deleted since loaded conflict, and with -atomic no node is saved.
+func TestUpdateConflictAtomic(t *testing.T) {
+	e3c := testE3C(t)
+	id1 := newTestNode(t, e3c, "-title=One")
+	id2 := newTestNode(t, e3c, "-title=Two")
+
+	loaded, _ := mustRunCmd(t, e3c, "load "+q(id1)+" "+q(id2), "")
+	changed := strings.Replace(loaded, "title: One", "title: One changed", 1)
+	changed = strings.Replace(changed, "title: Two", "title: Two changed", 1)
+
+	mustRunCmd(t, e3c, "delete "+q(id2), "")
+
+	_, pr := runCmd(e3c, "update -atomic", changed)
+	if pr.Err == nil || pr.Stmts[0].Resp.Nargs["conflictIDs"] != id2 {
+		t.Fatalf("atomic update of deleted node: %v (%v)", pr.Stmts[0].Resp, pr.Err)
+	}
+	if n := loadTestNode(t, e3c, id1); n.Title != "One" {
+		t.Errorf("atomic update saved node %s", id1)
+	}
+
+	_, pr = runCmd(e3c, "update", changed)
+	resp := pr.Stmts[0].Resp
+	if resp.Nargs["okIDs"] != id1 || resp.Nargs["conflictIDs"] != id2 {
+		t.Errorf("update of deleted node: %v (%v)", resp, pr.Err)
+	}
+	if exists, _ := e3c.st.ExistsNodeID(id2); exists {
+		t.Errorf("update recreated deleted node %s", id2)
+	}
+}
+
+func TestHistoryDiffRevert(t *testing.T) {
+	e3c := testE3C(t)
+	id := newTestNode(t, e3c, `-title=v1 -tags=a -body="line 1"`)
+	mustRunCmd(t, e3c, "load "+q(id)+" , map -title=v2 -tags+=b , update", "")
+	mustRunCmd(t, e3c, "load "+q(id)+" , map -title=v3 -.priority=high , update", "")
+
+	out, pr := mustRunCmd(t, e3c, "history "+q(id), "")
+	if pr.Stmts[0].Resp.Code != 3 {
+		t.Fatalf("history listed %d revisions, want 3:\n%s", pr.Stmts[0].Resp.Code, out)
+	}
+	for _, s := range []string{"rev: 1\n", "title: v1\n", "rev: 3\n", "title: v3\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("history missing %q:\n%s", s, out)
+		}
+	}
+
+	tests := []struct {
+		scmd     string
+		nchanged int
+		want     []string
+	}{
+		{"diff " + q(id), 2, []string{"title:\n- v2\n+ v3\n", ".priority:\n+ high\n"}},
+		{"diff " + q(id) + " 1", 3, []string{"title:\n- v1\n+ v3\n", "tags:\n- a\n+ a,b\n"}},
+		{"diff " + q(id) + " 1 2", 2, []string{"--- " + id + " rev 1", "+++ " + id + " rev 2"}},
+		{"diff " + q(id) + " 2 2", 0, nil},
+	}
+	for _, tt := range tests {
+		out, pr := mustRunCmd(t, e3c, tt.scmd, "")
+		if pr.Stmts[0].Resp.Code != tt.nchanged {
+			t.Errorf("%s: %d fields changed, want %d:\n%s", tt.scmd, pr.Stmts[0].Resp.Code, tt.nchanged, out)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(out, s) {
+				t.Errorf("%s: missing %q:\n%s", tt.scmd, s, out)
+			}
+		}
+	}
+
+	_, pr = runCmd(e3c, "diff "+q(id)+" 9", "")
+	if pr.Err == nil {
+		t.Errorf("diff to missing revision succeeded")
+	}
+
+	mustRunCmd(t, e3c, "revert "+q(id)+" 1 , update", "")
+	n := loadTestNode(t, e3c, id)
+	if n.Title != "v1" || strings.Join(n.Tags, ",") != "a" || n.Fields["priority"] != "" {
+		t.Errorf("reverted to %+v", n)
+	}
+	nrs, err := e3c.st.LoadNodeRevs(id)
+	if err != nil || len(nrs) != 4 {
+		t.Errorf("%d revisions after revert (%v), want 4", len(nrs), err)
+	}
+}
+
+func TestLinksTrashPurge(t *testing.T) {
+	e3c := testE3C(t)
+	a := newTestNode(t, e3c, "-title=A")
+	b := newTestNode(t, e3c, "-title=B")
+	c := newTestNode(t, e3c, "-title=C")
+
+	mustRunCmd(t, e3c, "load "+q(a)+` , map -links+="blocks:`+b+",ref:"+c+`"`, "")
+	_, pr := runCmd(e3c, "load "+q(a)+" , map -links+=blocks:nosuchid", "")
+	if pr.Err == nil || pr.Stmts[1].Resp.Nargs["errIDs"] != a {
+		t.Errorf("link to missing node: %v (%v)", pr.Stmts[1].Resp, pr.Err)
+	}
+
+	tests := []struct {
+		scmd string
+		want string
+	}{
+		{"links " + q(a), b + "," + c},
+		{"links " + q(a) + " -rel=blocks", b},
+		{"backlinks " + q(b), a},
+		{"backlinks " + q(a), ""},
+	}
+	for _, tt := range tests {
+		_, pr := mustRunCmd(t, e3c, tt.scmd, "")
+		if got := pr.Stmts[0].Resp.Status; got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.scmd, got, tt.want)
+		}
+	}
+
+	mustRunCmd(t, e3c, "load "+q(b)+" , delete", "")
+	_, pr = mustRunCmd(t, e3c, "links "+q(a), "")
+	if pr.Stmts[0].Resp.Status != c || pr.Stmts[0].Resp.Nargs["missingIDs"] != b {
+		t.Errorf("links to deleted node: %v", pr.Stmts[0].Resp)
+	}
+
+	_, pr = mustRunCmd(t, e3c, "trash", "")
+	if pr.Stmts[0].Resp.Status != b {
+		t.Errorf("trash: %s, want %s", pr.Stmts[0].Resp.Status, b)
+	}
+
+	mustRunCmd(t, e3c, "restore "+q(b), "")
+	_, pr = mustRunCmd(t, e3c, "links "+q(a)+" -rel=blocks", "")
+	if pr.Stmts[0].Resp.Status != b {
+		t.Errorf("links to restored node: %s, want %s", pr.Stmts[0].Resp.Status, b)
+	}
+
+	_, pr = runCmd(e3c, "purge", "")
+	if pr.Err == nil {
+		t.Errorf("purge without -older or -all succeeded")
+	}
+
+	mustRunCmd(t, e3c, "delete "+q(b), "")
+	_, pr = mustRunCmd(t, e3c, "purge -older=1h", "")
+	if pr.Stmts[0].Resp.Code != 0 {
+		t.Errorf("purge -older=1h purged %s", pr.Stmts[0].Resp.Status)
+	}
+	// Deletion times have second resolution, purge -all purges nodes
+	// deleted before the current second.
+	time.Sleep(time.Second)
+	_, pr = mustRunCmd(t, e3c, "purge -all", "")
+	if pr.Stmts[0].Resp.Status != b {
+		t.Errorf("purge -all: %s, want %s", pr.Stmts[0].Resp.Status, b)
+	}
+	_, pr = mustRunCmd(t, e3c, "links "+q(a), "")
+	if pr.Stmts[0].Resp.Status != c {
+		t.Errorf("links after purge: %s, want %s", pr.Stmts[0].Resp.Status, c)
+	}
+	_, pr = runCmd(e3c, "restore "+q(b), "")
+	if pr.Err == nil {
+		t.Errorf("restored purged node")
+	}
+}
+
+func TestPipelineVars(t *testing.T) {
+	e3c := testE3C(t)
+	a := newTestNode(t, e3c, "-title=A -assigned=rob")
+	newTestNode(t, e3c, "-title=B -assigned=ann")
+
+	tests := []struct {
+		scmd string
+		want string
+	}{
+		{"set who=rob , find -assigned=$who , count", "1\n"},
+		{`set -who="rob" -fmt=table , find -assigned=$who -outputfmt=$fmt`, "A"},
+		{`find -assigned=rob , echo $prev.code "$prev.status"`, "1 " + a + "\n"},
+		{"find -assigned=rob , set x=1 , echo $prev.code $x", "1 1\n"},
+		{"set x=1 , set x=2 , echo $x", "2\n"},
+	}
+	for _, tt := range tests {
+		out, _ := mustRunCmd(t, e3c, tt.scmd, "")
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%s: output %q, want %q", tt.scmd, out, tt.want)
+		}
+	}
+
+	for _, scmd := range []string{"echo $nosuchvar", "set 1x=2", "set prev.code=1"} {
+		_, pr := runCmd(e3c, scmd, "")
+		if pr.Err == nil {
+			t.Errorf("%s: succeeded", scmd)
+		}
+	}
+}
+
+// Custom fields set by new and map are saved, found and dumped.
+func TestCustomFields(t *testing.T) {
+	e3c := testE3C(t)
+	a := newTestNode(t, e3c, "-title=A -.priority=high")
+	b := newTestNode(t, e3c, "-title=B")
+
+	mustRunCmd(t, e3c, "load "+q(b)+" , map -.priority=low -.due=2024-06-01 , update", "")
+	mustRunCmd(t, e3c, "load "+q(a)+" , map -.priority= , update", "")
+
+	if n := loadTestNode(t, e3c, a); len(n.Fields) != 0 {
+		t.Errorf("node %s fields %v, want none", a, n.Fields)
+	}
+	if n := loadTestNode(t, e3c, b); n.Fields["priority"] != "low" || n.Fields["due"] != "2024-06-01" {
+		t.Errorf("node %s fields %v", b, n.Fields)
+	}
+
+	_, pr := mustRunCmd(t, e3c, "find -.priority=low", "")
+	if pr.Stmts[0].Resp.Status != b {
+		t.Errorf("find -.priority=low: %s, want %s", pr.Stmts[0].Resp.Status, b)
+	}
+	out, _ := mustRunCmd(t, e3c, "load "+q(b)+` , table -cols="title,.priority"`, "")
+	if !strings.Contains(out, "low") {
+		t.Errorf("table without custom field:\n%s", out)
+	}
+
+	_, pr = runCmd(e3c, "new -.bad-name=x", "")
+	if pr.Err == nil {
+		t.Errorf("new with invalid custom field name succeeded")
+	}
+}
+
+// restore restores a dump only with -dump, never a stream of nodes given no
+// IDs, Ex. "trash , restore $prev.args" with nothing in the trash.
+func TestDumpRestoreVerbs(t *testing.T) {
+	e3c := testE3C(t)
+	newTestNode(t, e3c, "-title=A")
+	newTestNode(t, e3c, "-title=B")
+	dump, _ := mustRunCmd(t, e3c, "dump", "")
+
+	e3c2 := testE3C(t)
+	for _, scmd := range []string{"restore", "trash , restore $prev.args", `restore -dump "-1"`} {
+		_, pr := runCmd(e3c2, scmd, dump)
+		if pr.Err == nil {
+			t.Errorf("%s: succeeded", scmd)
+		}
+	}
+	_, pr := mustRunCmd(t, e3c2, "find", "")
+	if pr.Stmts[0].Resp.Code != 0 {
+		t.Fatalf("restored %d nodes without -dump", pr.Stmts[0].Resp.Code)
+	}
+
+	_, pr = mustRunCmd(t, e3c2, "restore -dump", dump)
+	if pr.Stmts[0].Resp.Code != 2 {
+		t.Errorf("restore -dump restored %d nodes, want 2", pr.Stmts[0].Resp.Code)
+	}
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"bytes"
+	"e3/cmdutil"
+	"e3/datafmt"
+	"e3/osutil"
+	"e3/store"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Editor used if none is set in the conf file, $VISUAL or $EDITOR.
+const defaultEditor = "vi"
+
+// Problem found in edited nodes text, Line is 0 if the problem isn't on a
+// particular line.
+type editProblem struct {
+	Line int
+	Msg  string
+}
+
+// Edit input nodes in an external editor, and write the edited nodes.
+// The editor is the editor= conf setting, or $VISUAL or $EDITOR, or vi
+// if none is set. It may include args, Ex. editor=code --wait
+//
+// Nodes are edited as recj text. The edited text is checked before it's
+// written: if it doesn't parse or a node has no title, the editor is
+// reopened with the problems listed in '#' lines at the top of the file.
+// Quitting without changes writes nothing.
+//
+// load 12 , edit , update
+// find -tags=urgent , edit -each , update
+//
+// Input request:
+// sin = nodes to edit
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs["each"] = edit nodes one at a time, in a separate editor session
+//                 for each node
+//
+// Return response:
+// sout = edited nodes
+// Code = number of edited nodes written
+// Args = list of edited node IDs
+func (e3c *E3C) Edit(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	nr, nw, err := nodeStreams(r, w, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	writeEdited := func(edited []*store.Node) error {
+		for _, n := range edited {
+			ids = append(ids, n.ID)
+			err := nw.Write(n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if cmdutil.FlagOn(req.Nargs, "each") {
+		err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+			edited, err := e3c.editNodes([]*store.Node{n})
+			if err != nil {
+				return false, err
+			}
+			return true, writeEdited(edited)
+		})
+	} else {
+		var nl *store.NodeList
+		nl, err = store.ReadAllNodes(nr)
+		if err == nil {
+			var edited []*store.Node
+			edited, err = e3c.editNodes(nl.Items)
+			if err == nil {
+				err = writeEdited(edited)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeIDsResp(ids), nil
+}
+
+// Return editor command and args.
+func (e3c *E3C) editorCmd() []string {
+	for _, editor := range []string{e3c.opts["editor"], os.Getenv("VISUAL"), os.Getenv("EDITOR")} {
+		cmd := strings.Fields(editor)
+		if len(cmd) > 0 {
+			return cmd
+		}
+	}
+	return []string{defaultEditor}
+}
+
+// Edit nodes as recj text until it's saved without problems.
+// Returns nil if the text was saved unchanged.
+func (e3c *E3C) editNodes(ns []*store.Node) ([]*store.Node, error) {
+	var b bytes.Buffer
+	store.WriteAllNodes(store.NewRecjNodeWriter(&b), ns)
+	text := b.String()
+
+	var problems []editProblem
+	for {
+		hdr := editProblemsHeader(problems)
+		edited, err := e3c.runEditor(hdr + text)
+		if err != nil {
+			return nil, err
+		}
+		edited = stripEditHeader(edited)
+
+		if edited == text {
+			if len(problems) > 0 {
+				return nil, cmdutil.NewReqError("edit canceled, %d problems in edited nodes", len(problems))
+			}
+			return nil, nil
+		}
+
+		var edns []*store.Node
+		edns, problems = parseEditedNodes(edited)
+		if len(problems) == 0 {
+			return edns, nil
+		}
+		text = edited
+	}
+}
+
+// Run editor on text, and return the saved text.
+func (e3c *E3C) runEditor(text string) (string, error) {
+	file, err := osutil.CreateTmpFile("_e3", text)
+	if err != nil {
+		if file != "" {
+			os.Remove(file)
+		}
+		return "", err
+	}
+
+	cmd := e3c.editorCmd()
+	err = osutil.RunCommand(cmd[0], append(cmd[1:], file)...)
+	if err != nil {
+		os.Remove(file)
+		return "", fmt.Errorf("error running editor (%s)", err)
+	}
+
+	return osutil.ReadAndDeleteFile(file)
+}
+
+// Return '#' lines listing problems, with line numbers of the text
+// following the lines.
+func editProblemsHeader(problems []editProblem) string {
+	if len(problems) == 0 {
+		return ""
+	}
+
+	// Title and blank '#' lines, and a line per problem
+	nhdrLines := len(problems) + 2
+
+	var b strings.Builder
+	b.WriteString("# Fix the problems below and save, or quit without changes to cancel.\n")
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "# line %d: %s\n", p.Line+nhdrLines, p.Msg)
+		} else {
+			fmt.Fprintf(&b, "# %s\n", p.Msg)
+		}
+	}
+	b.WriteString("#\n")
+	return b.String()
+}
+
+// Remove '#' lines at the top of edited text.
+func stripEditHeader(s string) string {
+	for strings.HasPrefix(s, "#") {
+		i := strings.Index(s, "\n")
+		if i == -1 {
+			return ""
+		}
+		s = s[i+1:]
+	}
+	return s
+}
+
+// Parse edited recj text, returning the nodes or the problems found.
+func parseEditedNodes(s string) ([]*store.Node, []editProblem) {
+	var problems []editProblem
+
+	multiline := false
+	for i, line := range strings.Split(s, "\n") {
+		mlfield, isMultiline := datafmt.RecjMultilineField(line)
+		switch {
+		case strings.HasPrefix(line, "%%"):
+			multiline = false
+		case isMultiline:
+			multiline = true
+			if !store.ValidRecjKey(mlfield) {
+				problems = append(problems, editProblem{i + 1, fmt.Sprintf("invalid field name '%s'", mlfield)})
+			}
+		case multiline && line == datafmt.RecjEndMarker:
+			multiline = false
+		case multiline || strings.TrimSpace(line) == "":
+			// Multiline field contents and blank lines
+		default:
+			k, _, ok := datafmt.ParseRecjField(line)
+			if !ok {
+				problems = append(problems, editProblem{i + 1, fmt.Sprintf("expected 'field: value', got '%s'", line)})
+				continue
+			}
+			if !store.ValidRecjKey(k) {
+				problems = append(problems, editProblem{i + 1, fmt.Sprintf("invalid field name '%s'", k)})
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	nl, err := store.ReadAllNodes(store.NewRecjNodeReader(strings.NewReader(s)))
+	if err != nil {
+		return nil, []editProblem{{0, err.Error()}}
+	}
+
+	for i, n := range nl.Items {
+		if strings.TrimSpace(n.Title) == "" {
+			msg := fmt.Sprintf("node %d: missing title", i+1)
+			if n.ID != "" {
+				msg = fmt.Sprintf("node %d (id %s): missing title", i+1, n.ID)
+			}
+			problems = append(problems, editProblem{0, msg})
+		}
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return nl.Items, nil
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseEditedNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		nnodes   int
+		problems []string
+	}{
+		{"nodes", "title: One\n===body===\nline\n===\n%%\ntitle: Two\npriority: high\n", 2, nil},
+		{"multiline custom field", "title: One\n===notes===\nnote\n===\n", 1, nil},
+		{"not a field", "title: One\nnot a field\n", 0, []string{"line 2: expected 'field: value'"}},
+		{"invalid name", "title: One\nbad name: x\n===basehash===\nx\n===\n", 0, []string{"line 2: invalid field name 'bad name'"}},
+		{"prefixed custom field", "title: One\n.priority: high\n", 0, []string{"line 2: invalid field name '.priority'"}},
+		{"missing title", "title: One\n%%\nid: 12\ntitle: \n", 0, []string{"node 2 (id 12): missing title"}},
+	}
+
+	for _, tt := range tests {
+		ns, problems := parseEditedNodes(tt.text)
+		if len(ns) != tt.nnodes {
+			t.Errorf("%s: %d nodes, want %d", tt.name, len(ns), tt.nnodes)
+		}
+
+		hdr := editProblemsHeader(problems)
+		if len(problems) != len(tt.problems) {
+			t.Errorf("%s: problems\n%s", tt.name, hdr)
+			continue
+		}
+		for i, p := range problems {
+			got := p.Msg
+			if p.Line > 0 {
+				got = fmt.Sprintf("line %d: %s", p.Line, p.Msg)
+			}
+			if !strings.HasPrefix(got, tt.problems[i]) {
+				t.Errorf("%s: problem %q, want %q", tt.name, got, tt.problems[i])
+			}
+		}
+
+		// The header is stripped off the text saved with it.
+		if stripped := stripEditHeader(hdr + tt.text); stripped != tt.text {
+			t.Errorf("%s: stripped header text %q", tt.name, stripped)
+		}
+	}
+}
+
+// Edit with the editor conf setting run on a temp file of the nodes.
+func TestEdit(t *testing.T) {
+	e3c := testE3C(t)
+	id := newTestNode(t, e3c, "-title=One")
+
+	e3c.opts["editor"] = "sed -i s/One/Edited/"
+	_, pr := mustRunCmd(t, e3c, "load "+q(id)+" , edit , update", "")
+	if pr.Stmts[1].Resp.Code != 1 {
+		t.Errorf("edit wrote %d nodes, want 1", pr.Stmts[1].Resp.Code)
+	}
+	if n := loadTestNode(t, e3c, id); n.Title != "Edited" {
+		t.Errorf("edited title %q", n.Title)
+	}
+
+	// Unchanged text writes nothing.
+	e3c.opts["editor"] = "true"
+	out, pr := mustRunCmd(t, e3c, "load "+q(id)+" , edit", "")
+	if out != "" || pr.Stmts[1].Resp.Code != 0 {
+		t.Errorf("unchanged edit wrote %q", out)
+	}
+
+	// Problems are listed and the editor reopened, until the text is
+	// saved without problems, or unchanged.
+	e3c.opts["editor"] = "sed -i s/^title:.*//"
+	_, pr = runCmd(e3c, "load "+q(id)+" , edit", "")
+	if pr.Err == nil || !strings.Contains(pr.Err.Error(), "edit canceled") {
+		t.Errorf("edit removing title: %v", pr.Err)
+	}
+}
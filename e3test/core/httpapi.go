@@ -0,0 +1,404 @@
+package core
+
+import (
+	"e3/cmdutil"
+	"e3/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// JSON REST api for nodes.
+//
+// GET    /nodes?limit=&offset=&{field}{op}={val}  list nodes (see Find)
+// POST   /nodes                                   create node
+// GET    /nodes/{id}                              get node
+// PUT    /nodes/{id}                              update node
+// DELETE /nodes/{id}                              delete node (to trash)
+// GET    /search?q=&limit=&offset=                search nodes
+// GET    /tags                                    list tags with node counts
+//
+// Requests need an api token (see auth.go), reader role for GET requests,
+// writer role for the others.
+//
+// Nodes are sent and returned as json Node documents.
+// GET /nodes/{id} returns the node hash in the ETag header. PUT and DELETE
+// accept an If-Match header with the hash, and fail with 412 if the node
+// has changed since.
+
+const defaultPageLimit = 50
+const maxPageLimit = 500
+
+// A page of nodes returned by listings.
+// More is true if there are nodes after this page.
+type nodePage struct {
+	Items  []*store.Node
+	Offset int
+	Limit  int
+	More   bool
+}
+
+type httpError struct {
+	Error string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, httpError{err.Error()})
+}
+
+// Return limit and offset query params, limit+1 is queried to find out
+// if there are more nodes after the page.
+func pageParams(r *http.Request) (int, int, error) {
+	limit := defaultPageLimit
+	offset := 0
+
+	q := r.URL.Query()
+	if q.Get("limit") != "" {
+		n, ok := cmdutil.ConvInt(q.Get("limit"))
+		if !ok || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit '%s'", q.Get("limit"))
+		}
+		limit = n
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	if q.Get("offset") != "" {
+		n, ok := cmdutil.ConvInt(q.Get("offset"))
+		if !ok || n < 0 {
+			return 0, 0, fmt.Errorf("invalid offset '%s'", q.Get("offset"))
+		}
+		offset = n
+	}
+
+	return limit, offset, nil
+}
+
+func newNodePage(ns []*store.Node, limit, offset int) *nodePage {
+	page := &nodePage{
+		Items:  ns,
+		Offset: offset,
+		Limit:  limit,
+	}
+	if len(ns) > limit {
+		page.Items = ns[:limit]
+		page.More = true
+	}
+	if page.Items == nil {
+		page.Items = []*store.Node{}
+	}
+	return page
+}
+
+func etag(n *store.Node) string {
+	return fmt.Sprintf("\"%s\"", n.Hash)
+}
+
+// Return the If-Match header tag matching the node hash, blank if the
+// header is absent or "*". Returns false if no tag matches.
+// The returned hash is checked again when the node is written, see
+// httpPutNode().
+func ifMatch(r *http.Request, n *store.Node) (string, bool) {
+	h := r.Header.Get("If-Match")
+	if h == "" || h == "*" {
+		return "", true
+	}
+
+	for _, tag := range strings.Split(h, ",") {
+		tag = strings.TrimSpace(tag)
+		tag = strings.TrimPrefix(tag, "W/")
+		if strings.Trim(tag, "\"") == n.Hash {
+			return n.Hash, true
+		}
+	}
+	return "", false
+}
+
+func readJSONNode(r *http.Request) (*store.Node, error) {
+	defer r.Body.Close()
+
+	var n store.Node
+	err := json.NewDecoder(r.Body).Decode(&n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node json (%s)", err)
+	}
+	if strings.TrimSpace(n.Title) == "" {
+		return nil, errors.New("node has no title")
+	}
+	return &n, nil
+}
+
+// /nodes and /nodes/{id}
+func (e3c *E3C) HttpNodes(w http.ResponseWriter, r *http.Request) {
+	role := RoleWriter
+	if r.Method == http.MethodGet {
+		role = RoleReader
+	}
+	if e3c.httpAuth(w, r, role) == nil {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/nodes"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			e3c.httpListNodes(w, r)
+		case http.MethodPost:
+			e3c.httpCreateNode(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		e3c.httpGetNode(w, r, id)
+	case http.MethodPut:
+		e3c.httpPutNode(w, r, id)
+	case http.MethodDelete:
+		e3c.httpDeleteNode(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (e3c *E3C) httpListNodes(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var conds []*store.NodeCond
+	var qorderby string
+	for k, vs := range r.URL.Query() {
+		v := vs[0]
+		switch k {
+		case "limit", "offset":
+			continue
+		case "orderby":
+			qorderby, err = store.ParseNodeOrderBy(v)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			continue
+		}
+
+		c, err := store.ParseNodeCond(k, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		conds = append(conds, c)
+	}
+
+	ns, err := e3c.st.FindNodes(conds, qorderby, limit+1, offset)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newNodePage(ns, limit, offset))
+}
+
+func (e3c *E3C) httpCreateNode(w http.ResponseWriter, r *http.Request) {
+	n, err := readJSONNode(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if n.ID != "" {
+		exists, err := e3c.st.ExistsNodeID(n.ID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if exists {
+			writeJSONError(w, http.StatusConflict, fmt.Errorf("node ID %s already exists", n.ID))
+			return
+		}
+	}
+
+	n, err = e3c.st.SaveNode(n)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	n.Hash = n.HashString()
+	e3c.logger.Printf("Created node %s '%s'\n", n.ID, n.Alias)
+
+	w.Header().Set("Location", "/nodes/"+n.ID)
+	w.Header().Set("ETag", etag(n))
+	writeJSON(w, http.StatusCreated, n)
+}
+
+// Load node id, writing 404 or 500 error if it can't be loaded.
+// Returns nil if node wasn't loaded.
+func (e3c *E3C) httpLoadNode(w http.ResponseWriter, id string) *store.Node {
+	n, err := e3c.st.LoadNodeByID(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if n == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("node ID %s not found", id))
+		return nil
+	}
+	return n
+}
+
+func (e3c *E3C) httpGetNode(w http.ResponseWriter, r *http.Request, id string) {
+	n := e3c.httpLoadNode(w, id)
+	if n == nil {
+		return
+	}
+
+	w.Header().Set("ETag", etag(n))
+	writeJSON(w, http.StatusOK, n)
+}
+
+func (e3c *E3C) httpPutNode(w http.ResponseWriter, r *http.Request, id string) {
+	newn, err := readJSONNode(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if newn.ID != "" && newn.ID != id {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("node ID %s doesn't match url ID %s", newn.ID, id))
+		return
+	}
+	newn.ID = id
+
+	n := e3c.httpLoadNode(w, id)
+	if n == nil {
+		return
+	}
+	hash, ok := ifMatch(r, n)
+	if !ok {
+		writeJSONError(w, http.StatusPreconditionFailed, fmt.Errorf("node ID %s has changed", id))
+		return
+	}
+
+	// The node may change after it was loaded, so the matched hash is
+	// checked again by the update itself.
+	newn.Createdt = n.Createdt
+	if hash != "" {
+		newn, err = e3c.st.SaveNodeIfHash(newn, hash)
+	} else {
+		newn, err = e3c.st.SaveNode(newn)
+	}
+	if errors.Is(err, store.ErrNodeChanged) {
+		writeJSONError(w, http.StatusPreconditionFailed, fmt.Errorf("node ID %s has changed", id))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	newn.Hash = newn.HashString()
+	e3c.logger.Printf("Updated node %s '%s'\n", newn.ID, newn.Alias)
+
+	w.Header().Set("ETag", etag(newn))
+	writeJSON(w, http.StatusOK, newn)
+}
+
+func (e3c *E3C) httpDeleteNode(w http.ResponseWriter, r *http.Request, id string) {
+	n := e3c.httpLoadNode(w, id)
+	if n == nil {
+		return
+	}
+	hash, ok := ifMatch(r, n)
+	if !ok {
+		writeJSONError(w, http.StatusPreconditionFailed, fmt.Errorf("node ID %s has changed", id))
+		return
+	}
+
+	ok, err := e3c.st.TrashNodeIfHash(id, hash)
+	if errors.Is(err, store.ErrNodeChanged) {
+		writeJSONError(w, http.StatusPreconditionFailed, fmt.Errorf("node ID %s has changed", id))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("node ID %s not found", id))
+		return
+	}
+	e3c.logger.Printf("Deleted node %s\n", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /search?q=
+func (e3c *E3C) HttpSearch(w http.ResponseWriter, r *http.Request) {
+	if e3c.httpAuth(w, r, RoleReader) == nil {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("missing search query q"))
+		return
+	}
+
+	limit, offset, err := pageParams(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ns, err := e3c.st.SearchNodes(q, limit+1, offset)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newNodePage(ns, limit, offset))
+}
+
+// /tags
+func (e3c *E3C) HttpTags(w http.ResponseWriter, r *http.Request) {
+	if e3c.httpAuth(w, r, RoleReader) == nil {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	tcs, err := e3c.st.LoadTagCounts()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if tcs == nil {
+		tcs = []*store.TagCount{}
+	}
+
+	writeJSON(w, http.StatusOK, tcs)
+}
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"e3/store"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Return e3c with api tokens rtok, wtok and atok for the reader, writer
+// and admin roles.
+func testHttpE3C(t *testing.T) *E3C {
+	t.Helper()
+
+	e3c := testE3C(t)
+	e3c.opts["token.rd"] = "rtok:reader"
+	e3c.opts["token.wr"] = "wtok:writer"
+	e3c.opts["token.ad"] = "atok:admin"
+	return e3c
+}
+
+// Serve request to e3c as main does, with bearer token if not blank and
+// header If-Match if not blank.
+func serveHttp(e3c *E3C, method, target, token, ifMatch, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", e3c.HttpRoot)
+	mux.HandleFunc("/cmd", e3c.HttpCmd)
+	mux.HandleFunc("/nodes", e3c.HttpNodes)
+	mux.HandleFunc("/nodes/", e3c.HttpNodes)
+	mux.HandleFunc("/search", e3c.HttpSearch)
+	mux.HandleFunc("/tags", e3c.HttpTags)
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func decodeNode(t *testing.T, w *httptest.ResponseRecorder) *store.Node {
+	t.Helper()
+
+	var n store.Node
+	err := json.Unmarshal(w.Body.Bytes(), &n)
+	if err != nil {
+		t.Fatalf("invalid node json %s (%s)", w.Body, err)
+	}
+	return &n
+}
+
+func TestHttpAuth(t *testing.T) {
+	e3c := testHttpE3C(t)
+	id := newTestNode(t, e3c, "-title=One")
+
+	tests := []struct {
+		method, target, token string
+		body                  string
+		want                  int
+	}{
+		{"GET", "/nodes", "", "", http.StatusUnauthorized},
+		{"GET", "/nodes", "nosuchtok", "", http.StatusUnauthorized},
+		{"GET", "/nodes", "rtok", "", http.StatusOK},
+		{"GET", "/nodes/" + id, "rtok", "", http.StatusOK},
+		{"GET", "/tags", "rtok", "", http.StatusOK},
+		{"PUT", "/nodes/" + id, "rtok", `{"Title":"Two"}`, http.StatusForbidden},
+		{"DELETE", "/nodes/" + id, "rtok", "", http.StatusForbidden},
+		{"POST", "/nodes", "rtok", `{"Title":"Two"}`, http.StatusForbidden},
+		{"POST", "/nodes", "wtok", `{"Title":"Two"}`, http.StatusCreated},
+		{"PUT", "/nodes/" + id, "atok", `{"Title":"Two"}`, http.StatusOK},
+		{"PATCH", "/nodes/" + id, "atok", `{"Title":"Two"}`, http.StatusMethodNotAllowed},
+		{"POST", "/nosuchpath", "", "body", http.StatusUnauthorized},
+		{"POST", "/nosuchpath", "rtok", "body", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := serveHttp(e3c, tt.method, tt.target, tt.token, "", tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s token '%s': status %d, want %d (%s)", tt.method, tt.target, tt.token, w.Code, tt.want, w.Body)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s %s token '%s': no WWW-Authenticate header", tt.method, tt.target, tt.token)
+		}
+	}
+
+	// Invalid token settings aren't taken as no token.
+	e3c.opts["token.bad"] = "badtok"
+	w := serveHttp(e3c, "GET", "/nodes", "rtok", "", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("GET /nodes with invalid token settings: status %d, want 500", w.Code)
+	}
+}
+
+func TestHttpNodes(t *testing.T) {
+	e3c := testHttpE3C(t)
+
+	w := serveHttp(e3c, "POST", "/nodes", "wtok", "", `{"Title":"One","Tags":["bug"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /nodes: status %d (%s)", w.Code, w.Body)
+	}
+	n := decodeNode(t, w)
+	if n.ID == "" || w.Header().Get("Location") != "/nodes/"+n.ID || w.Header().Get("ETag") != etag(n) {
+		t.Errorf("POST /nodes: Location %s, ETag %s, created %+v", w.Header().Get("Location"), w.Header().Get("ETag"), n)
+	}
+	target := "/nodes/" + n.ID
+
+	tests := []struct {
+		method, ifMatch, body string
+		want                  int
+	}{
+		{"POST", "", `{"Title":"Dup","ID":"` + n.ID + `"}`, http.StatusConflict},
+		{"POST", "", `{"Body":"no title"}`, http.StatusBadRequest},
+		{"POST", "", `{`, http.StatusBadRequest},
+		{"PUT", "", `{"Title":"Two","ID":"other"}`, http.StatusBadRequest},
+		{"PUT", `"stale"`, `{"Title":"Two"}`, http.StatusPreconditionFailed},
+		{"PUT", etag(n), `{"Title":"Two"}`, http.StatusOK},
+		{"PUT", etag(n), `{"Title":"Three"}`, http.StatusPreconditionFailed},
+		{"DELETE", etag(n), "", http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		tg := target
+		if tt.method == "POST" {
+			tg = "/nodes"
+		}
+		w = serveHttp(e3c, tt.method, tg, "wtok", tt.ifMatch, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s %s If-Match %s %s: status %d, want %d (%s)", tt.method, tg, tt.ifMatch, tt.body, w.Code, tt.want, w.Body)
+		}
+	}
+
+	w = serveHttp(e3c, "GET", target, "rtok", "", "")
+	n2 := decodeNode(t, w)
+	if w.Code != http.StatusOK || n2.Title != "Two" || w.Header().Get("ETag") != etag(n2) || n2.Createdt != n.Createdt {
+		t.Fatalf("GET %s: status %d, ETag %s, node %+v", target, w.Code, w.Header().Get("ETag"), n2)
+	}
+
+	// Any tag of the header may match, "*" matches any node.
+	w = serveHttp(e3c, "PUT", target, "wtok", `"stale", W/`+etag(n2), `{"Title":"Four"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT %s If-Match tag list: status %d (%s)", target, w.Code, w.Body)
+	}
+	w = serveHttp(e3c, "PUT", target, "wtok", "*", `{"Title":"Five"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT %s If-Match *: status %d (%s)", target, w.Code, w.Body)
+	}
+
+	w = serveHttp(e3c, "DELETE", target, "wtok", decodeNode(t, w).Hash, "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE %s: status %d (%s)", target, w.Code, w.Body)
+	}
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		w = serveHttp(e3c, method, target, "wtok", "", `{"Title":"Six"}`)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s %s after delete: status %d, want 404", method, target, w.Code)
+		}
+	}
+}
+
+func TestHttpListNodes(t *testing.T) {
+	e3c := testHttpE3C(t)
+	for _, args := range []string{"-alias=a -assigned=rob", "-alias=b", "-alias=c -assigned=rob", "-alias=d -assigned=rob"} {
+		newTestNode(t, e3c, args+" -title=Node")
+	}
+
+	tests := []struct {
+		query string
+		want  string
+		more  bool
+	}{
+		{"orderby=alias", "a,b,c,d", false},
+		{"orderby=alias&limit=2", "a,b", true},
+		{"orderby=alias&limit=2&offset=2", "c,d", false},
+		{"orderby=alias&offset=4", "", false},
+		{"assigned=rob&orderby=alias+desc&limit=2", "d,c", true},
+		{"assigned!=rob", "b", false},
+	}
+
+	for _, tt := range tests {
+		w := serveHttp(e3c, "GET", "/nodes?"+tt.query, "rtok", "", "")
+		var page nodePage
+		err := json.Unmarshal(w.Body.Bytes(), &page)
+		if w.Code != http.StatusOK || err != nil {
+			t.Errorf("GET /nodes?%s: status %d, %s (%v)", tt.query, w.Code, w.Body, err)
+			continue
+		}
+		var aliases []string
+		for _, n := range page.Items {
+			aliases = append(aliases, n.Alias)
+		}
+		if got := strings.Join(aliases, ","); got != tt.want || page.More != tt.more {
+			t.Errorf("GET /nodes?%s: %s more %v, want %s more %v", tt.query, got, page.More, tt.want, tt.more)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "offset=-1", "nosuchfield=x", "orderby=tags"} {
+		w := serveHttp(e3c, "GET", "/nodes?"+query, "rtok", "", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /nodes?%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestHttpCmd(t *testing.T) {
+	e3c := testHttpE3C(t)
+	id := newTestNode(t, e3c, "-title=One")
+
+	tests := []struct {
+		scmd, token string
+		want        int
+	}{
+		{"echo hi", "", http.StatusUnauthorized},
+		{"echo hi", "rtok", http.StatusOK},
+		{"load " + q(id), "rtok", http.StatusOK},
+		{"", "rtok", http.StatusBadRequest},
+		{"load " + q(id) + " , update", "rtok", http.StatusForbidden},
+		{"load " + q(id) + " , update", "wtok", http.StatusOK},
+		{"dump", "wtok", http.StatusForbidden},
+		{"edit", "atok", http.StatusForbidden},
+		{"set -a=-dump , restore $a", "wtok", http.StatusForbidden},
+		{"restore", "wtok", http.StatusBadRequest},
+		{"find -nosuchfield=x", "rtok", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := serveHttp(e3c, "GET", "/cmd?"+url.QueryEscape(tt.scmd), tt.token, "", "")
+		if w.Code != tt.want {
+			t.Errorf("/cmd %s token '%s': status %d, want %d (%s)", tt.scmd, tt.token, w.Code, tt.want, w.Body)
+		}
+	}
+
+	// Piped input is written to the response only.
+	w := serveHttp(e3c, "POST", "/cmd?echo", "rtok", "", "piped\n")
+	if w.Code != http.StatusOK || w.Body.String() != "piped\n" {
+		t.Errorf("/cmd echo: status %d, output %q, want %q", w.Code, w.Body, "piped\n")
+	}
+
+	// Statements denied after variable expansion show which one failed.
+	w = serveHttp(e3c, "GET", "/cmd?"+url.QueryEscape("set -a=-dump , restore $a"), "wtok", "", "")
+	var herr httpCmdError
+	err := json.Unmarshal(w.Body.Bytes(), &herr)
+	if err != nil || herr.StmtIndex != 1 || herr.Completed != 1 || herr.NumStmts != 2 {
+		t.Errorf("/cmd denied restore $a: %s (%v)", w.Body, err)
+	}
+}
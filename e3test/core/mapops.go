@@ -0,0 +1,249 @@
+package core
+
+import (
+	"bytes"
+	"e3/cmdutil"
+	"e3/store"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Map operation on a node field, given as a named arg:
+// -{field}=val        set field to val
+// -{field}+=val       append val to field, tags+ adds csv list of tags
+// -tags-=val          remove csv list of tags
+// -{field}/s=/re/repl/{flags}
+//                     replace first match of regex re with repl, flags:
+//                     g - replace all matches
+//                     i - case insensitive match
+//                     repl may reference submatches as $1, ${name}
+//
+// Custom fields are given with the '.' prefix, -.priority=high, and are
+// removed by setting them to "".
+//
+// Values of set and append operations may be templates referencing the
+// node's fields, as they are when the operation is applied:
+// -title="{{.Alias}}: {{.Title}}"
+type mapOp struct {
+	Field  string
+	Op     string
+	Val    string
+	tmpl   *template.Template
+	re     *regexp.Regexp
+	global bool
+}
+
+// Fields that map operations may change.
+var _mapFields = map[string]bool{
+	"alias":    true,
+	"title":    true,
+	"assigned": true,
+	"body":     true,
+	"tags":     true,
+}
+
+// Named args of map options, not operations.
+var _mapOptNargs = map[string]bool{
+	"inputfmt":  true,
+	"outputfmt": true,
+	"cols":      true,
+	"map":       true,
+	"links+":    true,
+	"links-":    true,
+	"if":        true,
+}
+
+// Parse map operations from nargs, in statement order.
+func parseMapOps(nargs []cmdutil.Narg) ([]*mapOp, error) {
+	var ops []*mapOp
+	for _, narg := range nargs {
+		if _mapOptNargs[narg.K] {
+			continue
+		}
+
+		op, err := parseMapOp(narg.K, narg.V)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func parseMapOp(k, v string) (*mapOp, error) {
+	op := &mapOp{Field: k, Op: "=", Val: v}
+
+	switch {
+	case strings.HasSuffix(k, "/s"):
+		op.Field = strings.TrimSuffix(k, "/s")
+		op.Op = "s"
+	case strings.HasSuffix(k, "+"):
+		op.Field = strings.TrimSuffix(k, "+")
+		op.Op = "+="
+	case strings.HasSuffix(k, "-"):
+		op.Field = strings.TrimSuffix(k, "-")
+		op.Op = "-="
+		if op.Field != "tags" {
+			return nil, fmt.Errorf("invalid map operation '%s=%s', only tags- is supported", k, v)
+		}
+	}
+
+	if !_mapFields[op.Field] && !store.IsCustomField(op.Field) {
+		return nil, fmt.Errorf("invalid map operation '%s=%s', unknown field '%s'", k, v, op.Field)
+	}
+
+	if op.Op == "s" {
+		return op, op.parseSubst(v)
+	}
+
+	if strings.Contains(v, "{{") {
+		tmpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template in '%s=%s' (%s)", k, v, err)
+		}
+		op.tmpl = tmpl
+	}
+
+	return op, nil
+}
+
+// Parse substitution /re/repl/{flags}, the leading '/' is optional.
+// A '/' within re or repl is escaped as '\/'.
+func (op *mapOp) parseSubst(v string) error {
+	var parts []string
+	var b strings.Builder
+
+	s := strings.TrimPrefix(v, "/")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && s[i+1] == '/' {
+			b.WriteByte('/')
+			i++
+			continue
+		}
+		if c == '/' && len(parts) < 2 {
+			parts = append(parts, b.String())
+			b.Reset()
+			continue
+		}
+		b.WriteByte(c)
+	}
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid substitution '%s', expected /re/repl/", v)
+	}
+	flags := b.String()
+
+	pat := parts[0]
+	for _, flag := range flags {
+		switch flag {
+		case 'g':
+			op.global = true
+		case 'i':
+			pat = "(?i)" + pat
+		default:
+			return fmt.Errorf("invalid substitution '%s', unknown flag '%c'", v, flag)
+		}
+	}
+
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return fmt.Errorf("invalid regex in substitution '%s' (%s)", v, err)
+	}
+	op.re = re
+	op.Val = parts[1]
+
+	return nil
+}
+
+// Return operation value for node n, with any template executed.
+func (op *mapOp) val(n *store.Node) (string, error) {
+	if op.tmpl == nil {
+		return op.Val, nil
+	}
+
+	var b bytes.Buffer
+	err := op.tmpl.Execute(&b, n)
+	if err != nil {
+		return "", fmt.Errorf("template error (%s)", err)
+	}
+	return b.String(), nil
+}
+
+func (op *mapOp) apply(n *store.Node) error {
+	if op.Op == "s" {
+		n.SetFieldVal(op.Field, op.subst(n.FieldVal(op.Field)))
+		return nil
+	}
+
+	v, err := op.val(n)
+	if err != nil {
+		return err
+	}
+
+	switch op.Op {
+	case "=":
+		n.SetFieldVal(op.Field, v)
+	case "+=":
+		if op.Field == "tags" {
+			n.ProcessCsvTags(v, n.AddTag)
+		} else {
+			n.SetFieldVal(op.Field, n.FieldVal(op.Field)+v)
+		}
+	case "-=":
+		n.ProcessCsvTags(v, n.RemoveTag)
+	}
+	return nil
+}
+
+func (op *mapOp) subst(s string) string {
+	if op.global {
+		return op.re.ReplaceAllString(s, op.Val)
+	}
+
+	loc := op.re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return s
+	}
+	repl := op.re.ExpandString(nil, op.Val, s, loc)
+	return s[:loc[0]] + string(repl) + s[loc[1]:]
+}
+
+// Parse map guard predicates.
+// Guards are given as -if="{field}{op}{val}", or -if followed by
+// predicate args:
+// map -if tags=urgent assigned=rob -title+=" (urgent)"
+func parseMapGuards(req *cmdutil.Req) ([]*store.NodeCond, error) {
+	var exprs []string
+	argGuards := false
+	for _, narg := range req.NargList {
+		if narg.K != "if" {
+			continue
+		}
+		if narg.V == "" {
+			argGuards = true
+			continue
+		}
+		exprs = append(exprs, narg.V)
+	}
+	if argGuards {
+		exprs = append(exprs, req.Args...)
+	}
+
+	var conds []*store.NodeCond
+	for _, expr := range exprs {
+		k, v := expr, ""
+		i := strings.Index(expr, "=")
+		if i != -1 {
+			k, v = expr[:i], expr[i+1:]
+		}
+
+		c, err := store.ParseNodeCond(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -if '%s' (%s)", expr, err)
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
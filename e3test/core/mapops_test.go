@@ -0,0 +1,116 @@
+package core
+
+import (
+	"e3/cmdutil"
+	"e3/store"
+	"strings"
+	"testing"
+)
+
+func TestMapOps(t *testing.T) {
+	tests := []struct {
+		name  string
+		nargs []cmdutil.Narg
+		field string
+		want  string
+	}{
+		{"set", []cmdutil.Narg{{K: "assigned", V: "ann"}}, "assigned", "ann"},
+		{"append", []cmdutil.Narg{{K: "title+", V: " (urgent)"}}, "title", "TODO: fix login (urgent)"},
+		{"add tags", []cmdutil.Narg{{K: "tags+", V: "c, d,a"}}, "tags", "a,b,c,d"},
+		{"remove tags", []cmdutil.Narg{{K: "tags-", V: "a,x"}}, "tags", "b"},
+		{"substitute", []cmdutil.Narg{{K: "title/s", V: "/^TODO:/DONE:/"}}, "title", "DONE: fix login"},
+		{"substitute first", []cmdutil.Narg{{K: "body/s", V: "/foo/bar/"}}, "body", "bar Foo foo\n"},
+		{"substitute all", []cmdutil.Narg{{K: "body/s", V: "/foo/bar/g"}}, "body", "bar Foo bar\n"},
+		{"substitute all, any case", []cmdutil.Narg{{K: "body/s", V: "/foo/bar/gi"}}, "body", "bar bar bar\n"},
+		{"substitute submatch", []cmdutil.Narg{{K: "title/s", V: `/(\w+): (.*)/$2 ($1)/`}}, "title", "fix login (TODO)"},
+		{"substitute escaped slash", []cmdutil.Narg{{K: "title/s", V: `/: /\//`}}, "title", "TODO/fix login"},
+		{"template", []cmdutil.Narg{{K: "title", V: "{{.Alias}}: {{.Title}}"}}, "title", "login: TODO: fix login"},
+		{"in order", []cmdutil.Narg{{K: "title", V: "x"}, {K: "title+", V: "y"}, {K: "title+", V: "{{.Title}}"}}, "title", "xyxy"},
+		{"custom field", []cmdutil.Narg{{K: ".due", V: "2024-06-01"}}, ".due", "2024-06-01"},
+		{"remove custom field", []cmdutil.Narg{{K: ".priority", V: ""}}, ".priority", ""},
+		{"options skipped", []cmdutil.Narg{{K: "outputfmt", V: "table"}, {K: "if", V: "tags=a"}}, "title", "TODO: fix login"},
+	}
+
+	for _, tt := range tests {
+		n := &store.Node{Alias: "login", Title: "TODO: fix login", Body: "foo Foo foo\n", Tags: []string{"a", "b"}}
+		n.SetCustomField("priority", "high")
+
+		ops, err := parseMapOps(tt.nargs)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		for _, op := range ops {
+			err = op.apply(n)
+			if err != nil {
+				t.Errorf("%s: %s", tt.name, err)
+			}
+		}
+
+		got := n.FieldVal(tt.field)
+		if tt.field == "tags" {
+			got = strings.Join(n.Tags, ",")
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s = %q, want %q", tt.name, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseMapOpErrors(t *testing.T) {
+	tests := []struct{ k, v string }{
+		{"id", "x"},
+		{"createdt", "x"},
+		{"title-", "x"},
+		{"nosuchfield", "x"},
+		{".bad-name", "x"},
+		{"title/s", "/missing repl"},
+		{"title/s", "/(/x/"},
+		{"title/s", "/a/b/x"},
+		{"title", "{{.Title"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseMapOp(tt.k, tt.v)
+		if err == nil {
+			t.Errorf("parseMapOp(%q, %q) succeeded", tt.k, tt.v)
+		}
+	}
+}
+
+// Nodes not satisfying -if guards are passed on unchanged.
+func TestMapGuards(t *testing.T) {
+	e3c := testE3C(t)
+
+	in := "title: One\ntags: urgent\n%%\ntitle: Two\ntags: later\n%%\ntitle: Three\nassigned: rob\ntags: urgent\n"
+	tests := []struct {
+		scmd string
+		want string
+	}{
+		{"map -if=tags=urgent -title+=!", "One!,Two,Three!"},
+		{"map -if tags=urgent assigned=rob -title+=!", "One,Two,Three!"},
+		{`map -if="title~=^T" -title+=!`, "One,Two!,Three!"},
+	}
+	for _, tt := range tests {
+		out, _ := mustRunCmd(t, e3c, tt.scmd, in)
+		ns := nodeListFromRecj(t, out)
+
+		var titles []string
+		for _, n := range ns {
+			titles = append(titles, n.Title)
+		}
+		if got := strings.Join(titles, ","); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.scmd, got, tt.want)
+		}
+	}
+}
+
+func nodeListFromRecj(t *testing.T, s string) []*store.Node {
+	t.Helper()
+
+	nl, err := store.NodeListFromRecjString(s)
+	if err != nil {
+		t.Fatalf("error reading nodes (%s):\n%s", err, s)
+	}
+	return nl.Items
+}
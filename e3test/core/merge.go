@@ -0,0 +1,241 @@
+package core
+
+import (
+	"e3/store"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Three-way merge of node changes.
+// A node edited from base revision (ours) is merged with the node's
+// stored contents (theirs), saved by someone else since base was loaded.
+
+// Merge changes of n from base into stored node cur.
+// Returns error listing the fields changed differently in both, n is only
+// changed if all fields merge.
+func mergeNode(n, base, cur *store.Node) error {
+	var conflicts []string
+
+	alias, ok := mergeVal(base.Alias, n.Alias, cur.Alias)
+	if !ok {
+		conflicts = append(conflicts, "alias")
+	}
+	title, ok := mergeVal(base.Title, n.Title, cur.Title)
+	if !ok {
+		conflicts = append(conflicts, "title")
+	}
+	assigned, ok := mergeVal(base.Assigned, n.Assigned, cur.Assigned)
+	if !ok {
+		conflicts = append(conflicts, "assigned")
+	}
+	body, ok := mergeLines(base.Body, n.Body, cur.Body)
+	if !ok {
+		conflicts = append(conflicts, "body")
+	}
+
+	fields := map[string]string{}
+	for _, name := range customFieldNames(base, n, cur) {
+		field := store.CustomFieldPrefix + name
+		v, ok := mergeVal(base.FieldVal(field), n.FieldVal(field), cur.FieldVal(field))
+		if !ok {
+			conflicts = append(conflicts, field)
+		}
+		fields[name] = v
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting changes to %s", strings.Join(conflicts, ","))
+	}
+
+	n.Alias = alias
+	n.Title = title
+	n.Assigned = assigned
+	n.Body = body
+	n.Tags = mergeTags(base.Tags, n.Tags, cur.Tags)
+	n.Fields = nil
+	for name, v := range fields {
+		n.SetCustomField(name, v)
+	}
+	return nil
+}
+
+// Return sorted names of the custom fields of any of nodes ns.
+func customFieldNames(ns ...*store.Node) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, n := range ns {
+		for _, name := range n.CustomFieldNames() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Merge single value, ok is false if ours and theirs both changed base
+// to different values.
+func mergeVal(base, ours, theirs string) (string, bool) {
+	switch {
+	case ours == theirs || ours == base:
+		return theirs, true
+	case theirs == base:
+		return ours, true
+	}
+	return "", false
+}
+
+// Merge tags as sets: tags added in ours are added to theirs, and tags
+// removed in ours are removed from theirs.
+func mergeTags(base, ours, theirs []string) []string {
+	inBase := tagSet(base)
+	inOurs := tagSet(ours)
+
+	var tags []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			return
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	for _, tag := range theirs {
+		if inBase[strings.TrimSpace(tag)] && !inOurs[strings.TrimSpace(tag)] {
+			continue
+		}
+		add(tag)
+	}
+	for _, tag := range ours {
+		if !inBase[strings.TrimSpace(tag)] {
+			add(tag)
+		}
+	}
+	return tags
+}
+
+func tagSet(tags []string) map[string]bool {
+	set := map[string]bool{}
+	for _, tag := range tags {
+		set[strings.TrimSpace(tag)] = true
+	}
+	return set
+}
+
+// Change of base lines [Start, End) to Lines.
+type mergeHunk struct {
+	Start int
+	End   int
+	Lines []string
+}
+
+// Return changes of base in diff dls.
+func diffHunks(dls []diffLine) []*mergeHunk {
+	var hunks []*mergeHunk
+	var h *mergeHunk
+	i := 0
+	for _, dl := range dls {
+		if dl.Op == ' ' {
+			h = nil
+			i++
+			continue
+		}
+		if h == nil {
+			h = &mergeHunk{Start: i, End: i}
+			hunks = append(hunks, h)
+		}
+		if dl.Op == '-' {
+			i++
+			h.End = i
+		} else {
+			h.Lines = append(h.Lines, dl.Line)
+		}
+	}
+	return hunks
+}
+
+// Return base lines [start, end) with hunks applied.
+func applyHunks(base []string, hunks []*mergeHunk, start, end int) []string {
+	var lines []string
+	i := start
+	for _, h := range hunks {
+		lines = append(lines, base[i:h.Start]...)
+		lines = append(lines, h.Lines...)
+		i = h.End
+	}
+	return append(lines, base[i:end]...)
+}
+
+// Line based merge of text, ok is false if ours and theirs change the same
+// or adjacent base lines differently.
+func mergeLines(base, ours, theirs string) (string, bool) {
+	if s, ok := mergeVal(base, ours, theirs); ok {
+		return s, true
+	}
+
+	baseLines := splitLines(base)
+	a := diffHunks(diffLines(baseLines, splitLines(ours)))
+	b := diffHunks(diffLines(baseLines, splitLines(theirs)))
+
+	var lines []string
+	i := 0
+	for len(a) > 0 || len(b) > 0 {
+		// Group the first hunk with hunks of both sides overlapping or
+		// touching it.
+		var start int
+		if len(b) == 0 || (len(a) > 0 && a[0].Start <= b[0].Start) {
+			start = a[0].Start
+		} else {
+			start = b[0].Start
+		}
+		end := start
+
+		var ga, gb []*mergeHunk
+		for {
+			if len(a) > 0 && a[0].Start <= end {
+				ga = append(ga, a[0])
+				end = maxInt(end, a[0].End)
+				a = a[1:]
+				continue
+			}
+			if len(b) > 0 && b[0].Start <= end {
+				gb = append(gb, b[0])
+				end = maxInt(end, b[0].End)
+				b = b[1:]
+				continue
+			}
+			break
+		}
+
+		lines = append(lines, baseLines[i:start]...)
+		switch {
+		case len(gb) == 0:
+			lines = append(lines, applyHunks(baseLines, ga, start, end)...)
+		case len(ga) == 0:
+			lines = append(lines, applyHunks(baseLines, gb, start, end)...)
+		default:
+			la := applyHunks(baseLines, ga, start, end)
+			lb := applyHunks(baseLines, gb, start, end)
+			if strings.Join(la, "") != strings.Join(lb, "") {
+				return "", false
+			}
+			lines = append(lines, la...)
+		}
+		i = end
+	}
+	lines = append(lines, baseLines[i:]...)
+
+	return strings.Join(lines, ""), true
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
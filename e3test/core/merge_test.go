@@ -0,0 +1,111 @@
+package core
+
+import (
+	"e3/store"
+	"strings"
+	"testing"
+)
+
+func TestMergeVal(t *testing.T) {
+	tests := []struct {
+		base, ours, theirs string
+		want               string
+		ok                 bool
+	}{
+		{"a", "a", "a", "a", true},
+		{"a", "b", "a", "b", true},
+		{"a", "a", "c", "c", true},
+		{"a", "b", "b", "b", true},
+		{"a", "b", "c", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := mergeVal(tt.base, tt.ours, tt.theirs)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("mergeVal(%q, %q, %q) = %q, %v, want %q, %v", tt.base, tt.ours, tt.theirs, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	tests := []struct {
+		base, ours, theirs string
+		want               string
+	}{
+		{"a,b", "a,b", "a,b", "a,b"},
+		{"a,b", "a,b,c", "a,b", "a,b,c"},
+		{"a,b", "a", "a,b,d", "a,d"},
+		{"a,b", "a,b,c", "b,d", "b,d,c"},
+		{"a", "a,c", "a,c", "a,c"},
+		{"", "x", "y", "y,x"},
+	}
+
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+	for _, tt := range tests {
+		got := strings.Join(mergeTags(split(tt.base), split(tt.ours), split(tt.theirs)), ",")
+		if got != tt.want {
+			t.Errorf("mergeTags(%s, %s, %s) = %s, want %s", tt.base, tt.ours, tt.theirs, got, tt.want)
+		}
+	}
+}
+
+func TestMergeLines(t *testing.T) {
+	base := "1\n2\n3\n4\n5\n6\n"
+	tests := []struct {
+		name         string
+		ours, theirs string
+		want         string
+		ok           bool
+	}{
+		{"ours only", "1\n2 ours\n3\n4\n5\n6\n", base, "1\n2 ours\n3\n4\n5\n6\n", true},
+		{"apart", "1 ours\n2\n3\n4\n5\n6\n", "1\n2\n3\n4\n5\n6 theirs\n", "1 ours\n2\n3\n4\n5\n6 theirs\n", true},
+		{"insert and delete", "1\n2\n2.5\n3\n4\n5\n6\n", "1\n2\n3\n4\n6\n", "1\n2\n2.5\n3\n4\n6\n", true},
+		{"same change", "1\n2\n3 both\n4\n5\n6\n", "1\n2\n3 both\n4\n5\n6\n", "1\n2\n3 both\n4\n5\n6\n", true},
+		{"same line", "1\n2\n3 ours\n4\n5\n6\n", "1\n2\n3 theirs\n4\n5\n6\n", "", false},
+		{"adjacent lines", "1\n2\n3 ours\n4\n5\n6\n", "1\n2\n3\n4 theirs\n5\n6\n", "", false},
+		{"append both", base + "7\n", base + "8\n", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := mergeLines(base, tt.ours, tt.theirs)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: merged %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMergeNode(t *testing.T) {
+	base := &store.Node{Title: "Fix login", Assigned: "rob", Body: "1\n2\n3\n", Tags: []string{"bug"}}
+	base.SetCustomField("priority", "low")
+
+	n := &store.Node{Title: "Fix login page", Assigned: "rob", Body: "1 ours\n2\n3\n", Tags: []string{"bug", "urgent"}}
+	n.SetCustomField("priority", "low")
+	n.SetCustomField("due", "2024-06-01")
+
+	cur := &store.Node{Title: "Fix login", Assigned: "ann", Body: "1\n2\n3 theirs\n", Tags: []string{"bug", "web"}}
+	cur.SetCustomField("priority", "high")
+
+	err := mergeNode(n, base, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Title != "Fix login page" || n.Assigned != "ann" || n.Body != "1 ours\n2\n3 theirs\n" ||
+		strings.Join(n.Tags, ",") != "bug,web,urgent" || n.Fields["priority"] != "high" || n.Fields["due"] != "2024-06-01" {
+		t.Errorf("merged %+v", n)
+	}
+
+	conflicting := &store.Node{Title: "Fix logout", Assigned: "zed", Body: "1\n2\n3\n"}
+	conflicting.SetCustomField("priority", "medium")
+	err = mergeNode(conflicting, base, cur)
+	if err == nil || !strings.Contains(err.Error(), "assigned,.priority") {
+		t.Errorf("merging conflicting node: %v", err)
+	}
+	if conflicting.Title != "Fix logout" {
+		t.Errorf("conflicting node changed by failed merge")
+	}
+}
@@ -0,0 +1,424 @@
+package core
+
+import (
+	"e3/cmdutil"
+	"e3/store"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Node stream transforms.
+// Each verb reads nodes from input and writes nodes to output, in any of the
+// supported formats (-inputfmt, -outputfmt), without going to the database.
+//
+// load * , filter -assigned=rob , sort -by=createdt , head 5 , table
+
+// Return node predicates from nargs, skipping option nargs in opts.
+func parseNodeConds(nargs map[string]string, opts ...string) ([]*store.NodeCond, error) {
+	isOpt := map[string]bool{}
+	for _, opt := range opts {
+		isOpt[opt] = true
+	}
+
+	var conds []*store.NodeCond
+	for k, v := range nargs {
+		if isOpt[k] {
+			continue
+		}
+
+		c, err := store.ParseNodeCond(k, v)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+// Return csv list of node fields, or defaultFields if s is blank.
+func parseNodeFields(s string, defaultFields ...string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return defaultFields, nil
+	}
+
+	var fields []string
+	for _, name := range strings.Split(s, ",") {
+		field, err := store.ParseNodeField(name)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Return reader and writer for input and output node streams.
+func nodeStreams(r io.Reader, w io.Writer, nargs map[string]string) (store.NodeReader, store.NodeWriter, error) {
+	nr, err := nodeReader(r, nargs)
+	if err != nil {
+		return nil, nil, err
+	}
+	nw, err := nodeWriter(w, nargs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nr, nw, nil
+}
+
+// Call fn for each input node, until fn returns false or an error.
+func eachInputNode(nr store.NodeReader, fn func(n *store.Node) (bool, error)) error {
+	for {
+		n, err := nr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		more, err := fn(n)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// Response listing the IDs of nodes written to output.
+func nodeIDsResp(ids []string) *cmdutil.Resp {
+	return &cmdutil.Resp{
+		Code:   len(ids),
+		Status: strings.Join(ids, ","),
+		Args:   ids,
+	}
+}
+
+// Pass on input nodes satisfying all field predicates.
+//
+// filter -tags=urgent -title~=^Bug
+//   Passes on nodes tagged urgent with title matching regex ^Bug.
+//
+// Input request:
+// sin = input nodes
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs[{field}{op}] = val, where op is one of =, !=, <, <=, >, >=, ~=
+//                      (see Find)
+//
+// Return response:
+// sout = matching nodes
+// Code = number of matching nodes
+// Args = list of matching node IDs
+func (e3c *E3C) Filter(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	conds, err := parseNodeConds(req.Nargs, "inputfmt", "outputfmt", "cols", "map")
+	if err != nil {
+		return nil, cmdutil.NewReqError("filter error (%s)", err)
+	}
+
+	nr, nw, err := nodeStreams(r, w, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+		if !store.MatchAll(conds, n) {
+			return true, nil
+		}
+		ids = append(ids, n.ID)
+		return true, nw.Write(n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeIDsResp(ids), nil
+}
+
+// Sort input nodes by fields.
+// Nodes with equal fields keep their input order.
+//
+// sort -by=assigned,updatedt -desc
+//
+// Input request:
+// sin = input nodes
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs["by"] = csv list of fields to sort by, default is id
+// Nargs["desc"] = sort in descending order
+//
+// Return response:
+// sout = sorted nodes
+// Code = number of nodes
+// Args = list of sorted node IDs
+func (e3c *E3C) Sort(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	fields, err := parseNodeFields(req.Nargs["by"], "id")
+	if err != nil {
+		return nil, cmdutil.NewReqError("sort error (%s)", err)
+	}
+	desc := cmdutil.FlagOn(req.Nargs, "desc")
+
+	nl, err := readNodeList(r, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+	ns := nl.Items
+
+	sort.SliceStable(ns, func(i, j int) bool {
+		for _, field := range fields {
+			a, b := ns[i].FieldVal(field), ns[j].FieldVal(field)
+			if a == b {
+				continue
+			}
+			if desc {
+				return a > b
+			}
+			return a < b
+		}
+		return false
+	})
+
+	err = writeNodeList(w, nl, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, n := range ns {
+		ids = append(ids, n.ID)
+	}
+	return nodeIDsResp(ids), nil
+}
+
+const defaultHeadCount = 10
+
+// Pass on the first n input nodes.
+//
+// head 5
+//
+// Input request:
+// sin = input nodes
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Args[0] = number of nodes, default is 10
+//
+// Return response:
+// sout = first n nodes
+// Code = number of nodes
+// Args = list of node IDs
+func (e3c *E3C) Head(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	count := defaultHeadCount
+	if len(req.Args) > 0 {
+		n, ok := cmdutil.ConvInt(req.Args[0])
+		if !ok || n < 0 {
+			return nil, cmdutil.NewReqError("head: invalid count '%s'", req.Args[0])
+		}
+		count = n
+	}
+
+	nr, nw, err := nodeStreams(r, w, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if count > 0 {
+		err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+			ids = append(ids, n.ID)
+			return len(ids) < count, nw.Write(n)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeIDsResp(ids), nil
+}
+
+// Pass on input nodes, skipping nodes with the same fields as an earlier
+// node.
+//
+// uniq -by=alias
+//
+// Input request:
+// sin = input nodes
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["outputfmt"] = {recj|table|pb|json|ndjson|csv}
+// Nargs["by"] = csv list of fields compared, default is id
+//
+// Return response:
+// sout = unique nodes
+// Code = number of unique nodes
+// Args = list of unique node IDs
+// Nargs["dupIDs"] = list of skipped node IDs
+func (e3c *E3C) Uniq(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	fields, err := parseNodeFields(req.Nargs["by"], "id")
+	if err != nil {
+		return nil, cmdutil.NewReqError("uniq error (%s)", err)
+	}
+
+	nr, nw, err := nodeStreams(r, w, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var ids []string
+	var dupIDs []string
+	err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+		var vals []string
+		for _, field := range fields {
+			vals = append(vals, n.FieldVal(field))
+		}
+		k := strings.Join(vals, "\x00")
+
+		if seen[k] {
+			dupIDs = append(dupIDs, n.ID)
+			return true, nil
+		}
+		seen[k] = true
+
+		ids = append(ids, n.ID)
+		return true, nw.Write(n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := nodeIDsResp(ids)
+	resp.Nargs = map[string]string{
+		"dupIDs": strings.Join(dupIDs, ","),
+	}
+	return resp, nil
+}
+
+// Count input nodes, and input nodes per tag.
+//
+// Input request:
+// sin = input nodes
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+//
+// Return response:
+// sout = number of nodes, followed by a line per tag with its node count,
+//        most used tags first
+//   Ex.
+//   12
+//   urgent 5
+//   bug    3
+// Code = number of nodes
+// Nargs["tag.{tag}"] = number of nodes tagged {tag}
+func (e3c *E3C) Count(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	nr, err := nodeReader(r, req.Nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	nnodes := 0
+	tagCounts := map[string]int{}
+	err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+		nnodes++
+		for _, tag := range n.Tags {
+			tag = strings.TrimSpace(tag)
+			if tag != "" {
+				tagCounts[tag]++
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	tagWidth := 0
+	for tag := range tagCounts {
+		tags = append(tags, tag)
+		if len(tag) > tagWidth {
+			tagWidth = len(tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		a, b := tags[i], tags[j]
+		if tagCounts[a] != tagCounts[b] {
+			return tagCounts[a] > tagCounts[b]
+		}
+		return a < b
+	})
+
+	resp := &cmdutil.Resp{
+		Code:   nnodes,
+		Status: fmt.Sprintf("%d nodes", nnodes),
+		Nargs:  map[string]string{},
+	}
+
+	fmt.Fprintf(w, "%d\n", nnodes)
+	for _, tag := range tags {
+		_, err := fmt.Fprintf(w, "%-[1]*[2]s %[3]d\n", tagWidth, tag, tagCounts[tag])
+		if err != nil {
+			return nil, err
+		}
+		resp.Nargs["tag."+tag] = fmt.Sprintf("%d", tagCounts[tag])
+	}
+
+	return resp, nil
+}
+
+// Write input nodes as a table.
+// Same as map -outputfmt=table.
+//
+// Input request:
+// sin = input nodes
+// Nargs["inputfmt"] = {recj|pb|json|ndjson|csv}
+// Nargs["cols"] = csv list of table columns, Ex. -cols=id,title,tags
+//
+// Return response:
+// sout = nodes table
+// Code = number of nodes
+func (e3c *E3C) Table(req *cmdutil.Req, r io.Reader, w io.Writer) (*cmdutil.Resp, error) {
+	nargs := map[string]string{
+		"inputfmt":  req.Nargs["inputfmt"],
+		"map":       req.Nargs["map"],
+		"outputfmt": "table",
+		"cols":      req.Nargs["cols"],
+	}
+
+	nr, nw, err := nodeStreams(r, w, nargs)
+	if err != nil {
+		return nil, err
+	}
+
+	nnodes := 0
+	err = eachInputNode(nr, func(n *store.Node) (bool, error) {
+		nnodes++
+		return true, nw.Write(n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = nw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cmdutil.Resp{Code: nnodes}, nil
+}
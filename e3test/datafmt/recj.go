@@ -3,6 +3,7 @@ package datafmt
 import (
 	"fmt"
 	"io"
+	"regexp"
 	"strings"
 )
 
@@ -13,33 +14,60 @@ import (
 // ===fieldname1===
 // A multiline field value.
 // Spanning multiple lines
-// ===fieldname2===
-// Another multiline field value.
+// ===
 //
 // This produces:
-// fieldname1="A multiline field value.\nSpanning multiple lines\n
-// fieldname2="Another multiline field value.
-
+// fieldname1="A multiline field value.\nSpanning multiple lines\n"
+//
 // Sample format supported:
 //
 // Field1: Val 1
 // Field2: Val 2
-// Field3: Val 3
-// ===MultilineField4===
+// ===MultilineField3===
 // This is a value spanning multiple lines.
 // Here's the second line.
-// And the third.
-// ===MultilineField5===
-// You can have multiple multiline fields
-// but they can only appear at the end of the record.
+// ===
+// Field4: Val 4
 // %%
-// Field1: Val 1
-// Field2: Val 2
+// Field1: Re: meeting
+// Field2: 100% done\nNext line of a single line field.
 // ===Description===
 // A '%%' sequence acts as a record separator.
-// You can also add comments after the '%%' which
+// \%% Content lines starting with '\', '%' or '=' are escaped with a '\'.
+// ===
+// %% You can also add comments after the '%%' which
 // will be ignored by the parser.
 //
+// Dialect rules, followed by both the writer and the parser, so any record
+// of any field names and values is read back as it was written:
+//
+// - A single line field is 'name: value'. The name ends at the first ': '
+//   not escaped, a line ending in ':' is a field with an empty value.
+// - In names and single line values, '\\' is a backslash, '\n' a newline
+//   and '\r' a carriage return. '\:', '\%' and '\=' are ':', '%' and '=',
+//   used to escape ':' in names and a leading '%' or '=' of a name. Other
+//   '\' sequences are left as they are.
+// - A multiline field starts with a '===name===' line, name is one or more
+//   letters, digits or '_'. Its value is its content lines, each followed
+//   by a newline, up to a '===' line, the next '===name===' line or the
+//   end of the record. A content line starting with '\\', '\%' or '\='
+//   has its leading '\' removed.
+// - Values ending in a newline, without carriage returns, are written as
+//   multiline fields if their name allows it, other values are written as
+//   single line fields.
+// - Lines that aren't fields, other than blank lines, are syntax errors.
+//   RecjsFromString() ignores them.
+// - Records are separated by lines starting with '%%'. Records without
+//   fields aren't written, and aren't read back.
+//
+// Records written before end markers and escapes were added read back the
+// same, except for content lines and values with the escapes above.
+
+// Line ending a multiline field.
+const RecjEndMarker = "==="
+
+var _recjMultilineRe = regexp.MustCompile(`^=+(\w+)=+$`)
+var _recjMultilineKeyRe = regexp.MustCompile(`^\w+$`)
 
 type KVTuple struct {
 	K string
@@ -69,39 +97,94 @@ func (recj *Recj) LookupCol(k string) string {
 	return ""
 }
 
-func ensureNewlineEnd(s string) string {
-	if !strings.HasSuffix(s, "\n") {
-		s = s + "\n"
-	}
-	return s
-}
-
+// Write record as recj text.
 func (recj *Recj) WriteString(w io.Writer) {
-	var mlFields []KVTuple
+	io.WriteString(w, recj.text())
+}
 
+func (recj *Recj) text() string {
+	var b strings.Builder
 	for _, field := range recj.Fields {
-		// Multiline fields added last
-		if strings.Contains(field.V, "\n") {
-			mlFields = append(mlFields, field)
+		if !isMultilineField(field) {
+			b.WriteString(escapeRecjKey(field.K) + ": " + escapeRecjVal(field.V) + "\n")
 			continue
 		}
 
-		fmt.Fprintf(w, "%s: %s\n", field.K, field.V)
+		b.WriteString("===" + field.K + "===\n")
+		for _, line := range strings.Split(strings.TrimSuffix(field.V, "\n"), "\n") {
+			if escapedContentLine(line) {
+				line = "\\" + line
+			}
+			b.WriteString(line + "\n")
+		}
+		b.WriteString(RecjEndMarker + "\n")
+	}
+	return b.String()
+}
+
+// Return true if field is written as a multiline field.
+func isMultilineField(field KVTuple) bool {
+	return _recjMultilineKeyRe.MatchString(field.K) &&
+		strings.HasSuffix(field.V, "\n") &&
+		!strings.Contains(field.V, "\r")
+}
+
+// Return true if multiline content line needs a leading '\\' escape.
+func escapedContentLine(line string) bool {
+	return strings.HasPrefix(line, "\\") || strings.HasPrefix(line, "%") || strings.HasPrefix(line, "=")
+}
+
+var _recjValEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+var _recjKeyEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r", ":", "\\:")
+
+func escapeRecjVal(v string) string {
+	return _recjValEscaper.Replace(v)
+}
+
+func escapeRecjKey(k string) string {
+	k = _recjKeyEscaper.Replace(k)
+	if strings.HasPrefix(k, "%") || strings.HasPrefix(k, "=") {
+		k = "\\" + k
 	}
+	return k
+}
+
+// Return s with recj escapes replaced by the characters they stand for.
+func unescapeRecj(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
 
-	// Write remaining multiline fields
-	for _, field := range mlFields {
-		fmt.Fprintf(w, "===%s===\n", field.K)
-		fmt.Fprintf(w, ensureNewlineEnd(field.V))
+		i++
+		switch s[i] {
+		case '\\', ':', '%', '=':
+			b.WriteByte(s[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
 	}
+	return b.String()
 }
 
 func (recjs Recjs) WriteString(w io.Writer) {
-	// Write each recj separated by a '%%'
-	for i, recj := range recjs {
-		recj.WriteString(w)
-		if i < len(recjs)-1 {
-			io.WriteString(w, "%%\n")
+	enc := NewEncoder(w)
+	for _, recj := range recjs {
+		err := enc.Encode(recj)
+		if err != nil {
+			return
 		}
 	}
 }
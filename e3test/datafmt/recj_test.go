@@ -0,0 +1,223 @@
+package datafmt
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// Pieces random field names and values are built from, weighted towards
+// the characters and sequences with a meaning in recj text.
+var _recjPieces = []string{
+	"a", "b", "Z", "_", "1", " ", "\t", "é", "日",
+	":", ": ", "\\", "\\n", "\\:", "%", "%%", "%d", "=", "===", "#",
+	"\n", "\r", "\r\n", "\x00",
+}
+
+func randRecjString(rnd *rand.Rand, maxPieces int) string {
+	var b strings.Builder
+	n := rnd.Intn(maxPieces + 1)
+	for i := 0; i < n; i++ {
+		b.WriteString(_recjPieces[rnd.Intn(len(_recjPieces))])
+	}
+	return b.String()
+}
+
+// Random field name, a plain word half the time so multiline fields get
+// written.
+func randRecjKey(rnd *rand.Rand) string {
+	if rnd.Intn(2) == 0 {
+		words := []string{"title", "body", "tags", "k_1", "Field2"}
+		return words[rnd.Intn(len(words))]
+	}
+	return randRecjString(rnd, 6)
+}
+
+// Random field value, ending in a newline a third of the time.
+func randRecjVal(rnd *rand.Rand) string {
+	v := randRecjString(rnd, 12)
+	if rnd.Intn(3) == 0 {
+		v += "\n"
+	}
+	return v
+}
+
+// Recjs with at least one field per record, as records without fields
+// aren't written.
+type testRecjs Recjs
+
+func (testRecjs) Generate(rnd *rand.Rand, size int) reflect.Value {
+	var recjs testRecjs
+	nrecjs := rnd.Intn(4)
+	for i := 0; i < nrecjs; i++ {
+		recj := NewRecj()
+		nfields := 1 + rnd.Intn(5)
+		for j := 0; j < nfields; j++ {
+			recj.AddField(randRecjKey(rnd), randRecjVal(rnd))
+		}
+		recjs = append(recjs, recj)
+	}
+	return reflect.ValueOf(recjs)
+}
+
+func recjsEqual(a, b Recjs) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i].Fields) != len(b[i].Fields) {
+			return false
+		}
+		for j := range a[i].Fields {
+			if a[i].Fields[j] != b[i].Fields[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Fields of each record, for test failure messages.
+func recjsFields(recjs Recjs) [][]KVTuple {
+	var fields [][]KVTuple
+	for _, recj := range recjs {
+		fields = append(fields, recj.Fields)
+	}
+	return fields
+}
+
+func recjsString(recjs Recjs) string {
+	var b bytes.Buffer
+	recjs.WriteString(&b)
+	return b.String()
+}
+
+func TestRecjRoundTrip(t *testing.T) {
+	f := func(x testRecjs) bool {
+		s := recjsString(Recjs(x))
+		got := RecjsFromString(s)
+		if !recjsEqual(got, Recjs(x)) {
+			t.Logf("recj text:\n%s", s)
+			return false
+		}
+		return true
+	}
+
+	err := quick.Check(f, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecjStreamRoundTrip(t *testing.T) {
+	f := func(x testRecjs) bool {
+		var b bytes.Buffer
+		enc := NewEncoder(&b)
+		for _, recj := range x {
+			err := enc.Encode(recj)
+			if err != nil {
+				t.Logf("encode error (%s)", err)
+				return false
+			}
+		}
+
+		dec := NewDecoder(&b)
+		var got Recjs
+		for {
+			recj, err := dec.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Logf("decode error (%s)", err)
+				return false
+			}
+			got = append(got, recj)
+		}
+		return recjsEqual(got, Recjs(x))
+	}
+
+	err := quick.Check(f, &quick.Config{MaxCount: 500})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecjDecoderSyntaxError(t *testing.T) {
+	s := "id: 1\ntitle: One\n%%\nid: 2\n\nnot a field\ntitle: Two\n%%\nid: 3\n"
+
+	dec := NewDecoder(strings.NewReader(s))
+	recj, err := dec.Next()
+	if err != nil || recj.LookupCol("id") != "1" {
+		t.Fatalf("first record: got %v, %v", recj, err)
+	}
+
+	// The record is read to its end and returned with the error.
+	recj, err = dec.Next()
+	serr, ok := err.(*SyntaxError)
+	if !ok || serr.Line != 6 || serr.RecordLine != 4 {
+		t.Fatalf("expected syntax error on line 6 of record at line 4, got %v", err)
+	}
+	if recj == nil || recj.LookupCol("id") != "2" || recj.LookupCol("title") != "Two" {
+		t.Fatalf("record with syntax error: got %v", recj)
+	}
+
+	// Reading continues with the next record.
+	recj, err = dec.Next()
+	if err != nil || recj.LookupCol("id") != "3" {
+		t.Fatalf("last record: got %v, %v", recj, err)
+	}
+	_, err = dec.Next()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestRecjFields(t *testing.T) {
+	tests := []struct {
+		name string
+		k, v string
+	}{
+		{"colon in value", "title", "Re: meeting"},
+		{"percent in value", "title", "100% of %d %s"},
+		{"record separator in body", "body", "line 1\n%%\nline 3\n"},
+		{"end marker in body", "body", "===\n===body===\n"},
+		{"escaped content line", "body", "\\%% stays\n\\begin\n"},
+		{"body without final newline", "body", "line 1\nline 2"},
+		{"crlf", "body", "line 1\r\nline 2\r\n"},
+		{"colon in name", "a: b", "v"},
+		{"separator name", "%%", "v"},
+		{"empty", "title", ""},
+	}
+
+	for _, tt := range tests {
+		recj := NewRecj()
+		recj.AddField(tt.k, tt.v)
+		recj.AddField("after", "x")
+
+		s := recjsString(Recjs{recj})
+		got := RecjsFromString(s)
+		if !recjsEqual(got, Recjs{recj}) {
+			t.Errorf("%s: wrote %q, read back %q", tt.name, s, recjsFields(got))
+		}
+	}
+}
+
+// Records written before end markers and escapes read back the same.
+func TestRecjUnescapedText(t *testing.T) {
+	s := "id: 1\ntitle: Re: meeting\npath: C:\\dir\n===body===\nline 1\nline 2\n===notes===\nnote\n%%\nid: 2\n"
+
+	want := Recjs{
+		{Fields: []KVTuple{{"id", "1"}, {"title", "Re: meeting"}, {"path", "C:\\dir"}, {"body", "line 1\nline 2\n"}, {"notes", "note\n"}}},
+		{Fields: []KVTuple{{"id", "2"}}},
+	}
+
+	got := RecjsFromString(s)
+	if !recjsEqual(got, want) {
+		t.Errorf("read %q, want %q", recjsFields(got), recjsFields(want))
+	}
+}
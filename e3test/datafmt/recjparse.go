@@ -2,99 +2,81 @@ package datafmt
 
 import (
 	"bufio"
-	"bytes"
-	"fmt"
-	"regexp"
+	"io"
 	"strings"
 )
 
-func RecjsFromString(s string) Recjs {
-	var recjs Recjs
-	b := &bytes.Buffer{}
+// Longest line read, single line fields may hold a long escaped value.
+const _maxRecjLine = 64 * 1024 * 1024
 
-	scanner := bufio.NewScanner(strings.NewReader(s))
-	for scanner.Scan() {
-		line := scanner.Text()
+func newRecjScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, _maxRecjLine)
+	return scanner
+}
 
-		if strings.HasPrefix(line, "%%") {
-			recj := RecjFromString(b.String())
-			recjs = append(recjs, recj)
+// Return records in s. Lines that aren't fields are ignored.
+func RecjsFromString(s string) Recjs {
+	var recjs Recjs
 
-			b = &bytes.Buffer{}
-			continue
+	dec := NewDecoder(strings.NewReader(s))
+	dec.skipInvalid = true
+	for {
+		recj, err := dec.Next()
+		if err != nil {
+			// Only read errors are returned, a line too long to
+			// read ends the records.
+			break
 		}
-
-		fmt.Fprintf(b, "%s\n", line)
-	}
-
-	// Add last record
-	if b.String() != "" {
-		recj := RecjFromString(b.String())
 		recjs = append(recjs, recj)
 	}
 
 	return recjs
 }
 
+// Return first record in s.
 func RecjFromString(s string) *Recj {
-	var fields []KVTuple
-
-	r := regexp.MustCompile("^=+(\\w+)=+$")
-
-	scanner := bufio.NewScanner(strings.NewReader(s))
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		matches := r.FindStringSubmatch(line)
-		if matches != nil {
-			mlfield := matches[1]
-			fields = parseMultilineFields(mlfield, scanner, fields)
-			break
-		}
+	recjs := RecjsFromString(s)
+	if len(recjs) == 0 {
+		return NewRecj()
+	}
+	return recjs[0]
+}
 
-		toks := strings.Split(line, ": ")
-		if len(toks) < 2 {
-			continue
+// Parse single line field 'name: value', returning the unescaped name and
+// value. ok is false if line isn't a single line field.
+func ParseRecjField(line string) (string, string, bool) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			// Skip escaped char
+			i++
+		case ':':
+			if i+1 == len(line) {
+				return unescapeRecj(line[:i]), "", true
+			}
+			if line[i+1] == ' ' {
+				return unescapeRecj(line[:i]), unescapeRecj(line[i+2:]), true
+			}
 		}
-
-		k := toks[0]
-		v := strings.Replace(toks[1], "\\n", "\n", -1)
-		fields = append(fields, KVTuple{k, v})
 	}
+	return "", "", false
+}
 
-	return &Recj{
-		Fields: fields,
+// Return field name of a '===name===' line starting a multiline field.
+// ok is false if line doesn't start a multiline field.
+func RecjMultilineField(line string) (string, bool) {
+	matches := _recjMultilineRe.FindStringSubmatch(line)
+	if matches == nil {
+		return "", false
 	}
+	return matches[1], true
 }
 
-func parseMultilineFields(firstField string, scanner *bufio.Scanner, fields []KVTuple) []KVTuple {
-
-	curField := firstField
-	r := regexp.MustCompile("^=+(\\w+)=+$")
-	var b = &bytes.Buffer{}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		matches := r.FindStringSubmatch(line)
-		if matches != nil {
-			fields = append(fields, KVTuple{
-				K: curField,
-				V: b.String(),
-			})
-
-			curField = matches[1]
-			b = &bytes.Buffer{}
-			continue
-		}
-
-		fmt.Fprintf(b, "%s\n", line)
+// Return multiline content line without its '\\' escape.
+func unescapeContentLine(line string) string {
+	if strings.HasPrefix(line, "\\") && escapedContentLine(line[1:]) {
+		return line[1:]
 	}
-
-	fields = append(fields, KVTuple{
-		K: curField,
-		V: b.String(),
-	})
-
-	return fields
+	return line
 }
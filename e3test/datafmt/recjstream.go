@@ -0,0 +1,160 @@
+package datafmt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Record-jar streams.
+// A Decoder reads records one at a time from an input stream, and an
+// Encoder writes records one at a time to an output stream, so a record
+// list never has to be held in memory as a whole.
+
+// Error in recj text, Line is the number of the invalid line and
+// RecordLine the number of the first line of its record, from 1.
+type SyntaxError struct {
+	Line       int
+	RecordLine int
+	Msg        string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d of record at line %d: %s", e.Line, e.RecordLine, e.Msg)
+}
+
+type Decoder struct {
+	scanner *bufio.Scanner
+
+	// Number of lines read
+	nlines int
+
+	// Ignore lines that aren't fields instead of returning a SyntaxError.
+	skipInvalid bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{scanner: newRecjScanner(r)}
+}
+
+// Return number of the last line read, from 1.
+func (dec *Decoder) Line() int {
+	return dec.nlines
+}
+
+// Return next record in the stream, or io.EOF after the last record.
+// Records without fields are skipped.
+// If a line of the record isn't a field, the record is read to its end and
+// returned with a *SyntaxError for the first such line, the next call
+// continues with the record after it.
+func (dec *Decoder) Next() (*Recj, error) {
+	recj := NewRecj()
+
+	// Number of the first line of the record, and its first invalid line
+	recLine := 0
+	var serr *SyntaxError
+
+	// Multiline field being read
+	var mlfield string
+	var ml *strings.Builder
+
+	endMultiline := func() {
+		if ml != nil {
+			recj.AddField(mlfield, ml.String())
+			ml = nil
+		}
+	}
+
+	for dec.scanner.Scan() {
+		dec.nlines++
+		line := dec.scanner.Text()
+
+		if strings.HasPrefix(line, "%%") {
+			endMultiline()
+			if serr != nil {
+				return recj, serr
+			}
+			if len(recj.Fields) > 0 {
+				return recj, nil
+			}
+			continue
+		}
+
+		if recLine == 0 && strings.TrimSpace(line) != "" {
+			recLine = dec.nlines
+		}
+
+		if field, ok := RecjMultilineField(line); ok {
+			endMultiline()
+			mlfield = field
+			ml = &strings.Builder{}
+			continue
+		}
+
+		if ml != nil {
+			if line == RecjEndMarker {
+				endMultiline()
+				continue
+			}
+			ml.WriteString(unescapeContentLine(line))
+			ml.WriteString("\n")
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		k, v, ok := ParseRecjField(line)
+		if !ok {
+			if !dec.skipInvalid && serr == nil {
+				serr = &SyntaxError{dec.nlines, recLine, fmt.Sprintf("expected 'name: value', got '%s'", line)}
+			}
+			continue
+		}
+		recj.AddField(k, v)
+	}
+	err := dec.scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s", dec.nlines+1, err)
+	}
+
+	// Last record
+	endMultiline()
+	if serr != nil {
+		return recj, serr
+	}
+	if len(recj.Fields) > 0 {
+		return recj, nil
+	}
+	return nil, io.EOF
+}
+
+type Encoder struct {
+	w        io.Writer
+	nwritten int
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Write record, after a '%%' separator if it isn't the first.
+// Records without fields aren't written.
+func (enc *Encoder) Encode(recj *Recj) error {
+	if len(recj.Fields) == 0 {
+		return nil
+	}
+
+	s := recj.text()
+	if enc.nwritten > 0 {
+		s = "%%\n" + s
+	}
+	_, err := io.WriteString(enc.w, s)
+	if err != nil {
+		return err
+	}
+	enc.nwritten++
+	return nil
+}
@@ -0,0 +1,28 @@
+package osutil
+
+import (
+	"context"
+	"os"
+	"os/signal"
+)
+
+// Return context that is canceled when any of the signals is received,
+// or when parent is done.
+// Call the returned cancel func to stop listening for the signals.
+func SignalContext(parent context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+
+	go func() {
+		select {
+		case <-c:
+		case <-ctx.Done():
+		}
+		signal.Stop(c)
+		cancel()
+	}()
+
+	return ctx, cancel
+}
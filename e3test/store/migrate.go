@@ -0,0 +1,274 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schema migrations.
+// The schema version of a database is the latest migration applied to it,
+// recorded in the schemaversion table. Migrations are applied in version
+// order, each one once.
+//
+// To change the schema, append a migration to _migrations with the next
+// version number. Never change a migration once released, databases
+// already at its version won't run it again.
+
+type Migration struct {
+	Version int
+	Desc    string
+
+	// sql statements run on all drivers, followed by the statements for
+	// the store's driver.
+	Stmts    []string
+	Sqlite   []string
+	Postgres []string
+}
+
+var _migrations = []*Migration{
+	{
+		Version: 1,
+		Desc:    "create node, nodechange, nodetag, nodehist, nodelink, nodetrash tables",
+		Stmts: []string{
+			`CREATE TABLE IF NOT EXISTS node (
+				id TEXT PRIMARY KEY,
+				hash TEXT,
+				alias TEXT,
+				title TEXT,
+				assigned TEXT,
+				body TEXT,
+				createdt TEXT,
+				updatedt TEXT)`,
+			`CREATE TABLE IF NOT EXISTS nodechange (
+				id TEXT PRIMARY KEY)`,
+			`CREATE TABLE IF NOT EXISTS nodetag (
+				id TEXT,
+				tag TEXT,
+				UNIQUE (id, tag))`,
+			`CREATE TABLE IF NOT EXISTS nodehist (
+				id TEXT,
+				rev INTEGER,
+				hash TEXT,
+				alias TEXT,
+				title TEXT,
+				assigned TEXT,
+				body TEXT,
+				tags TEXT,
+				savedt TEXT,
+				UNIQUE (id, rev))`,
+			`CREATE TABLE IF NOT EXISTS nodelink (
+				fromid TEXT,
+				toid TEXT,
+				rel TEXT,
+				UNIQUE (fromid, toid, rel))`,
+			`CREATE TABLE IF NOT EXISTS nodetrash (
+				id TEXT PRIMARY KEY,
+				hash TEXT,
+				alias TEXT,
+				title TEXT,
+				assigned TEXT,
+				body TEXT,
+				tags TEXT,
+				createdt TEXT,
+				updatedt TEXT,
+				deldt TEXT)`,
+		},
+	},
+	{
+		Version: 2,
+		Desc:    "add custom fields: nodefield table, nodehist and nodetrash fields columns",
+		Stmts: []string{
+			`CREATE TABLE IF NOT EXISTS nodefield (
+				id TEXT,
+				name TEXT,
+				val TEXT,
+				UNIQUE (id, name))`,
+			"ALTER TABLE nodehist ADD COLUMN fields TEXT",
+			"ALTER TABLE nodetrash ADD COLUMN fields TEXT",
+		},
+	},
+}
+
+// Return schema version of this binary, the version of its latest
+// migration.
+func SchemaVersion() int {
+	return _migrations[len(_migrations)-1].Version
+}
+
+// Return sql statements of migration m for driver.
+func (m *Migration) DriverStmts(driver string) []string {
+	stmts := append([]string{}, m.Stmts...)
+	switch driver {
+	case "sqlite3":
+		stmts = append(stmts, m.Sqlite...)
+	case "postgres":
+		stmts = append(stmts, m.Postgres...)
+	}
+	return stmts
+}
+
+// Return schema version of the database, 0 if no migrations were applied.
+func (st *Store) DBSchemaVersion() (int, error) {
+	if st.DB() == nil {
+		return 0, dbnilErr()
+	}
+
+	var q string
+	if isSqlite(st) {
+		q = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schemaversion'"
+	} else {
+		q = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schemaversion'"
+	}
+	var ntables int
+	err := st.conn().QueryRow(q).Scan(&ntables)
+	if err != nil {
+		return 0, errSql(q, err)
+	}
+	if ntables == 0 {
+		return 0, nil
+	}
+
+	q = "SELECT COALESCE(MAX(version), 0) FROM schemaversion"
+	var version int
+	err = st.conn().QueryRow(q).Scan(&version)
+	if err != nil {
+		return 0, errSql(q, err)
+	}
+	return version, nil
+}
+
+// Return error if the database schema is older than this binary's, as the
+// store is read-only until its pending migrations are applied.
+// A newer schema is read-only too, but can still be read.
+func (st *Store) CheckSchemaCurrent() error {
+	version, err := st.DBSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < SchemaVersion() {
+		return schemaOlderErr(version)
+	}
+	if version > SchemaVersion() {
+		st.Logger.Printf("%s\n", schemaNewerErr(version))
+	}
+	return nil
+}
+
+// Return migrations not yet applied to the database, in version order.
+func (st *Store) PendingMigrations() ([]*Migration, error) {
+	version, err := st.DBSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion() {
+		return nil, schemaNewerErr(version)
+	}
+
+	var ms []*Migration
+	for _, m := range _migrations {
+		if m.Version > version {
+			ms = append(ms, m)
+		}
+	}
+	return ms, nil
+}
+
+// Apply pending migrations in a single transaction.
+// If any migration fails, none of them are applied.
+// Returns the migrations applied.
+func (st *Store) Migrate() ([]*Migration, error) {
+	defer st.resetSchemaVersion()
+
+	var applied []*Migration
+	err := st.schemaWriter().WithTx(func(txst *Store) error {
+		ms, err := txst.PendingMigrations()
+		if err != nil {
+			return err
+		}
+
+		var eb ErrorBag
+		q := "CREATE TABLE IF NOT EXISTS schemaversion (version INTEGER PRIMARY KEY, description TEXT, applieddt TEXT)"
+		txst.execSql(q, &eb)
+		if eb.HasErrors() {
+			return eb
+		}
+
+		for _, m := range ms {
+			for _, stmt := range m.DriverStmts(txst.Driver) {
+				txst.execSql(stmt, &eb)
+			}
+
+			q = fmt.Sprintf("INSERT INTO schemaversion (version, description, applieddt) VALUES (%s)", txst.sqlParams(3))
+			txst.execSql(q, &eb, m.Version, m.Desc, isotimestr(time.Now()))
+
+			if eb.HasErrors() {
+				return fmt.Errorf("migration %d failed (%s)", m.Version, eb)
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range applied {
+		st.Logger.Printf("Applied schema migration %d: %s\n", m.Version, m.Desc)
+	}
+	return applied, nil
+}
+
+// Return error if the store can't be written to.
+// A database with a schema newer than this binary is read-only, its tables
+// may have changed in ways this binary doesn't know about. A database with
+// an older schema needs its pending migrations applied first.
+// The schema version is read on the store's first write.
+func (st *Store) checkWritable() error {
+	if st.schemaWrite {
+		return nil
+	}
+
+	st.res.schemaMu.Lock()
+	defer st.res.schemaMu.Unlock()
+
+	if !st.res.schemaChecked {
+		version, err := st.DBSchemaVersion()
+		if err != nil {
+			// Let the write itself report db errors.
+			return nil
+		}
+		st.res.schemaVersion = version
+		st.res.schemaChecked = true
+	}
+
+	version := st.res.schemaVersion
+	if version > SchemaVersion() {
+		return schemaNewerErr(version)
+	}
+	if version < SchemaVersion() {
+		return schemaOlderErr(version)
+	}
+	return nil
+}
+
+// Have the schema version read again on the next write.
+func (st *Store) resetSchemaVersion() {
+	st.res.schemaMu.Lock()
+	st.res.schemaChecked = false
+	st.res.schemaMu.Unlock()
+}
+
+// Return copy of store that writes without checking the schema version.
+func (st *Store) schemaWriter() *Store {
+	sw := *st
+	sw.schemaWrite = true
+	return &sw
+}
+
+func schemaOlderErr(version int) error {
+	return fmt.Errorf("database schema version %d is older than this e3's version %d, run 'e migrate'", version, SchemaVersion())
+}
+
+func schemaNewerErr(version int) error {
+	return fmt.Errorf("database schema version %d is newer than this e3's version %d, store is read-only", version, SchemaVersion())
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Apply migrations up to version to st, as an older e3 would have.
+func migrateTo(t *testing.T, st *Store, version int) {
+	t.Helper()
+
+	sw := st.schemaWriter()
+	var eb ErrorBag
+	sw.execSql("CREATE TABLE IF NOT EXISTS schemaversion (version INTEGER PRIMARY KEY, description TEXT, applieddt TEXT)", &eb)
+	for _, m := range _migrations {
+		if m.Version > version {
+			break
+		}
+		for _, stmt := range m.DriverStmts(sw.Driver) {
+			sw.execSql(stmt, &eb)
+		}
+		sw.execSql("INSERT INTO schemaversion (version, description, applieddt) VALUES (?, ?, ?)", &eb, m.Version, m.Desc, isotimestr(time.Now()))
+	}
+	if eb.HasErrors() {
+		t.Fatal(eb)
+	}
+	st.resetSchemaVersion()
+}
+
+func migrationVersions(ms []*Migration) string {
+	var vs []string
+	for _, m := range ms {
+		vs = append(vs, fmt.Sprint(m.Version))
+	}
+	return strings.Join(vs, ",")
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		from        int
+		wantApplied string
+	}{
+		{0, "1,2"},
+		{1, "2"},
+		{2, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("from %d", tt.from), func(t *testing.T) {
+			st := tempStore(t)
+			if tt.from > 0 {
+				migrateTo(t, st, tt.from)
+			}
+
+			version, err := st.DBSchemaVersion()
+			if err != nil || version != tt.from {
+				t.Fatalf("schema version %d (%v), want %d", version, err, tt.from)
+			}
+
+			// Writing needs the latest schema.
+			_, err = st.SaveNode(&Node{Title: "before migrate"})
+			if tt.from < SchemaVersion() && (err == nil || !strings.Contains(err.Error(), "run 'e migrate'")) {
+				t.Fatalf("saving node to schema version %d: %v, want migrate error", tt.from, err)
+			}
+			err = st.CheckSchemaCurrent()
+			if (err == nil) != (tt.from == SchemaVersion()) {
+				t.Fatalf("schema version %d current: %v", tt.from, err)
+			}
+
+			ms, err := st.PendingMigrations()
+			if err != nil || migrationVersions(ms) != tt.wantApplied {
+				t.Fatalf("pending migrations %s (%v), want %s", migrationVersions(ms), err, tt.wantApplied)
+			}
+
+			ms, err = st.Migrate()
+			if err != nil || migrationVersions(ms) != tt.wantApplied {
+				t.Fatalf("applied migrations %s (%v), want %s", migrationVersions(ms), err, tt.wantApplied)
+			}
+
+			version, err = st.DBSchemaVersion()
+			if err != nil || version != SchemaVersion() {
+				t.Fatalf("migrated schema version %d (%v), want %d", version, err, SchemaVersion())
+			}
+			err = st.CheckSchemaCurrent()
+			if err != nil {
+				t.Fatalf("migrated schema not current (%s)", err)
+			}
+
+			ms, err = st.Migrate()
+			if err != nil || len(ms) != 0 {
+				t.Fatalf("migrating again applied %s (%v)", migrationVersions(ms), err)
+			}
+
+			n := &Node{Title: "after migrate"}
+			n.SetCustomField("priority", "high")
+			_, err = st.SaveNode(n)
+			if err != nil {
+				t.Fatalf("error saving node after migrate (%s)", err)
+			}
+		})
+	}
+}
+
+// Rows written at schema version 1 read back after migrating, with no
+// custom fields.
+func TestMigrateV1Data(t *testing.T) {
+	st := tempStore(t)
+	migrateTo(t, st, 1)
+
+	sw := st.schemaWriter()
+	var eb ErrorBag
+	dt := isotimestr(time.Now())
+	sw.execSql("INSERT INTO node (id, hash, alias, title, assigned, body, createdt, updatedt) VALUES ('1', 'h1', 'one', 'One', 'rob', 'body\n', ?, ?)", &eb, dt, dt)
+	sw.execSql("INSERT INTO nodetag (id, tag) VALUES ('1', 'urgent')", &eb)
+	sw.execSql("INSERT INTO nodehist (id, rev, hash, alias, title, assigned, body, tags, savedt) VALUES ('1', 1, 'h1', 'one', 'One', 'rob', 'body\n', 'urgent', ?)", &eb, dt)
+	sw.execSql("INSERT INTO nodetrash (id, hash, alias, title, assigned, body, tags, createdt, updatedt, deldt) VALUES ('2', 'h2', 'two', 'Two', '', '', 'later', ?, ?, ?)", &eb, dt, dt, dt)
+	if eb.HasErrors() {
+		t.Fatal(eb)
+	}
+
+	_, err := st.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := st.LoadNodeByID("1")
+	if err != nil || n == nil {
+		t.Fatalf("node 1: %v, %v", n, err)
+	}
+	if n.Title != "One" || strings.Join(n.Tags, ",") != "urgent" || len(n.Fields) != 0 {
+		t.Errorf("node 1 loaded as %+v", n)
+	}
+
+	nrs, err := st.LoadNodeRevs("1")
+	if err != nil || len(nrs) != 1 || nrs[0].Node.Title != "One" || len(nrs[0].Node.Fields) != 0 {
+		t.Errorf("node 1 revisions %v (%v)", nrs, err)
+	}
+
+	tns, err := st.LoadTrashedNodes()
+	if err != nil || len(tns) != 1 || tns[0].Node.ID != "2" || len(tns[0].Node.Fields) != 0 {
+		t.Errorf("trashed nodes %v (%v)", tns, err)
+	}
+
+	ok, err := st.RestoreTrashedNode("2")
+	if err != nil || !ok {
+		t.Errorf("error restoring node 2 (%v)", err)
+	}
+}
+
+// A database with a newer schema is read-only.
+func TestSchemaNewer(t *testing.T) {
+	st, _ := genStore(t, 1)
+
+	var eb ErrorBag
+	st.schemaWriter().execSql("INSERT INTO schemaversion (version, description, applieddt) VALUES (?, 'future', '')", &eb, SchemaVersion()+1)
+	if eb.HasErrors() {
+		t.Fatal(eb)
+	}
+	st.resetSchemaVersion()
+
+	_, err := st.SaveNode(&Node{Title: "new"})
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("saving to newer schema: %v, want read-only error", err)
+	}
+
+	_, err = st.Migrate()
+	if err == nil {
+		t.Errorf("migrated newer schema")
+	}
+
+	// Served read-only.
+	err = st.CheckSchemaCurrent()
+	if err != nil {
+		t.Errorf("newer schema not servable (%s)", err)
+	}
+
+	ns, err := st.LoadNodes("id <> ''", "id", "")
+	if err != nil || len(ns) != 1 {
+		t.Errorf("loading from newer schema: %d nodes (%v)", len(ns), err)
+	}
+}
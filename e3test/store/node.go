@@ -16,14 +16,6 @@ func TagSep() string {
 	return _tagSep
 }
 
-func (nl *NodeList) toRecjs() datafmt.Recjs {
-	var recjs datafmt.Recjs
-	for _, n := range nl.Items {
-		recjs = append(recjs, n.toRecj())
-	}
-	return recjs
-}
-
 func nodeFromRecj(recj *datafmt.Recj) *Node {
 	var n Node
 
@@ -45,41 +37,54 @@ func nodeFromRecj(recj *datafmt.Recj) *Node {
 			n.Createdt = kv.V
 		case "updatedt":
 			n.Updatedt = kv.V
+		case "basehash":
+			n.Basehash = kv.V
+		default:
+			// Keys that aren't valid custom field names are dropped.
+			if ValidCustomFieldName(kv.K) {
+				n.SetCustomField(kv.K, kv.V)
+			}
 		}
 	}
 
 	return &n
 }
 
-func nodeListFromRecjs(recjs datafmt.Recjs) *NodeList {
-	var ns []*Node
-
-	for _, recj := range recjs {
-		n := nodeFromRecj(recj)
-		ns = append(ns, n)
-	}
-
-	return &NodeList{ns}
-}
-
-func (nl *NodeList) WriteRecjString(w io.Writer) {
-	nl.toRecjs().WriteString(w)
+// Write nodes as recj text.
+func (nl *NodeList) WriteRecjString(w io.Writer) error {
+	return WriteAllNodes(NewRecjNodeWriter(w), nl.Items)
 }
 
+// Write nodes as table, cols are node fields (see FieldVal()).
 func (nl *NodeList) WriteTableString(w io.Writer, cols []string) {
-	nl.toRecjs().WriteTableString(w, cols)
+	var recjs datafmt.Recjs
+	for _, n := range nl.Items {
+		recj := datafmt.NewRecj()
+		for _, col := range cols {
+			recj.AddField(col, n.FieldVal(col))
+		}
+		recjs = append(recjs, recj)
+	}
+	recjs.WriteTableString(w, cols)
 }
 
 func (n *Node) HashString() string {
 	s := fmt.Sprintf("%s%s%s%s%s", n.Alias, n.Title, n.Assigned, n.Body, strings.Join(n.Tags, _tagSep))
+
+	// Nodes without custom fields keep the hash they had before
+	// custom fields.
+	for _, name := range n.CustomFieldNames() {
+		s += fmt.Sprintf("\x00%s=%s", name, n.Fields[name])
+	}
+
 	h := sha1.New()
 	h.Write([]byte(s))
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func NodeListFromRecjString(s string) *NodeList {
-	recjs := datafmt.RecjsFromString(s)
-	return nodeListFromRecjs(recjs)
+// Read nodes from recj text.
+func NodeListFromRecjString(s string) (*NodeList, error) {
+	return ReadAllNodes(NewRecjNodeReader(strings.NewReader(s)))
 }
 
 //
@@ -111,10 +116,69 @@ func (n *Node) toRecj() *datafmt.Recj {
 	recj.AddField("tags", fmt.Sprintf("%s", strings.Join(n.Tags, _tagSep)))
 	recj.AddField("createdt", n.Createdt)
 	recj.AddField("updatedt", n.Updatedt)
+	for _, name := range n.CustomFieldNames() {
+		recj.AddField(name, n.Fields[name])
+	}
+	if n.Basehash != "" {
+		recj.AddField("basehash", n.Basehash)
+	}
 
 	return recj
 }
 
+// Return value of field, tags as csv text.
+// Custom fields are given with the '.' prefix, Ex. ".priority"
+func (n *Node) FieldVal(field string) string {
+	switch field {
+	case "id":
+		return n.ID
+	case "alias":
+		return n.Alias
+	case "title":
+		return n.Title
+	case "assigned":
+		return n.Assigned
+	case "body":
+		return n.Body
+	case "tags":
+		return strings.Join(n.Tags, _tagSep)
+	case "createdt":
+		return n.Createdt
+	case "updatedt":
+		return n.Updatedt
+	}
+	if name := customFieldName(field); name != "" {
+		return n.Fields[name]
+	}
+	return ""
+}
+
+// Set value of field, tags from csv text.
+func (n *Node) SetFieldVal(field, v string) {
+	switch field {
+	case "id":
+		n.ID = v
+	case "alias":
+		n.Alias = v
+	case "title":
+		n.Title = v
+	case "assigned":
+		n.Assigned = v
+	case "body":
+		n.Body = v
+	case "tags":
+		n.Tags = splitCsvTags(v)
+	case "createdt":
+		n.Createdt = v
+	case "updatedt":
+		n.Updatedt = v
+	default:
+		if name := customFieldName(field); name != "" {
+			n.SetCustomField(name, v)
+		}
+	}
+}
+
 func (n *Node) ExistsTag(tag string) bool {
 	for _, t := range n.Tags {
 		if t == tag {
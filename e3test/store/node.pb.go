@@ -29,15 +29,17 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Node struct {
-	ID       string   `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
-	Hash     string   `protobuf:"bytes,2,opt,name=Hash" json:"Hash,omitempty"`
-	Alias    string   `protobuf:"bytes,3,opt,name=Alias" json:"Alias,omitempty"`
-	Title    string   `protobuf:"bytes,4,opt,name=Title" json:"Title,omitempty"`
-	Assigned string   `protobuf:"bytes,5,opt,name=Assigned" json:"Assigned,omitempty"`
-	Body     string   `protobuf:"bytes,6,opt,name=Body" json:"Body,omitempty"`
-	Tags     []string `protobuf:"bytes,7,rep,name=Tags" json:"Tags,omitempty"`
-	Createdt string   `protobuf:"bytes,8,opt,name=Createdt" json:"Createdt,omitempty"`
-	Updatedt string   `protobuf:"bytes,9,opt,name=Updatedt" json:"Updatedt,omitempty"`
+	ID       string            `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Hash     string            `protobuf:"bytes,2,opt,name=Hash" json:"Hash,omitempty"`
+	Alias    string            `protobuf:"bytes,3,opt,name=Alias" json:"Alias,omitempty"`
+	Title    string            `protobuf:"bytes,4,opt,name=Title" json:"Title,omitempty"`
+	Assigned string            `protobuf:"bytes,5,opt,name=Assigned" json:"Assigned,omitempty"`
+	Body     string            `protobuf:"bytes,6,opt,name=Body" json:"Body,omitempty"`
+	Tags     []string          `protobuf:"bytes,7,rep,name=Tags" json:"Tags,omitempty"`
+	Createdt string            `protobuf:"bytes,8,opt,name=Createdt" json:"Createdt,omitempty"`
+	Updatedt string            `protobuf:"bytes,9,opt,name=Updatedt" json:"Updatedt,omitempty"`
+	Basehash string            `protobuf:"bytes,10,opt,name=Basehash" json:"Basehash,omitempty"`
+	Fields   map[string]string `protobuf:"bytes,11,rep,name=Fields" json:"Fields,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *Node) Reset()                    { *m = Node{} }
@@ -108,6 +110,20 @@ func (m *Node) GetUpdatedt() string {
 	return ""
 }
 
+func (m *Node) GetBasehash() string {
+	if m != nil {
+		return m.Basehash
+	}
+	return ""
+}
+
+func (m *Node) GetFields() map[string]string {
+	if m != nil {
+		return m.Fields
+	}
+	return nil
+}
+
 type NodeList struct {
 	Items []*Node `protobuf:"bytes,1,rep,name=Items" json:"Items,omitempty"`
 }
@@ -132,19 +148,23 @@ func init() {
 func init() { proto.RegisterFile("node.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 212 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x3c, 0x90, 0xb1, 0x4e, 0x87, 0x30,
-	0x10, 0xc6, 0xc3, 0x1f, 0x8a, 0x70, 0x24, 0x0e, 0x8d, 0xc3, 0xc5, 0x09, 0x99, 0x58, 0x64, 0xd0,
-	0x27, 0x40, 0x1d, 0x24, 0x31, 0x0e, 0x04, 0x1f, 0xa0, 0xa6, 0x0d, 0x36, 0x41, 0x4a, 0xb8, 0x2e,
-	0xbe, 0xa6, 0x4f, 0x24, 0xd7, 0x06, 0xb7, 0xef, 0xfb, 0xfd, 0x92, 0x2f, 0xb9, 0x03, 0x58, 0x9d,
-	0x36, 0xdd, 0xb6, 0x3b, 0xef, 0xa4, 0x20, 0xef, 0x76, 0xd3, 0xfc, 0x26, 0x90, 0xbd, 0x1f, 0x54,
-	0x5e, 0xc3, 0x65, 0x78, 0xc1, 0xa4, 0x4e, 0xda, 0x72, 0x3c, 0x92, 0x94, 0x90, 0xbd, 0x2a, 0xfa,
-	0xc2, 0x4b, 0x20, 0x21, 0xcb, 0x1b, 0x10, 0xfd, 0x62, 0x15, 0x61, 0x1a, 0x60, 0x2c, 0x4c, 0x27,
-	0xeb, 0x17, 0x83, 0x59, 0xa4, 0xa1, 0xc8, 0x5b, 0x28, 0x7a, 0x22, 0x3b, 0xaf, 0x46, 0xa3, 0x08,
-	0xe2, 0xbf, 0xf3, 0xf6, 0x93, 0xd3, 0x3f, 0x98, 0xc7, 0x6d, 0xce, 0xcc, 0x26, 0x35, 0x13, 0x5e,
-	0xd5, 0x29, 0x33, 0xce, 0xbc, 0xf1, 0xbc, 0x1b, 0xe5, 0x8d, 0xf6, 0x58, 0xc4, 0x8d, 0xb3, 0xb3,
-	0xfb, 0xd8, 0x74, 0x74, 0x65, 0x74, 0x67, 0x6f, 0xee, 0xa1, 0xe0, 0x9b, 0xde, 0x2c, 0x79, 0x79,
-	0x07, 0x62, 0xf0, 0xe6, 0x9b, 0x8e, 0xd3, 0xd2, 0xb6, 0x7a, 0xa8, 0xba, 0x70, 0x77, 0xc7, 0x7e,
-	0x8c, 0xe6, 0x33, 0x0f, 0x1f, 0x79, 0xfc, 0x0b, 0x00, 0x00, 0xff, 0xff, 0x84, 0xa4, 0x4d, 0xc6,
-	0x1f, 0x01, 0x00, 0x00,
+	// 274 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x4d, 0x91, 0x4f, 0x4b, 0xc3, 0x40,
+	0x10, 0xc5, 0xc9, 0x5f, 0xd3, 0x09, 0x88, 0x2c, 0x82, 0x4b, 0x4f, 0xb5, 0x27, 0x2f, 0x46, 0xd0,
+	0x8b, 0x7a, 0x6b, 0xd5, 0xd2, 0x82, 0x78, 0x08, 0xf5, 0x03, 0xac, 0xec, 0xd0, 0x06, 0x63, 0xb6,
+	0x64, 0x56, 0x21, 0x5f, 0xd5, 0x4f, 0x63, 0x66, 0x37, 0x91, 0xde, 0xde, 0x7b, 0xbf, 0xec, 0x9b,
+	0xcd, 0x2c, 0x40, 0x63, 0x34, 0x16, 0x87, 0xd6, 0x58, 0x23, 0x12, 0xb2, 0xa6, 0xc5, 0xf9, 0x6f,
+	0x08, 0xf1, 0x5b, 0x9f, 0x8a, 0x53, 0x08, 0x37, 0xcf, 0x32, 0x98, 0x05, 0x57, 0x93, 0xb2, 0x57,
+	0x42, 0x40, 0xbc, 0x56, 0xb4, 0x97, 0xa1, 0x4b, 0x9c, 0x16, 0xe7, 0x90, 0x2c, 0xea, 0x4a, 0x91,
+	0x8c, 0x5c, 0xe8, 0x0d, 0xa7, 0xdb, 0xca, 0xd6, 0x28, 0x63, 0x9f, 0x3a, 0x23, 0xa6, 0x90, 0x2d,
+	0x88, 0xaa, 0x5d, 0x83, 0x5a, 0x26, 0x0e, 0xfc, 0x7b, 0xee, 0x5e, 0x1a, 0xdd, 0xc9, 0xd4, 0x77,
+	0xb3, 0xe6, 0x6c, 0xab, 0x76, 0x24, 0x4f, 0x66, 0x11, 0x67, 0xac, 0xb9, 0xe3, 0xa9, 0x45, 0x65,
+	0x51, 0x5b, 0x99, 0xf9, 0x8e, 0xd1, 0x33, 0x7b, 0x3f, 0x68, 0xcf, 0x26, 0x9e, 0x8d, 0x9e, 0xd9,
+	0x52, 0x11, 0xee, 0xf9, 0xfe, 0xe0, 0xd9, 0xe8, 0xc5, 0x0d, 0xa4, 0xab, 0x0a, 0x6b, 0x4d, 0x32,
+	0xef, 0x27, 0xe5, 0xb7, 0x17, 0x85, 0x5b, 0x44, 0xc1, 0x4b, 0x28, 0x3c, 0x79, 0x69, 0x6c, 0xdb,
+	0x95, 0xc3, 0x67, 0xd3, 0x07, 0xc8, 0x8f, 0x62, 0x71, 0x06, 0xd1, 0x27, 0x76, 0xc3, 0xa2, 0x58,
+	0xf2, 0xff, 0xff, 0xa8, 0xfa, 0x1b, 0x87, 0x55, 0x79, 0xf3, 0x18, 0xde, 0x07, 0xf3, 0x6b, 0xc8,
+	0xb8, 0xf6, 0xb5, 0x22, 0x2b, 0x2e, 0x21, 0xd9, 0x58, 0xfc, 0xa2, 0xfe, 0x24, 0x8f, 0xcd, 0x8f,
+	0xc6, 0x96, 0x9e, 0x7c, 0xa4, 0xee, 0x65, 0xee, 0xfe, 0x00, 0xa5, 0x7c, 0x16, 0x7e, 0xa7, 0x01,
+	0x00, 0x00,
 }
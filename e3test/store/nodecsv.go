@@ -0,0 +1,197 @@
+package store
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Default csv columns, in output order.
+var CsvCols = []string{"id", "alias", "title", "assigned", "body", "tags", "createdt", "updatedt"}
+
+// Validate csv list of node fields and return the list of field names.
+// Returns CsvCols if scols is blank.
+// Ex. "id,title,tags,.priority"
+func ParseCsvCols(scols string) ([]string, error) {
+	if strings.TrimSpace(scols) == "" {
+		return CsvCols, nil
+	}
+
+	var cols []string
+	for _, col := range strings.Split(scols, ",") {
+		field, err := ParseNodeField(col)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, field)
+	}
+
+	return cols, nil
+}
+
+// Parse csv header to field mapping.
+// Ex. "Summary:title,Owner:assigned,Priority:.priority"
+// Returns: {"summary": "title", "owner": "assigned", "priority": ".priority"}
+func ParseCsvColMap(smap string) (map[string]string, error) {
+	colmap := map[string]string{}
+	if strings.TrimSpace(smap) == "" {
+		return colmap, nil
+	}
+
+	for _, kv := range strings.Split(smap, ",") {
+		i := strings.LastIndex(kv, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid column mapping '%s', expected header:field", kv)
+		}
+
+		header := csvHeaderKey(kv[:i])
+		field, err := ParseNodeField(kv[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("unknown node field in column mapping '%s'", kv)
+		}
+		colmap[header] = field
+	}
+
+	return colmap, nil
+}
+
+func csvHeaderKey(header string) string {
+	return strings.ToLower(strings.TrimSpace(header))
+}
+
+// Read csv text into node list.
+// First row is the header, identifying the node field of each column.
+// Header names are matched against field names (case insensitive), or
+// through colmap if a header is mapped (see ParseCsvColMap()).
+// Columns that don't map to a node field are ignored.
+func NodeListFromCSV(r io.Reader, colmap map[string]string) (*NodeList, error) {
+	return ReadAllNodes(NewCSVNodeReader(r, colmap))
+}
+
+// Write node list as csv text with header row, using cols as columns.
+func (nl *NodeList) WriteCSV(w io.Writer, cols []string) error {
+	return WriteAllNodes(NewCSVNodeWriter(w, cols), nl.Items)
+}
+
+// Reads csv rows one node at a time, see NodeListFromCSV().
+type csvNodeReader struct {
+	cr     *csv.Reader
+	colmap map[string]string
+
+	// Node field for each column, "" if column isn't mapped.
+	fields []string
+}
+
+func NewCSVNodeReader(r io.Reader, colmap map[string]string) NodeReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	return &csvNodeReader{cr: cr, colmap: colmap}
+}
+
+func (nr *csvNodeReader) readHeader() error {
+	header, err := nr.cr.Read()
+	if err == io.EOF {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("csv read error (%s)", err)
+	}
+
+	nr.fields = make([]string, len(header))
+	for i, h := range header {
+		k := csvHeaderKey(h)
+		if field, ok := nr.colmap[k]; ok {
+			nr.fields[i] = field
+		} else if field, ok := _nodeCondFields[k]; ok {
+			nr.fields[i] = field
+		}
+	}
+	return nil
+}
+
+func (nr *csvNodeReader) Next() (*Node, error) {
+	if nr.fields == nil {
+		err := nr.readHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	row, err := nr.cr.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("csv read error (%s)", err)
+	}
+
+	n := &Node{}
+	for i, v := range row {
+		if i < len(nr.fields) && nr.fields[i] != "" {
+			n.SetFieldVal(nr.fields[i], v)
+		}
+	}
+	return n, nil
+}
+
+// Writes csv header row, then one row per node.
+type csvNodeWriter struct {
+	cw          *csv.Writer
+	cols        []string
+	row         []string
+	wroteHeader bool
+}
+
+func NewCSVNodeWriter(w io.Writer, cols []string) NodeWriter {
+	return &csvNodeWriter{
+		cw:   csv.NewWriter(w),
+		cols: cols,
+		row:  make([]string, len(cols)),
+	}
+}
+
+func (nw *csvNodeWriter) writeHeader() error {
+	nw.wroteHeader = true
+
+	err := nw.cw.Write(nw.cols)
+	if err != nil {
+		return fmt.Errorf("csv write error (%s)", err)
+	}
+	return nil
+}
+
+func (nw *csvNodeWriter) Write(n *Node) error {
+	if !nw.wroteHeader {
+		err := nw.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, col := range nw.cols {
+		nw.row[i] = n.FieldVal(col)
+	}
+
+	err := nw.cw.Write(nw.row)
+	if err != nil {
+		return fmt.Errorf("csv write error node %s (%s)", n.ID, err)
+	}
+	return nil
+}
+
+func (nw *csvNodeWriter) Close() error {
+	if !nw.wroteHeader {
+		err := nw.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	nw.cw.Flush()
+	err := nw.cw.Error()
+	if err != nil {
+		return fmt.Errorf("csv write error (%s)", err)
+	}
+	return nil
+}
@@ -14,6 +14,10 @@ func isSqlite(st *Store) bool {
 	return st.Driver == "sqlite3"
 }
 
+// Error of a save or delete conditional on the node's hash, when the
+// stored node has a different hash or doesn't exist.
+var ErrNodeChanged = errors.New("node changed since loaded")
+
 func dbnilErr() error {
 	return errors.New("error opening db, check logs")
 }
@@ -45,7 +49,7 @@ func (st *Store) NodeIsUpToDate(id, hash string) (bool, error) {
 	} else {
 		q = "SELECT id, hash FROM node where id = $1 AND hash = $2"
 	}
-	row := st.DB().QueryRow(q, id, hash)
+	row := st.conn().QueryRow(q, id, hash)
 
 	err := row.Scan(&id, &hash)
 	if err == sql.ErrNoRows {
@@ -69,7 +73,7 @@ func (st *Store) LoadNodeByID(id string) (*Node, error) {
 	} else {
 		q = "SELECT id, hash, alias, title, assigned, body, createdt, updatedt FROM node WHERE id = $1"
 	}
-	row := st.DB().QueryRow(q, id)
+	row := st.conn().QueryRow(q, id)
 
 	n := Node{}
 	err := row.Scan(&n.ID, &n.Hash, &n.Alias, &n.Title, &n.Assigned, &n.Body, &n.Createdt, &n.Updatedt)
@@ -86,6 +90,11 @@ func (st *Store) LoadNodeByID(id string) (*Node, error) {
 	}
 	n.Tags = tags
 
+	err = st.loadNodesFields([]*Node{&n})
+	if err != nil {
+		return nil, err
+	}
+
 	return &n, nil
 }
 
@@ -96,7 +105,117 @@ func (st *Store) LoadNodes(qwhere, qorderby, qlimit string, vals ...interface{})
 
 	q := fmt.Sprintf("SELECT id, hash, alias, title, assigned, body, createdt, updatedt FROM node WHERE %s ORDER BY %s %s", qwhere, qorderby, qlimit)
 
-	rows, err := st.DB().Query(q, vals...)
+	ns, err := st.queryNodes(q, vals...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = st.loadNodesTags(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	err = st.loadNodesFields(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+// Call fn for each node, in descending ID order, up to limit nodes.
+// limit <= 0 means all nodes.
+// Nodes are loaded a batch at a time, so all nodes aren't held in memory
+// at once. Stops at the first error returned by fn.
+func (st *Store) EachNode(limit int, fn func(n *Node) error) error {
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	nfound := 0
+	lastID := ""
+	for {
+		batchSize := _idBatchSize
+		if limit > 0 && limit-nfound < batchSize {
+			batchSize = limit - nfound
+		}
+		if batchSize <= 0 {
+			return nil
+		}
+		qlimit := fmt.Sprintf("limit %d", batchSize)
+
+		var ns []*Node
+		var err error
+		if lastID == "" {
+			ns, err = st.LoadNodes("id <> ''", "id desc", qlimit)
+		} else {
+			qwhere := fmt.Sprintf("id <> '' AND id < %s", st.sqlParam(1))
+			ns, err = st.LoadNodes(qwhere, "id desc", qlimit, lastID)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, n := range ns {
+			err := fn(n)
+			if err != nil {
+				return err
+			}
+		}
+		nfound += len(ns)
+
+		if len(ns) < batchSize {
+			return nil
+		}
+		lastID = ns[len(ns)-1].ID
+	}
+}
+
+// Load nodes with IDs, in the same order as ids.
+// IDs that don't exist are skipped.
+func (st *Store) LoadNodesByIDs(ids []string) ([]*Node, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	nodesByID := map[string]*Node{}
+
+	for _, batch := range idBatches(ids) {
+		q := fmt.Sprintf("SELECT id, hash, alias, title, assigned, body, createdt, updatedt FROM node WHERE id IN (%s)", st.sqlParams(len(batch)))
+		ns, err := st.queryNodes(q, idVals(batch)...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, n := range ns {
+			nodesByID[n.ID] = n
+		}
+	}
+
+	var ns []*Node
+	for _, id := range ids {
+		n := nodesByID[id]
+		if n != nil {
+			ns = append(ns, n)
+		}
+	}
+
+	err := st.loadNodesTags(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	err = st.loadNodesFields(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	return ns, nil
+}
+
+// Run node select query, without loading tags.
+func (st *Store) queryNodes(q string, vals ...interface{}) ([]*Node, error) {
+	rows, err := st.conn().Query(q, vals...)
 	if err != nil {
 		return nil, errSql(q, err)
 	}
@@ -110,16 +229,78 @@ func (st *Store) LoadNodes(qwhere, qorderby, qlimit string, vals ...interface{})
 			return nil, errSql(q, err)
 		}
 
-		tags, err := st.LoadNodeTags(n.ID)
+		ns = append(ns, &n)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+
+	return ns, nil
+}
+
+// Max number of IDs in a single 'IN (...)' query.
+// Keeps within sqlite's default limit of 999 query parameters.
+const _idBatchSize = 500
+
+func idBatches(ids []string) [][]string {
+	var batches [][]string
+	for len(ids) > _idBatchSize {
+		batches = append(batches, ids[:_idBatchSize])
+		ids = ids[_idBatchSize:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+func idVals(ids []string) []interface{} {
+	vals := make([]interface{}, len(ids))
+	for i, id := range ids {
+		vals[i] = id
+	}
+	return vals
+}
+
+// Load tags of nodes ns, with one query per batch of node IDs.
+func (st *Store) loadNodesTags(ns []*Node) error {
+	var ids []string
+	nodesByID := map[string]*Node{}
+	for _, n := range ns {
+		n.Tags = nil
+		ids = append(ids, n.ID)
+		nodesByID[n.ID] = n
+	}
+
+	for _, batch := range idBatches(ids) {
+		q := fmt.Sprintf("SELECT id, tag FROM nodetag WHERE id IN (%s) ORDER BY id, tag", st.sqlParams(len(batch)))
+		rows, err := st.conn().Query(q, idVals(batch)...)
 		if err != nil {
-			return nil, errSql(q, err)
+			return errSql(q, err)
 		}
-		n.Tags = tags
 
-		ns = append(ns, &n)
+		for rows.Next() {
+			var id, tag string
+			err := rows.Scan(&id, &tag)
+			if err != nil {
+				rows.Close()
+				return errSql(q, err)
+			}
+
+			n := nodesByID[id]
+			if n != nil {
+				n.Tags = append(n.Tags, tag)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return errSql(q, err)
+		}
 	}
 
-	return ns, nil
+	return nil
 }
 
 func (st *Store) insertNode(n *Node) (*Node, error) {
@@ -131,6 +312,8 @@ func (st *Store) insertNode(n *Node) (*Node, error) {
 	}
 
 	nowIsoStr := isotimestr(time.Now())
+	n.Createdt = nowIsoStr
+	n.Updatedt = nowIsoStr
 
 	if isSqlite(st) {
 		q = "INSERT INTO node (id, hash, alias, title, assigned, body, createdt, updatedt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
@@ -145,37 +328,86 @@ func (st *Store) insertNode(n *Node) (*Node, error) {
 	return n, nil
 }
 
-func (st *Store) updateNode(n *Node) (*Node, error) {
-	var q string
+// Update stored node n. If ifHash isn't blank, the node is only updated if
+// its stored hash is ifHash.
+// Returns false if no node was updated.
+func (st *Store) updateNode(n *Node, ifHash string) (bool, error) {
 	var eb ErrorBag
 
 	nowIsoStr := isotimestr(time.Now())
+	n.Updatedt = nowIsoStr
 
-	if isSqlite(st) {
-		q = "UPDATE node SET hash = ?, alias = ?, title = ?, assigned = ?, body = ?, updatedt = ? WHERE id = ?"
-	} else {
-		q = "UPDATE node SET hash = $1, alias = $2, title = $3, assigned = $4, body = $5,  updatedt = $6 WHERE id = $7"
+	q := fmt.Sprintf("UPDATE node SET hash = %s, alias = %s, title = %s, assigned = %s, body = %s, updatedt = %s WHERE id = %s",
+		st.sqlParam(1), st.sqlParam(2), st.sqlParam(3), st.sqlParam(4), st.sqlParam(5), st.sqlParam(6), st.sqlParam(7))
+	vals := []interface{}{n.HashString(), n.Alias, n.Title, n.Assigned, n.Body, nowIsoStr, n.ID}
+	if ifHash != "" {
+		q += fmt.Sprintf(" AND hash = %s", st.sqlParam(8))
+		vals = append(vals, ifHash)
 	}
-	st.execSql(q, &eb, n.HashString(), n.Alias, n.Title, n.Assigned, n.Body, nowIsoStr, n.ID)
+	count := st.execSqlCount(q, &eb, vals...)
 
 	if eb.HasErrors() {
-		return nil, eb
+		return false, eb
 	}
-	return n, nil
+	return count > 0, nil
 }
 
+// Save node contents, tags, custom fields and revision in a single
+// transaction.
 func (st *Store) SaveNode(n *Node) (*Node, error) {
 	if st.DB() == nil {
 		return nil, dbnilErr()
 	}
 
+	var savedn *Node
+	err := st.WithTx(func(tx *Store) error {
+		var err error
+		savedn, err = tx.saveNode(n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return savedn, nil
+}
+
+// Save existing node n like SaveNode(), if its stored hash is hash.
+// The hash is checked by the update itself, so a node changed by a
+// concurrent save is never overwritten.
+// Returns ErrNodeChanged if the node's hash isn't hash, or the node
+// doesn't exist.
+func (st *Store) SaveNodeIfHash(n *Node, hash string) (*Node, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	err := st.WithTx(func(tx *Store) error {
+		ok, err := tx.updateNode(n, hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNodeChanged
+		}
+		return tx.saveNodeData(n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (st *Store) saveNode(n *Node) (*Node, error) {
 	var err error
 
 	// Insert new node if blank or nonexisting ID, otherwise Update
 	if n.ID == "" {
 		n, err = st.insertNode(n)
 	} else {
-		exists, err := st.ExistsNodeID(n.ID)
+		var exists bool
+		exists, err = st.ExistsNodeID(n.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -183,19 +415,29 @@ func (st *Store) SaveNode(n *Node) (*Node, error) {
 		if !exists {
 			n, err = st.insertNode(n)
 		} else {
-			n, err = st.updateNode(n)
+			_, err = st.updateNode(n, "")
 		}
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	err = st.saveNodeData(n)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Save tags, custom fields and revision of node n, whose node row was
+// just written.
+func (st *Store) saveNodeData(n *Node) error {
 	// Mark node as changed.
 	// Helper processes can use this to find which nodes were
 	// updated and rebuild search indexes, related nodes, etc.
-	err = st.MarkNodeChanged(n.ID)
+	err := st.MarkNodeChanged(n.ID)
 	if err != nil {
-		return n, err
+		return err
 	}
 
 	// Clear tags first, then add tags one by one,
@@ -203,16 +445,23 @@ func (st *Store) SaveNode(n *Node) (*Node, error) {
 	// $$ A better way to do this?
 	err = st.DeleteNodeTagAll(n.ID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	for _, tag := range n.Tags {
 		err = st.SaveNodeTag(n.ID, tag)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return n, nil
+	err = st.saveNodeFields(n)
+	if err != nil {
+		return err
+	}
+
+	// Keep an immutable copy of what was saved so that
+	// earlier node contents can be listed and restored.
+	return st.saveNodeRev(n)
 }
 
 func (st *Store) ExistsTableRow(table, col, val string) (bool, error) {
@@ -222,7 +471,7 @@ func (st *Store) ExistsTableRow(table, col, val string) (bool, error) {
 	} else {
 		q = fmt.Sprintf("SELECT %s FROM %s where %s = $1", col, table, col)
 	}
-	row := st.DB().QueryRow(q, val)
+	row := st.conn().QueryRow(q, val)
 
 	var destval interface{}
 	err := row.Scan(&destval)
@@ -280,6 +529,23 @@ func (st *Store) ClearNodeChanged(id string) error {
 	return nil
 }
 
+func (st *Store) ClearNodesChanged(ids []string) error {
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	var eb ErrorBag
+	for _, batch := range idBatches(ids) {
+		q := fmt.Sprintf("DELETE FROM nodechange WHERE id IN (%s)", st.sqlParams(len(batch)))
+		st.execSql(q, &eb, idVals(batch)...)
+	}
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
 func (st *Store) ClearAllNodeChanged() error {
 	if st.DB() == nil {
 		return dbnilErr()
@@ -301,7 +567,7 @@ func (st *Store) QueryChangedNodes() ([]string, error) {
 	}
 
 	q := "SELECT id FROM nodechange"
-	rows, err := st.DB().Query(q)
+	rows, err := st.conn().Query(q)
 	if err != nil {
 		return nil, errSql(q, err)
 	}
@@ -332,7 +598,7 @@ func (st *Store) LoadNodeTags(id string) ([]string, error) {
 	} else {
 		q = "SELECT tag FROM nodetag WHERE id = $1 ORDER BY tag"
 	}
-	rows, err := st.DB().Query(q, id)
+	rows, err := st.conn().Query(q, id)
 	if err != nil {
 		return nil, errSql(q, err)
 	}
@@ -352,6 +618,37 @@ func (st *Store) LoadNodeTags(id string) ([]string, error) {
 	return tags, nil
 }
 
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// Load all tags in use, with number of nodes having each tag.
+func (st *Store) LoadTagCounts() ([]*TagCount, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	q := "SELECT tag, COUNT(*) FROM nodetag GROUP BY tag ORDER BY tag"
+	rows, err := st.conn().Query(q)
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+	defer rows.Close()
+
+	var tcs []*TagCount
+	for rows.Next() {
+		var tc TagCount
+		err := rows.Scan(&tc.Tag, &tc.Count)
+		if err != nil {
+			return nil, errSql(q, err)
+		}
+		tcs = append(tcs, &tc)
+	}
+
+	return tcs, nil
+}
+
 func (st *Store) SaveNodeTag(id, tag string) error {
 	exists, err := st.ExistsNodeID(id)
 	if err != nil {
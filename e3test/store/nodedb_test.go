@@ -0,0 +1,372 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Create sqlite store in a temp dir, without tables.
+func tempStore(tb testing.TB) *Store {
+	dir, err := ioutil.TempDir("", "e3bench")
+	if err != nil {
+		tb.Fatalf("error creating temp dir (%s)", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	logger := log.New(ioutil.Discard, "", 0)
+	st := NewStore("sqlite3", filepath.Join(dir, "bench.db"), filepath.Join(dir, "index"), logger)
+	tb.Cleanup(func() { st.Close() })
+	return st
+}
+
+// Create sqlite store in a temp dir, with nnodes generated nodes
+// having 3 tags each.
+// Returns store and list of node IDs.
+func genStore(tb testing.TB, nnodes int) (*Store, []string) {
+	st := tempStore(tb)
+	err := st.InitTables()
+	if err != nil {
+		tb.Fatalf("error creating tables (%s)", err)
+	}
+
+	var ids []string
+	err = st.WithTx(func(tx *Store) error {
+		for i := 0; i < nnodes; i++ {
+			n := &Node{
+				Alias: fmt.Sprintf("node%d", i),
+				Title: fmt.Sprintf("Node %d title", i),
+				Body:  fmt.Sprintf("Body of node %d.\nSecond line.\n", i),
+				Tags:  []string{"bench", fmt.Sprintf("group%d", i%10), fmt.Sprintf("tag%d", i)},
+			}
+			n, err := tx.SaveNode(n)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, n.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatalf("error generating nodes (%s)", err)
+	}
+
+	return st, ids
+}
+
+// Check ns are the generated nodes ids, in the same order, with their tags.
+func checkGenNodes(t *testing.T, ns []*Node, ids []string, genIndex map[string]int) {
+	t.Helper()
+
+	if len(ns) != len(ids) {
+		t.Fatalf("expected %d nodes, loaded %d", len(ids), len(ns))
+	}
+	for j, n := range ns {
+		if n.ID != ids[j] {
+			t.Fatalf("node %d: expected ID %s, got %s", j, ids[j], n.ID)
+		}
+
+		i := genIndex[n.ID]
+		wantTags := []string{"bench", fmt.Sprintf("group%d", i%10), fmt.Sprintf("tag%d", i)}
+		tags := append([]string{}, n.Tags...)
+		sort.Strings(wantTags)
+		sort.Strings(tags)
+		if strings.Join(tags, ",") != strings.Join(wantTags, ",") {
+			t.Fatalf("node %s: expected tags %v, got %v", n.ID, wantTags, n.Tags)
+		}
+	}
+}
+
+func genIndexes(ids []string) map[string]int {
+	genIndex := map[string]int{}
+	for i, id := range ids {
+		genIndex[id] = i
+	}
+	return genIndex
+}
+
+func TestLoadNodesByIDs(t *testing.T) {
+	st, ids := genStore(t, 20)
+	genIndex := genIndexes(ids)
+
+	tests := []struct {
+		name string
+		ids  []string
+		want []string
+	}{
+		{"stored order", ids, ids},
+		{"reversed", reversed(ids), reversed(ids)},
+		{"some", []string{ids[7], ids[2], ids[19]}, []string{ids[7], ids[2], ids[19]}},
+		{"missing IDs skipped", []string{"nosuchid", ids[3], "", ids[1]}, []string{ids[3], ids[1]}},
+		{"none", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, err := st.LoadNodesByIDs(tt.ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGenNodes(t, ns, tt.want, genIndex)
+		})
+	}
+}
+
+// More IDs than fit in one query are loaded in batches, still in the
+// requested order.
+func TestLoadNodesByIDsBatches(t *testing.T) {
+	nnodes := 2*_idBatchSize + 200
+	st, ids := genStore(t, nnodes)
+	genIndex := genIndexes(ids)
+
+	// Interleave nodes from every batch.
+	var mixed []string
+	for i := 0; i < 3; i++ {
+		for j := i; j < nnodes; j += 3 {
+			mixed = append(mixed, ids[j])
+		}
+	}
+
+	for _, want := range [][]string{ids, reversed(ids), mixed} {
+		ns, err := st.LoadNodesByIDs(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGenNodes(t, ns, want, genIndex)
+	}
+}
+
+func TestIdBatches(t *testing.T) {
+	tests := []struct {
+		nids  int
+		sizes []int
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{_idBatchSize, []int{_idBatchSize}},
+		{_idBatchSize + 1, []int{_idBatchSize, 1}},
+		{2*_idBatchSize + 200, []int{_idBatchSize, _idBatchSize, 200}},
+	}
+
+	for _, tt := range tests {
+		ids := make([]string, tt.nids)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("id%d", i)
+		}
+
+		var sizes []int
+		var joined []string
+		for _, batch := range idBatches(ids) {
+			sizes = append(sizes, len(batch))
+			joined = append(joined, batch...)
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(tt.sizes) {
+			t.Errorf("%d ids: batch sizes %v, want %v", tt.nids, sizes, tt.sizes)
+		}
+		if strings.Join(joined, ",") != strings.Join(ids, ",") {
+			t.Errorf("%d ids: batches don't add up to ids", tt.nids)
+		}
+	}
+}
+
+func reversed(ids []string) []string {
+	var rev []string
+	for i := len(ids) - 1; i >= 0; i-- {
+		rev = append(rev, ids[i])
+	}
+	return rev
+}
+
+func benchLoadNodes(b *testing.B, nnodes int) {
+	st, _ := genStore(b, nnodes)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ns, err := st.LoadNodes("id <> ''", "id desc", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ns) != nnodes {
+			b.Fatalf("expected %d nodes, loaded %d", nnodes, len(ns))
+		}
+	}
+}
+
+func BenchmarkLoadNodes100(b *testing.B)  { benchLoadNodes(b, 100) }
+func BenchmarkLoadNodes1000(b *testing.B) { benchLoadNodes(b, 1000) }
+func BenchmarkLoadNodes5000(b *testing.B) { benchLoadNodes(b, 5000) }
+
+// Previous way of loading search results, one LoadNodeByID() per hit.
+func benchLoadNodeByIDEach(b *testing.B, nnodes int) {
+	st, ids := genStore(b, nnodes)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			n, err := st.LoadNodeByID(id)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n == nil {
+				b.Fatalf("node %s not found", id)
+			}
+		}
+	}
+}
+
+func BenchmarkLoadNodeByIDEach100(b *testing.B)  { benchLoadNodeByIDEach(b, 100) }
+func BenchmarkLoadNodeByIDEach1000(b *testing.B) { benchLoadNodeByIDEach(b, 1000) }
+
+func benchLoadNodesByIDs(b *testing.B, nnodes int) {
+	st, ids := genStore(b, nnodes)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ns, err := st.LoadNodesByIDs(ids)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ns) != nnodes {
+			b.Fatalf("expected %d nodes, loaded %d", nnodes, len(ns))
+		}
+	}
+}
+
+func BenchmarkLoadNodesByIDs100(b *testing.B)  { benchLoadNodesByIDs(b, 100) }
+func BenchmarkLoadNodesByIDs1000(b *testing.B) { benchLoadNodesByIDs(b, 1000) }
+
+// Saves conditional on the node's hash fail once the node has changed.
+func TestSaveNodeIfHash(t *testing.T) {
+	st, ids := genStore(t, 1)
+
+	a, err := st.LoadNodeByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := st.LoadNodeByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	basehash := a.Hash
+
+	a.Title = "Changed by a"
+	_, err = st.SaveNodeIfHash(a, basehash)
+	if err != nil {
+		t.Fatalf("first save from base failed (%s)", err)
+	}
+
+	b.Title = "Changed by b"
+	b.Tags = []string{"b"}
+	_, err = st.SaveNodeIfHash(b, basehash)
+	if !errors.Is(err, ErrNodeChanged) {
+		t.Fatalf("second save from base: %v, want ErrNodeChanged", err)
+	}
+
+	// The failed save leaves no trace.
+	n, err := st.LoadNodeByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Title != "Changed by a" || n.ExistsTag("b") {
+		t.Errorf("node after failed save %+v", n)
+	}
+	nrs, err := st.LoadNodeRevs(ids[0])
+	if err != nil || len(nrs) != 2 {
+		t.Errorf("%d revisions (%v), want 2", len(nrs), err)
+	}
+
+	_, err = st.SaveNodeIfHash(&Node{ID: "nosuchid", Title: "x"}, "h")
+	if !errors.Is(err, ErrNodeChanged) {
+		t.Errorf("save of missing node: %v, want ErrNodeChanged", err)
+	}
+}
+
+// Of concurrent saves from the same base, at most one is saved.
+func TestSaveNodeIfHashConcurrent(t *testing.T) {
+	st, ids := genStore(t, 1)
+	n, err := st.LoadNodeByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	basehash := n.Hash
+
+	const nsaves = 8
+	errs := make(chan error, nsaves)
+	for i := 0; i < nsaves; i++ {
+		go func(i int) {
+			n := &Node{ID: ids[0], Title: fmt.Sprintf("Save %d", i), Createdt: n.Createdt}
+			_, err := st.SaveNodeIfHash(n, basehash)
+			errs <- err
+		}(i)
+	}
+
+	nsaved := 0
+	for i := 0; i < nsaves; i++ {
+		if err := <-errs; err == nil {
+			nsaved++
+		}
+	}
+	if nsaved > 1 {
+		t.Errorf("%d saves from the same base, want at most 1", nsaved)
+	}
+
+	nrs, err := st.LoadNodeRevs(ids[0])
+	if err != nil || len(nrs) != 1+nsaved {
+		t.Errorf("%d revisions (%v), want %d", len(nrs), err, 1+nsaved)
+	}
+}
+
+func TestNodeRevsAndFields(t *testing.T) {
+	st, _ := genStore(t, 0)
+
+	n := &Node{Title: "v1", Tags: []string{"a"}}
+	n.SetCustomField("priority", "high")
+	n, err := st.SaveNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.Title = "v2"
+	n.Tags = []string{"b"}
+	n.SetCustomField("priority", "")
+	n.SetCustomField("due", "2024-06-01")
+	_, err = st.SaveNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := st.LoadNodeByID(n.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Title != "v2" || strings.Join(loaded.Tags, ",") != "b" || len(loaded.Fields) != 1 || loaded.Fields["due"] != "2024-06-01" {
+		t.Errorf("loaded %+v", loaded)
+	}
+
+	nrs, err := st.LoadNodeRevs(n.ID)
+	if err != nil || len(nrs) != 2 {
+		t.Fatalf("%d revisions (%v), want 2", len(nrs), err)
+	}
+	r1, r2 := nrs[0].Node, nrs[1].Node
+	if nrs[0].Rev != 1 || r1.Title != "v1" || strings.Join(r1.Tags, ",") != "a" || r1.Fields["priority"] != "high" {
+		t.Errorf("revision 1 %+v", r1)
+	}
+	if nrs[1].Rev != 2 || r2.Title != "v2" || r2.Hash != loaded.Hash || r2.Fields["priority"] != "" {
+		t.Errorf("revision 2 %+v", r2)
+	}
+
+	nr, err := st.LoadNodeRev(n.ID, 1)
+	if err != nil || nr == nil || nr.Node.Title != "v1" {
+		t.Errorf("LoadNodeRev 1: %v (%v)", nr, err)
+	}
+	nr, err = st.LoadNodeRev(n.ID, 3)
+	if err != nil || nr != nil {
+		t.Errorf("LoadNodeRev 3: %v (%v), want nil", nr, err)
+	}
+}
@@ -0,0 +1,357 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Store dump.
+// A dump is the full contents of a store as ndjson, one record per line:
+// a header record, then every node with its tags, custom fields, dates and
+// hash, the node revisions, links and trashed nodes.
+//   {"kind":"header","version":1,"schema":2,"dumpdt":"2024-06-01T10:00:00Z"}
+//   {"kind":"node","node":{"ID":"-NxE...","Title":"Fix login",...}}
+//   {"kind":"rev","rev":1,"savedt":"...","node":{...}}
+//   {"kind":"link","link":{"FromID":"...","ToID":"...","Rel":"blocks"}}
+//   {"kind":"trash","deldt":"...","node":{...}}
+//
+// Restoring a dump into an empty store recreates it exactly as it was,
+// with the original IDs, dates and hashes.
+
+// Version of the dump format.
+const DumpVersion = 1
+
+const (
+	DumpHeader = "header"
+	DumpNode   = "node"
+	DumpRev    = "rev"
+	DumpLink   = "link"
+	DumpTrash  = "trash"
+)
+
+type DumpRecord struct {
+	Kind string `json:"kind"`
+
+	// Header
+	Version int    `json:"version,omitempty"`
+	Schema  int    `json:"schema,omitempty"`
+	Dumpdt  string `json:"dumpdt,omitempty"`
+
+	// Node, revision, or trashed node
+	Node   *Node  `json:"node,omitempty"`
+	Rev    int    `json:"rev,omitempty"`
+	Savedt string `json:"savedt,omitempty"`
+	Deldt  string `json:"deldt,omitempty"`
+
+	Link *NodeLink `json:"link,omitempty"`
+}
+
+// Number of records of each kind dumped or restored.
+type DumpStats struct {
+	Nodes   int
+	Revs    int
+	Links   int
+	Trashed int
+
+	// IDs of the restored nodes.
+	NodeIDs []string
+}
+
+func (ds *DumpStats) String() string {
+	return fmt.Sprintf("%d nodes, %d revisions, %d links, %d trashed nodes", ds.Nodes, ds.Revs, ds.Links, ds.Trashed)
+}
+
+// Write dump of the store to w.
+// The store is read in a single transaction, so the dump is consistent
+// even if the store is written to meanwhile.
+func (st *Store) Dump(w io.Writer) (*DumpStats, error) {
+	var ds DumpStats
+	err := st.WithTx(func(tx *Store) error {
+		return tx.dump(w, &ds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+func (st *Store) dump(w io.Writer, ds *DumpStats) error {
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	version, err := st.DBSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	write := func(rec *DumpRecord) error {
+		err := enc.Encode(rec)
+		if err != nil {
+			return fmt.Errorf("error writing dump (%s)", err)
+		}
+		return nil
+	}
+
+	err = write(&DumpRecord{Kind: DumpHeader, Version: DumpVersion, Schema: version, Dumpdt: isotimestr(time.Now())})
+	if err != nil {
+		return err
+	}
+
+	err = st.EachNode(0, func(n *Node) error {
+		ds.Nodes++
+		return write(&DumpRecord{Kind: DumpNode, Node: n})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = st.eachNodeRev(func(nr *NodeRev) error {
+		ds.Revs++
+		return write(&DumpRecord{Kind: DumpRev, Rev: nr.Rev, Savedt: nr.Savedt, Node: nr.Node})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = st.eachNodeLink(func(l *NodeLink) error {
+		ds.Links++
+		return write(&DumpRecord{Kind: DumpLink, Link: l})
+	})
+	if err != nil {
+		return err
+	}
+
+	tns, err := st.LoadTrashedNodes()
+	if err != nil {
+		return err
+	}
+	for _, tn := range tns {
+		ds.Trashed++
+		err := write(&DumpRecord{Kind: DumpTrash, Deldt: tn.Deldt, Node: tn.Node})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Call fn for every node revision, ordered by node ID and revision.
+func (st *Store) eachNodeRev(fn func(nr *NodeRev) error) error {
+	q := "SELECT id, rev, savedt, hash, alias, title, assigned, body, tags, COALESCE(fields, '') FROM nodehist ORDER BY id, rev"
+	rows, err := st.conn().Query(q)
+	if err != nil {
+		return errSql(q, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		nr, err := scanNodeRev("", func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&id}, dest...)...)
+		})
+		if err != nil {
+			return errSql(q, err)
+		}
+		nr.Node.ID = id
+
+		err = fn(nr)
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return errSql(q, err)
+	}
+	return nil
+}
+
+// Call fn for every node link.
+func (st *Store) eachNodeLink(fn func(l *NodeLink) error) error {
+	q := "SELECT fromid, toid, rel FROM nodelink ORDER BY fromid, rel, toid"
+	rows, err := st.conn().Query(q)
+	if err != nil {
+		return errSql(q, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l NodeLink
+		err := rows.Scan(&l.FromID, &l.ToID, &l.Rel)
+		if err != nil {
+			return errSql(q, err)
+		}
+
+		err = fn(&l)
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return errSql(q, err)
+	}
+	return nil
+}
+
+// Restore dump read from r into the store, which must be empty.
+// Nodes keep their IDs, dates and hashes, and are marked changed to be
+// indexed. The dump is restored in a single transaction, if any record
+// fails nothing is restored.
+func (st *Store) RestoreDump(r io.Reader) (*DumpStats, error) {
+	var ds DumpStats
+	err := st.WithTx(func(tx *Store) error {
+		return tx.restoreDump(r, &ds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+func (st *Store) restoreDump(r io.Reader, ds *DumpStats) error {
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	for _, table := range []string{"node", "nodehist", "nodelink", "nodetrash"} {
+		n, err := st.countRows(table)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("store isn't empty, %s table has %d rows", table, n)
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	for i := 1; ; i++ {
+		var rec DumpRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			if i == 1 {
+				return fmt.Errorf("empty dump")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("dump record %d: error reading (%s)", i, err)
+		}
+
+		if i == 1 && rec.Kind != DumpHeader {
+			return fmt.Errorf("dump record 1: expected header, got '%s'", rec.Kind)
+		}
+
+		err = st.restoreDumpRecord(&rec, ds)
+		if err != nil {
+			return fmt.Errorf("dump record %d: %s", i, err)
+		}
+	}
+}
+
+func (st *Store) restoreDumpRecord(rec *DumpRecord, ds *DumpStats) error {
+	switch rec.Kind {
+	case DumpNode, DumpRev, DumpTrash:
+		if rec.Node == nil || rec.Node.ID == "" {
+			return fmt.Errorf("%s without node ID", rec.Kind)
+		}
+		if rec.Node.Hash == "" {
+			rec.Node.Hash = rec.Node.HashString()
+		}
+	}
+
+	var eb ErrorBag
+	var q string
+
+	switch rec.Kind {
+	case DumpHeader:
+		if rec.Version != DumpVersion {
+			return fmt.Errorf("unsupported dump version %d, expected %d", rec.Version, DumpVersion)
+		}
+		if rec.Schema > SchemaVersion() {
+			return fmt.Errorf("dump schema version %d is newer than this e3's version %d", rec.Schema, SchemaVersion())
+		}
+		return nil
+
+	case DumpNode:
+		n := rec.Node
+		q = fmt.Sprintf("INSERT INTO node (id, hash, alias, title, assigned, body, createdt, updatedt) VALUES (%s)", st.sqlParams(8))
+		st.execSql(q, &eb, n.ID, n.Hash, n.Alias, n.Title, n.Assigned, n.Body, n.Createdt, n.Updatedt)
+		if eb.HasErrors() {
+			return eb
+		}
+
+		for _, tag := range n.Tags {
+			err := st.SaveNodeTag(n.ID, tag)
+			if err != nil {
+				return err
+			}
+		}
+		err := st.saveNodeFields(n)
+		if err != nil {
+			return err
+		}
+
+		err = st.MarkNodeChanged(n.ID)
+		if err != nil {
+			return err
+		}
+		ds.Nodes++
+		ds.NodeIDs = append(ds.NodeIDs, n.ID)
+
+	case DumpRev:
+		n := rec.Node
+		sfields, err := encodeFields(n.Fields)
+		if err != nil {
+			return err
+		}
+		q = fmt.Sprintf("INSERT INTO nodehist (id, rev, hash, alias, title, assigned, body, tags, savedt, fields) VALUES (%s)", st.sqlParams(10))
+		st.execSql(q, &eb, n.ID, rec.Rev, n.Hash, n.Alias, n.Title, n.Assigned, n.Body, strings.Join(n.Tags, _tagSep), rec.Savedt, sfields)
+		ds.Revs++
+
+	case DumpLink:
+		l := rec.Link
+		if l == nil || l.FromID == "" || l.ToID == "" {
+			return fmt.Errorf("link without node IDs")
+		}
+		// Links to trashed nodes are kept, so the nodes needn't exist.
+		q = fmt.Sprintf("INSERT INTO nodelink (fromid, toid, rel) VALUES (%s)", st.sqlParams(3))
+		st.execSql(q, &eb, l.FromID, l.ToID, l.Rel)
+		ds.Links++
+
+	case DumpTrash:
+		n := rec.Node
+		sfields, err := encodeFields(n.Fields)
+		if err != nil {
+			return err
+		}
+		q = fmt.Sprintf("INSERT INTO nodetrash (%s) VALUES (%s)", _trashCols, st.sqlParams(11))
+		st.execSql(q, &eb, n.ID, n.Hash, n.Alias, n.Title, n.Assigned, n.Body, strings.Join(n.Tags, _tagSep), n.Createdt, n.Updatedt, rec.Deldt, sfields)
+		ds.Trashed++
+
+	default:
+		return fmt.Errorf("unknown record kind '%s'", rec.Kind)
+	}
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
+// Return number of rows in table.
+func (st *Store) countRows(table string) (int, error) {
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+	var n int
+	err := st.conn().QueryRow(q).Scan(&n)
+	if err != nil {
+		return 0, errSql(q, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return dump of st without its header, which has the dump time.
+func dumpBody(t *testing.T, st *Store) (string, *DumpStats) {
+	t.Helper()
+
+	var b bytes.Buffer
+	ds, err := st.Dump(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := b.String()
+	i := strings.Index(s, "\n")
+	var rec DumpRecord
+	err = json.Unmarshal([]byte(s[:i]), &rec)
+	if err != nil || rec.Kind != DumpHeader || rec.Version != DumpVersion || rec.Schema != SchemaVersion() {
+		t.Fatalf("dump header %s (%v)", s[:i], err)
+	}
+	return s[i+1:], ds
+}
+
+func TestDumpRestore(t *testing.T) {
+	st, ids := genStore(t, 5)
+
+	// Revisions, custom fields, links and trashed nodes.
+	n, err := st.LoadNodeByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Title = "Node 0, second revision"
+	n.SetCustomField("priority", "high")
+	_, err = st.SaveNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []*NodeLink{{ids[0], ids[1], "blocks"}, {ids[2], ids[0], "parent"}, {ids[3], ids[4], "ref"}} {
+		err = st.AddNodeLink(l.FromID, l.ToID, l.Rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = st.TrashNode(ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dump, ds := dumpBody(t, st)
+	want := DumpStats{Nodes: 4, Revs: 6, Links: 3, Trashed: 1}
+	if ds.Nodes != want.Nodes || ds.Revs != want.Revs || ds.Links != want.Links || ds.Trashed != want.Trashed {
+		t.Errorf("dumped %s, want %s", ds, &want)
+	}
+
+	st2, _ := genStore(t, 0)
+	rs, err := st2.RestoreDump(strings.NewReader(dump))
+	if err == nil {
+		t.Fatal("restored dump without header")
+	}
+
+	var b bytes.Buffer
+	_, err = st.Dump(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err = st2.RestoreDump(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.String() != ds.String() || len(rs.NodeIDs) != ds.Nodes {
+		t.Errorf("restored %s, %d node IDs, dumped %s", rs, len(rs.NodeIDs), ds)
+	}
+
+	dump2, _ := dumpBody(t, st2)
+	if dump2 != dump {
+		t.Errorf("dump of restored store differs:\n%s\nwant:\n%s", dump2, dump)
+	}
+
+	n2, err := st2.LoadNodeByID(ids[0])
+	if err != nil || n2 == nil {
+		t.Fatalf("restored node %s: %v, %v", ids[0], n2, err)
+	}
+	if n2.Hash != n.HashString() || n2.Fields["priority"] != "high" || n2.Createdt != n.Createdt {
+		t.Errorf("restored node %+v, saved %+v", n2, n)
+	}
+
+	// Restored nodes are updated as any other.
+	n2.Body = "Changed after restore.\n"
+	_, err = st2.SaveNodeIfHash(n2, n2.Hash)
+	if err != nil {
+		t.Errorf("error updating restored node (%s)", err)
+	}
+	nrs, err := st2.LoadNodeRevs(ids[0])
+	if err != nil || len(nrs) != 3 {
+		t.Errorf("restored node has %d revisions after update, want 3 (%v)", len(nrs), err)
+	}
+	ok, err := st2.RestoreTrashedNode(ids[4])
+	if err != nil || !ok {
+		t.Errorf("error restoring trashed node from dump (%v)", err)
+	}
+
+	// Only empty stores are restored into.
+	_, err = st2.RestoreDump(strings.NewReader(`{"kind":"header","version":1}`))
+	if err == nil || !strings.Contains(err.Error(), "isn't empty") {
+		t.Errorf("restoring into non-empty store: %v", err)
+	}
+}
+
+func TestRestoreDumpErrors(t *testing.T) {
+	header := `{"kind":"header","version":1,"schema":2}` + "\n"
+	dt := isotimestr(time.Now())
+
+	tests := []struct {
+		name string
+		dump string
+	}{
+		{"empty", ""},
+		{"not json", "header\n"},
+		{"no header", `{"kind":"node","node":{"ID":"1"}}` + "\n"},
+		{"dump version", `{"kind":"header","version":99}` + "\n"},
+		{"newer schema", `{"kind":"header","version":1,"schema":99}` + "\n"},
+		{"unknown kind", header + `{"kind":"stuff"}` + "\n"},
+		{"node without ID", header + `{"kind":"node","node":{"Title":"x"}}` + "\n"},
+		{"link without IDs", header + `{"kind":"link","link":{"Rel":"blocks"}}` + "\n"},
+		{"duplicate node", header +
+			`{"kind":"node","node":{"ID":"1","Createdt":"` + dt + `"}}` + "\n" +
+			`{"kind":"node","node":{"ID":"1","Createdt":"` + dt + `"}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		st, _ := genStore(t, 0)
+		_, err := st.RestoreDump(strings.NewReader(tt.dump))
+		if err == nil {
+			t.Errorf("%s: restored", tt.name)
+			continue
+		}
+
+		// Nothing is restored from a failed dump.
+		n, err := st.countRows("node")
+		if err != nil || n != 0 {
+			t.Errorf("%s: %d nodes restored (%v)", tt.name, n, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Custom node fields.
+// Besides its fixed fields, a node may have any number of custom fields,
+// user defined name/value attributes, Ex. priority, due.
+// They're stored in the nodefield table, and carried in recj and json
+// keyed by name:
+//   title: Fix login
+//   priority: high
+//
+// Where a name could be either a node field or a custom field, as in field
+// predicates, -cols and map operations, custom field names are prefixed
+// with '.':
+//   find -.priority=high
+//   map -.due=2024-06-01
+//   table -cols=id,title,.priority
+//
+// Setting a custom field to "" removes it.
+
+const CustomFieldPrefix = "."
+
+var _customFieldRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Recj keys of the fixed node fields, which custom fields can't be named.
+var _recjKeys = map[string]bool{
+	"id":       true,
+	"hash":     true,
+	"alias":    true,
+	"title":    true,
+	"assigned": true,
+	"body":     true,
+	"tags":     true,
+	"createdt": true,
+	"updatedt": true,
+	"basehash": true,
+}
+
+// Return true if name is a valid custom field name, without the '.'
+// prefix.
+func ValidCustomFieldName(name string) bool {
+	return _customFieldRe.MatchString(name) && !_recjKeys[name]
+}
+
+// Return true if k is a node recj key, a fixed field or custom field name.
+func ValidRecjKey(k string) bool {
+	return _recjKeys[k] || ValidCustomFieldName(k)
+}
+
+// Return custom field name of field, Ex. ".priority" => "priority",
+// or "" if field isn't a custom field.
+func customFieldName(field string) string {
+	if !strings.HasPrefix(field, CustomFieldPrefix) {
+		return ""
+	}
+	name := strings.TrimPrefix(field, CustomFieldPrefix)
+	if !ValidCustomFieldName(name) {
+		return ""
+	}
+	return name
+}
+
+// Return true if field is a '.' prefixed custom field.
+func IsCustomField(field string) bool {
+	return customFieldName(field) != ""
+}
+
+// Set custom field name to v, or remove it if v is "".
+func (n *Node) SetCustomField(name, v string) {
+	if v == "" {
+		delete(n.Fields, name)
+		return
+	}
+	if n.Fields == nil {
+		n.Fields = map[string]string{}
+	}
+	n.Fields[name] = v
+}
+
+// Return names of custom fields, sorted.
+func (n *Node) CustomFieldNames() []string {
+	var names []string
+	for name := range n.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Custom fields as text, for revision and trash table columns.
+func encodeFields(fields map[string]string) (string, error) {
+	if len(fields) == 0 {
+		return "", nil
+	}
+	bs, err := json.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf("error encoding custom fields (%s)", err)
+	}
+	return string(bs), nil
+}
+
+func decodeFields(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var fields map[string]string
+	err := json.Unmarshal([]byte(s), &fields)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding custom fields (%s)", err)
+	}
+	return fields, nil
+}
+
+// Load custom fields of nodes ns.
+func (st *Store) loadNodesFields(ns []*Node) error {
+	if len(ns) == 0 {
+		return nil
+	}
+
+	var ids []string
+	nodesByID := map[string]*Node{}
+	for _, n := range ns {
+		ids = append(ids, n.ID)
+		nodesByID[n.ID] = n
+	}
+
+	for _, batch := range idBatches(ids) {
+		q := fmt.Sprintf("SELECT id, name, val FROM nodefield WHERE id IN (%s)", st.sqlParams(len(batch)))
+		rows, err := st.conn().Query(q, idVals(batch)...)
+		if err != nil {
+			return errSql(q, err)
+		}
+
+		for rows.Next() {
+			var id, name, val string
+			err := rows.Scan(&id, &name, &val)
+			if err != nil {
+				rows.Close()
+				return errSql(q, err)
+			}
+
+			n := nodesByID[id]
+			if n != nil {
+				n.SetCustomField(name, val)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return errSql(q, err)
+		}
+	}
+
+	return nil
+}
+
+// Replace stored custom fields of node n with n.Fields.
+func (st *Store) saveNodeFields(n *Node) error {
+	err := st.deleteNodeFields(n.ID)
+	if err != nil {
+		return err
+	}
+
+	var eb ErrorBag
+	q := fmt.Sprintf("INSERT INTO nodefield (id, name, val) VALUES (%s)", st.sqlParams(3))
+	for _, name := range n.CustomFieldNames() {
+		st.execSql(q, &eb, n.ID, name, n.Fields[name])
+	}
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
+func (st *Store) deleteNodeFields(id string) error {
+	var eb ErrorBag
+	q := fmt.Sprintf("DELETE FROM nodefield WHERE id = %s", st.sqlParam(1))
+	st.execSql(q, &eb, id)
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Field predicate used to select nodes.
+//
+// Predicates are given as named args in the form -{field}{op}{val}:
+// -assigned=rob              Field: assigned, Op: =,  Val: rob
+// -tags=urgent,bug           Field: tags,     Op: =,  Val: urgent,bug
+// -updated>=2024-01-01       Field: updatedt, Op: >=, Val: 2024-01-01
+// -createdt<2024-01-01       Field: createdt, Op: <,  Val: 2024-01-01
+// -title~=^Bug               Field: title,    Op: ~=, Val: ^Bug
+// -alias!=                   Field: alias,    Op: !=, Val: ""
+// -.priority=high            Field: .priority, Op: =, Val: high
+//
+// Custom fields are given with the '.' prefix, a node without the field
+// has it as "".
+//
+// Tags predicates match against each of a node's tags:
+// tags=a,b   node has all of the tags a and b
+// tags!=a,b  node has none of the tags a and b
+// tags~=re   node has at least one tag matching re
+type NodeCond struct {
+	Field string
+	Op    string
+	Val   string
+	re    *regexp.Regexp
+}
+
+var _nodeCondFields = map[string]string{
+	"id":       "id",
+	"alias":    "alias",
+	"title":    "title",
+	"assigned": "assigned",
+	"body":     "body",
+	"tags":     "tags",
+	"createdt": "createdt",
+	"created":  "createdt",
+	"updatedt": "updatedt",
+	"updated":  "updatedt",
+}
+
+// Return field name for name or its alias, Ex. "updated" => "updatedt"
+// Custom fields are returned as is, Ex. ".priority"
+func ParseNodeField(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if IsCustomField(name) {
+		return name, nil
+	}
+
+	field, ok := _nodeCondFields[name]
+	if !ok {
+		return "", fmt.Errorf("unknown node field '%s'", name)
+	}
+	return field, nil
+}
+
+// Parse a named arg key and value into a node predicate.
+// k is the narg key as parsed by the pipeline, which holds everything
+// before the first '=', so the op chars end up in the key:
+//   -updated>=2024-01-01  => k: "updated>", v: "2024-01-01"
+//   -updated>2024-01-01   => k: "updated>2024-01-01", v: ""
+func ParseNodeCond(k, v string) (*NodeCond, error) {
+	i := strings.IndexAny(k, "<>!~")
+	if i == -1 {
+		return newNodeCond(k, "=", v)
+	}
+
+	field := k[:i]
+	op := k[i : i+1]
+	rest := k[i+1:]
+
+	switch op {
+	case "<", ">":
+		// -updated>=val or -updated>val
+		if rest == "" {
+			return newNodeCond(field, op+"=", v)
+		}
+		return newNodeCond(field, op, rest)
+	case "!", "~":
+		// -alias!=val, -title~=val
+		if rest == "" {
+			return newNodeCond(field, op+"=", v)
+		}
+	}
+
+	return nil, fmt.Errorf("invalid field predicate '%s=%s'", k, v)
+}
+
+func newNodeCond(field, op, val string) (*NodeCond, error) {
+	col, err := ParseNodeField(field)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &NodeCond{
+		Field: col,
+		Op:    op,
+		Val:   val,
+	}
+
+	if op == "~=" {
+		re, err := regexp.Compile(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex '%s' (%s)", val, err)
+		}
+		c.re = re
+	}
+
+	return c, nil
+}
+
+func (c *NodeCond) String() string {
+	return fmt.Sprintf("%s%s%s", c.Field, c.Op, c.Val)
+}
+
+// Return true if node satisfies predicate.
+func (c *NodeCond) Match(n *Node) bool {
+	if c.Field == "tags" {
+		return c.matchTags(n)
+	}
+
+	v := n.FieldVal(c.Field)
+	switch c.Op {
+	case "=":
+		return v == c.Val
+	case "!=":
+		return v != c.Val
+	case "<":
+		return v < c.Val
+	case "<=":
+		return v <= c.Val
+	case ">":
+		return v > c.Val
+	case ">=":
+		return v >= c.Val
+	case "~=":
+		return c.re.MatchString(v)
+	}
+	return false
+}
+
+func (c *NodeCond) matchTags(n *Node) bool {
+	if c.Op == "~=" {
+		for _, tag := range n.Tags {
+			if c.re.MatchString(tag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tag := range splitCsvTags(c.Val) {
+		has := n.ExistsTag(tag)
+		if c.Op == "=" && !has {
+			return false
+		}
+		if c.Op == "!=" && has {
+			return false
+		}
+	}
+	return true
+}
+
+func splitCsvTags(csvTags string) []string {
+	var tags []string
+	for _, tag := range strings.Split(csvTags, _tagSep) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Return sql placeholder for the nth (1-based) query parameter.
+func (st *Store) sqlParam(i int) string {
+	if isSqlite(st) {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", i)
+}
+
+// Return comma separated sql placeholders for n query parameters.
+func (st *Store) sqlParams(n int) string {
+	var params []string
+	for i := 1; i <= n; i++ {
+		params = append(params, st.sqlParam(i))
+	}
+	return strings.Join(params, ", ")
+}
+
+// Return sql where expression and parameter values for predicate.
+// Regex predicates can't be expressed portably in sql, so they return
+// an empty expression and are applied after loading through Match().
+func (st *Store) condSql(c *NodeCond, vals []interface{}) (string, []interface{}) {
+	if c.Op == "~=" {
+		return "", vals
+	}
+
+	if c.Field == "tags" {
+		var exprs []string
+		for _, tag := range splitCsvTags(c.Val) {
+			vals = append(vals, tag)
+			not := ""
+			if c.Op == "!=" {
+				not = "NOT "
+			}
+			exprs = append(exprs, fmt.Sprintf("id %sIN (SELECT id FROM nodetag WHERE tag = %s)", not, st.sqlParam(len(vals))))
+		}
+		return strings.Join(exprs, " AND "), vals
+	}
+
+	if name := customFieldName(c.Field); name != "" {
+		vals = append(vals, name, c.Val)
+		return fmt.Sprintf("%s %s %s", customFieldSql(st.sqlParam(len(vals)-1)), sqlOp(c.Op), st.sqlParam(len(vals))), vals
+	}
+
+	vals = append(vals, c.Val)
+	return fmt.Sprintf("%s %s %s", c.Field, sqlOp(c.Op), st.sqlParam(len(vals))), vals
+}
+
+// Return sql expression for value of a node's custom field, "" if the node
+// doesn't have it.
+// qname is the field name, as a sql parameter or string literal.
+func customFieldSql(qname string) string {
+	return fmt.Sprintf("COALESCE((SELECT val FROM nodefield WHERE nodefield.id = node.id AND nodefield.name = %s), '')", qname)
+}
+
+func sqlOp(op string) string {
+	if op == "!=" {
+		return "<>"
+	}
+	return op
+}
+
+// Validate and return sql order by expression.
+// Accepts a csv list of node fields, each optionally followed by asc or desc.
+// Ex. "updatedt desc,title"
+func ParseNodeOrderBy(s string) (string, error) {
+	var exprs []string
+
+	for _, part := range strings.Split(s, ",") {
+		toks := strings.Fields(part)
+		if len(toks) == 0 {
+			continue
+		}
+
+		col, ok := _nodeCondFields[toks[0]]
+		if name := customFieldName(toks[0]); name != "" {
+			// Valid names have no quotes, so can be given as a literal.
+			col, ok = customFieldSql("'"+name+"'"), true
+		}
+		if !ok || col == "tags" {
+			return "", fmt.Errorf("invalid orderby field '%s'", toks[0])
+		}
+
+		dir := ""
+		if len(toks) > 1 {
+			dir = strings.ToLower(toks[1])
+			if len(toks) > 2 || (dir != "asc" && dir != "desc") {
+				return "", fmt.Errorf("invalid orderby '%s'", part)
+			}
+		}
+
+		exprs = append(exprs, strings.TrimSpace(col+" "+dir))
+	}
+
+	if len(exprs) == 0 {
+		return "", fmt.Errorf("invalid orderby '%s'", s)
+	}
+	return strings.Join(exprs, ", "), nil
+}
+
+// Load nodes satisfying all predicates.
+// qorderby is a sql order by expression (see ParseNodeOrderBy()).
+// limit <= 0 returns all matching nodes, starting from offset.
+func (st *Store) FindNodes(conds []*NodeCond, qorderby string, limit, offset int) ([]*Node, error) {
+	var exprs []string
+	var vals []interface{}
+	var reConds []*NodeCond
+
+	// Sort predicates so same request produces the same sql.
+	sort.SliceStable(conds, func(i, j int) bool {
+		return conds[i].String() < conds[j].String()
+	})
+
+	for _, c := range conds {
+		var expr string
+		expr, vals = st.condSql(c, vals)
+		if expr == "" {
+			reConds = append(reConds, c)
+			continue
+		}
+		exprs = append(exprs, expr)
+	}
+
+	qwhere := "id <> ''"
+	if len(exprs) > 0 {
+		qwhere = strings.Join(exprs, " AND ")
+	}
+	if qorderby == "" {
+		qorderby = "id desc"
+	}
+
+	// Regex predicates are applied after the query, so the limit
+	// and offset can only be applied after those are filtered.
+	var qlimit string
+	if len(reConds) == 0 {
+		if limit > 0 {
+			qlimit = fmt.Sprintf("limit %d", limit)
+		}
+		if offset > 0 {
+			if limit <= 0 {
+				// sqlite requires a limit before offset
+				qlimit = "limit -1"
+				if !isSqlite(st) {
+					qlimit = "limit ALL"
+				}
+			}
+			qlimit += fmt.Sprintf(" offset %d", offset)
+		}
+	}
+
+	ns, err := st.LoadNodes(qwhere, qorderby, qlimit, vals...)
+	if err != nil {
+		return nil, err
+	}
+	if len(reConds) == 0 {
+		return ns, nil
+	}
+
+	var retns []*Node
+	for _, n := range ns {
+		if !MatchAll(reConds, n) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		retns = append(retns, n)
+		if limit > 0 && len(retns) >= limit {
+			break
+		}
+	}
+	return retns, nil
+}
+
+// Return true if node satisfies all predicates.
+func MatchAll(conds []*NodeCond, n *Node) bool {
+	for _, c := range conds {
+		if !c.Match(n) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseNodeCond(t *testing.T) {
+	tests := []struct {
+		k, v    string
+		want    string
+		wantErr bool
+	}{
+		{"assigned", "rob", "assigned=rob", false},
+		{"tags", "urgent,bug", "tags=urgent,bug", false},
+		{"updated>", "2024-01-01", "updatedt>=2024-01-01", false},
+		{"updated>2024-01-01", "", "updatedt>2024-01-01", false},
+		{"createdt<", "2024-01-01", "createdt<=2024-01-01", false},
+		{"created<2024-01-01", "", "createdt<2024-01-01", false},
+		{"alias!", "", "alias!=", false},
+		{"title~", "^Bug", "title~=^Bug", false},
+		{"tags~", "^urg", "tags~=^urg", false},
+		{".priority", "high", ".priority=high", false},
+		{".priority!", "", ".priority!=", false},
+
+		{"nosuchfield", "x", "", true},
+		{"title~", "(", "", true},
+		{"title!x", "", "", true},
+		{"title~x", "", "", true},
+		{".bad-name", "x", "", true},
+		{".title", "x", "", true},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseNodeCond(tt.k, tt.v)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseNodeCond(%q, %q) = %s, want error", tt.k, tt.v, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseNodeCond(%q, %q) error (%s)", tt.k, tt.v, err)
+			continue
+		}
+		if c.String() != tt.want {
+			t.Errorf("ParseNodeCond(%q, %q) = %s, want %s", tt.k, tt.v, c, tt.want)
+		}
+	}
+}
+
+func mustParseNodeCond(t *testing.T, k, v string) *NodeCond {
+	t.Helper()
+	c, err := ParseNodeCond(k, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCondSql(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	sqlite := NewStore("sqlite3", "", "", logger)
+	postgres := NewStore("postgres", "", "", logger)
+
+	tests := []struct {
+		k, v     string
+		nvals    int // values before the predicate's
+		sqlite   string
+		postgres string
+		vals     []string
+	}{
+		{"assigned", "rob", 0, "assigned = ?", "assigned = $1", []string{"rob"}},
+		{"alias!", "", 0, "alias <> ?", "alias <> $1", []string{""}},
+		{"updated>", "2024-01-01", 2, "updatedt >= ?", "updatedt >= $3", []string{"2024-01-01"}},
+		{"tags", "a,b", 0,
+			"id IN (SELECT id FROM nodetag WHERE tag = ?) AND id IN (SELECT id FROM nodetag WHERE tag = ?)",
+			"id IN (SELECT id FROM nodetag WHERE tag = $1) AND id IN (SELECT id FROM nodetag WHERE tag = $2)",
+			[]string{"a", "b"}},
+		{"tags!", "a", 1,
+			"id NOT IN (SELECT id FROM nodetag WHERE tag = ?)",
+			"id NOT IN (SELECT id FROM nodetag WHERE tag = $2)",
+			[]string{"a"}},
+		{".priority", "high", 0,
+			customFieldSql("?") + " = ?",
+			customFieldSql("$1") + " = $2",
+			[]string{"priority", "high"}},
+		{"title~", "^Bug", 0, "", "", nil},
+	}
+
+	for _, tt := range tests {
+		c := mustParseNodeCond(t, tt.k, tt.v)
+
+		for _, st := range []*Store{sqlite, postgres} {
+			want := tt.sqlite
+			if st == postgres {
+				want = tt.postgres
+			}
+
+			var vals []interface{}
+			for i := 0; i < tt.nvals; i++ {
+				vals = append(vals, "x")
+			}
+			expr, vals := st.condSql(c, vals)
+			if expr != want {
+				t.Errorf("%s %s: sql %q, want %q", st.Driver, c, expr, want)
+			}
+
+			var svals []string
+			for _, v := range vals[tt.nvals:] {
+				svals = append(svals, fmt.Sprint(v))
+			}
+			if strings.Join(svals, ",") != strings.Join(tt.vals, ",") || len(svals) != len(tt.vals) {
+				t.Errorf("%s %s: vals %q, want %q", st.Driver, c, svals, tt.vals)
+			}
+		}
+	}
+}
+
+func TestNodeCondMatch(t *testing.T) {
+	n := &Node{
+		ID:       "1",
+		Title:    "Bug: login fails",
+		Assigned: "rob",
+		Tags:     []string{"urgent", "bug"},
+		Updatedt: "2024-03-01T10:00:00Z",
+	}
+	n.SetCustomField("priority", "high")
+
+	tests := []struct {
+		k, v string
+		want bool
+	}{
+		{"assigned", "rob", true},
+		{"assigned", "ann", false},
+		{"assigned!", "ann", true},
+		{"alias", "", true},
+		{"title~", "^Bug", true},
+		{"title~", "^bug", false},
+		{"updated>", "2024-03-01", true},
+		{"updated<", "2024-03-01", false},
+		{"tags", "urgent", true},
+		{"tags", "urgent,bug", true},
+		{"tags", "urgent,later", false},
+		{"tags!", "later", true},
+		{"tags!", "later,bug", false},
+		{"tags~", "^urg", true},
+		{"tags~", "^lat", false},
+		{".priority", "high", true},
+		{".due", "", true},
+		{".due!", "", false},
+	}
+
+	for _, tt := range tests {
+		c := mustParseNodeCond(t, tt.k, tt.v)
+		if got := c.Match(n); got != tt.want {
+			t.Errorf("%s: match %v, want %v", c, got, tt.want)
+		}
+	}
+}
+
+func TestParseNodeOrderBy(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"updatedt desc,title", "updatedt desc, title", false},
+		{"updated ASC", "updatedt asc", false},
+		{" id , alias desc ", "id, alias desc", false},
+		{".priority desc", customFieldSql("'priority'") + " desc", false},
+
+		{"", "", true},
+		{"tags", "", true},
+		{"nosuchfield", "", true},
+		{"title sideways", "", true},
+		{"title asc desc", "", true},
+		{"title; DROP TABLE node", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNodeOrderBy(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseNodeOrderBy(%q) error %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseNodeOrderBy(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestFindNodes(t *testing.T) {
+	st, _ := genStore(t, 0)
+
+	nodes := []*Node{
+		{Alias: "a", Title: "Bug: login fails", Assigned: "rob", Tags: []string{"urgent", "bug"}},
+		{Alias: "b", Title: "Bug: logout", Assigned: "ann", Tags: []string{"bug"}},
+		{Alias: "c", Title: "Add export", Assigned: "rob", Tags: []string{"feature"}},
+		{Alias: "d", Title: "Bug: slow search", Assigned: "rob", Tags: []string{"bug", "later"}},
+	}
+	nodes[0].SetCustomField("priority", "high")
+	nodes[2].SetCustomField("priority", "low")
+	for _, n := range nodes {
+		_, err := st.SaveNode(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		conds         [][2]string
+		orderby       string
+		limit, offset int
+		want          string
+	}{
+		{nil, "alias", 0, 0, "a,b,c,d"},
+		{[][2]string{{"assigned", "rob"}}, "alias", 0, 0, "a,c,d"},
+		{[][2]string{{"tags", "bug"}, {"tags!", "later"}}, "alias", 0, 0, "a,b"},
+		{[][2]string{{".priority", "high"}}, "alias", 0, 0, "a"},
+		{[][2]string{{".priority", ""}}, "alias", 0, 0, "b,d"},
+		{[][2]string{{"title~", "^Bug"}}, "alias", 0, 0, "a,b,d"},
+		{[][2]string{{"title~", "^Bug"}, {"assigned", "rob"}}, "alias desc", 0, 0, "d,a"},
+		{nil, "alias", 2, 1, "b,c"},
+		{nil, "alias", 0, 3, "d"},
+		{[][2]string{{"title~", "^Bug"}}, "alias", 1, 1, "b"},
+		{[][2]string{{"title~", "^Bug"}}, "alias", 0, 2, "d"},
+		{nil, ".priority desc,alias", 2, 0, "c,a"},
+	}
+
+	for _, tt := range tests {
+		var conds []*NodeCond
+		for _, kv := range tt.conds {
+			conds = append(conds, mustParseNodeCond(t, kv[0], kv[1]))
+		}
+		qorderby, err := ParseNodeOrderBy(tt.orderby)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ns, err := st.FindNodes(conds, qorderby, tt.limit, tt.offset)
+		if err != nil {
+			t.Errorf("%v: %s", tt.conds, err)
+			continue
+		}
+		var aliases []string
+		for _, n := range ns {
+			aliases = append(aliases, n.Alias)
+		}
+		if got := strings.Join(aliases, ","); got != tt.want {
+			t.Errorf("%v orderby %s limit %d offset %d: found %s, want %s", tt.conds, tt.orderby, tt.limit, tt.offset, got, tt.want)
+		}
+	}
+}
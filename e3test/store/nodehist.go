@@ -0,0 +1,124 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Node revision.
+// A new revision is written to the nodehist table on every node save.
+// Revisions are numbered from 1 for each node ID and are never updated.
+type NodeRev struct {
+	Rev    int
+	Savedt string
+	Node   *Node
+}
+
+// Write node contents as the next revision of the node.
+func (st *Store) saveNodeRev(n *Node) error {
+	var q string
+	if isSqlite(st) {
+		q = "SELECT COALESCE(MAX(rev), 0) + 1 FROM nodehist WHERE id = ?"
+	} else {
+		q = "SELECT COALESCE(MAX(rev), 0) + 1 FROM nodehist WHERE id = $1"
+	}
+	row := st.conn().QueryRow(q, n.ID)
+
+	var rev int
+	err := row.Scan(&rev)
+	if err != nil {
+		return errSql(q, err)
+	}
+
+	sfields, err := encodeFields(n.Fields)
+	if err != nil {
+		return err
+	}
+
+	var eb ErrorBag
+	if isSqlite(st) {
+		q = "INSERT INTO nodehist (id, rev, hash, alias, title, assigned, body, tags, savedt, fields) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	} else {
+		q = "INSERT INTO nodehist (id, rev, hash, alias, title, assigned, body, tags, savedt, fields) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	}
+	st.execSql(q, &eb, n.ID, rev, n.HashString(), n.Alias, n.Title, n.Assigned, n.Body, strings.Join(n.Tags, _tagSep), n.Updatedt, sfields)
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
+func scanNodeRev(id string, scan func(dest ...interface{}) error) (*NodeRev, error) {
+	nr := NodeRev{Node: &Node{ID: id}}
+	n := nr.Node
+
+	var stags, sfields string
+	err := scan(&nr.Rev, &nr.Savedt, &n.Hash, &n.Alias, &n.Title, &n.Assigned, &n.Body, &stags, &sfields)
+	if err != nil {
+		return nil, err
+	}
+	n.Tags = splitCsvTags(stags)
+	n.Fields, err = decodeFields(sfields)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nr, nil
+}
+
+// Load all revisions of node ID, oldest revision first.
+func (st *Store) LoadNodeRevs(id string) ([]*NodeRev, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	var q string
+	if isSqlite(st) {
+		q = "SELECT rev, savedt, hash, alias, title, assigned, body, tags, COALESCE(fields, '') FROM nodehist WHERE id = ? ORDER BY rev"
+	} else {
+		q = "SELECT rev, savedt, hash, alias, title, assigned, body, tags, COALESCE(fields, '') FROM nodehist WHERE id = $1 ORDER BY rev"
+	}
+	rows, err := st.conn().Query(q, id)
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+	defer rows.Close()
+
+	var nrs []*NodeRev
+	for rows.Next() {
+		nr, err := scanNodeRev(id, rows.Scan)
+		if err != nil {
+			return nil, errSql(q, err)
+		}
+		nrs = append(nrs, nr)
+	}
+
+	return nrs, nil
+}
+
+// Load revision number rev of node ID.
+// Returns nil if revision doesn't exist.
+func (st *Store) LoadNodeRev(id string, rev int) (*NodeRev, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	var q string
+	if isSqlite(st) {
+		q = "SELECT rev, savedt, hash, alias, title, assigned, body, tags, COALESCE(fields, '') FROM nodehist WHERE id = ? AND rev = ?"
+	} else {
+		q = "SELECT rev, savedt, hash, alias, title, assigned, body, tags, COALESCE(fields, '') FROM nodehist WHERE id = $1 AND rev = $2"
+	}
+	row := st.conn().QueryRow(q, id, rev)
+
+	nr, err := scanNodeRev(id, row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+
+	return nr, nil
+}
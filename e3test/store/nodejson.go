@@ -0,0 +1,216 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// JSON node list formats:
+//
+// json:   a single NodeList document
+//         {"Items": [{"ID": "...", "Title": "...", ...}, ...]}
+//
+// ndjson: newline delimited json, one Node document per line
+//         {"ID": "...", "Title": "...", ...}
+//         {"ID": "...", "Title": "...", ...}
+
+func NodeListFromJSON(r io.Reader) (*NodeList, error) {
+	return ReadAllNodes(NewJSONNodeReader(r))
+}
+
+func NodeListFromNDJSON(r io.Reader) (*NodeList, error) {
+	return ReadAllNodes(NewNDJSONNodeReader(r))
+}
+
+func (nl *NodeList) WriteJSON(w io.Writer) error {
+	return WriteAllNodes(NewJSONNodeWriter(w), nl.Items)
+}
+
+func (nl *NodeList) WriteNDJSON(w io.Writer) error {
+	return WriteAllNodes(NewNDJSONNodeWriter(w), nl.Items)
+}
+
+// Reads the Items of a json NodeList document one node at a time.
+type jsonNodeReader struct {
+	dec     *json.Decoder
+	started bool
+	inItems bool
+	done    bool
+	nnodes  int
+}
+
+func NewJSONNodeReader(r io.Reader) NodeReader {
+	return &jsonNodeReader{dec: json.NewDecoder(r)}
+}
+
+func jsonDecodeErr(err error) error {
+	return fmt.Errorf("json decode error (%s)", noEOF(err))
+}
+
+func (nr *jsonNodeReader) Next() (*Node, error) {
+	if nr.done {
+		return nil, io.EOF
+	}
+
+	if !nr.started {
+		nr.started = true
+
+		t, err := nr.dec.Token()
+		if err == io.EOF {
+			// Empty input is an empty list
+			nr.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, jsonDecodeErr(err)
+		}
+		if t != json.Delim('{') {
+			return nil, fmt.Errorf("json decode error (expected NodeList object)")
+		}
+	}
+
+	for {
+		if nr.inItems {
+			if nr.dec.More() {
+				nr.nnodes++
+				var n Node
+				err := nr.dec.Decode(&n)
+				if err != nil {
+					return nil, fmt.Errorf("json decode error in node %d (%s)", nr.nnodes, noEOF(err))
+				}
+				return &n, nil
+			}
+
+			// End of Items ']'
+			_, err := nr.dec.Token()
+			if err != nil {
+				return nil, jsonDecodeErr(err)
+			}
+			nr.inItems = false
+			continue
+		}
+
+		if !nr.dec.More() {
+			// End of NodeList '}'
+			_, err := nr.dec.Token()
+			if err != nil {
+				return nil, jsonDecodeErr(err)
+			}
+			nr.done = true
+			return nil, io.EOF
+		}
+
+		k, err := nr.dec.Token()
+		if err != nil {
+			return nil, jsonDecodeErr(err)
+		}
+
+		if k == "Items" {
+			t, err := nr.dec.Token()
+			if err != nil {
+				return nil, jsonDecodeErr(err)
+			}
+			if t == nil {
+				// "Items": null
+				continue
+			}
+			if t != json.Delim('[') {
+				return nil, fmt.Errorf("json decode error (expected Items array)")
+			}
+			nr.inItems = true
+			continue
+		}
+
+		// Skip other keys
+		var v json.RawMessage
+		err = nr.dec.Decode(&v)
+		if err != nil {
+			return nil, jsonDecodeErr(err)
+		}
+	}
+}
+
+type ndjsonNodeReader struct {
+	dec    *json.Decoder
+	nnodes int
+}
+
+func NewNDJSONNodeReader(r io.Reader) NodeReader {
+	return &ndjsonNodeReader{dec: json.NewDecoder(r)}
+}
+
+func (nr *ndjsonNodeReader) Next() (*Node, error) {
+	var n Node
+	err := nr.dec.Decode(&n)
+	if err == io.EOF {
+		return nil, err
+	}
+	nr.nnodes++
+	if err != nil {
+		return nil, fmt.Errorf("ndjson decode error in node %d (%s)", nr.nnodes, err)
+	}
+	return &n, nil
+}
+
+// Writes a json NodeList document one node at a time, indented the same
+// as json.Encoder with SetIndent("", "  ").
+type jsonNodeWriter struct {
+	w      io.Writer
+	nnodes int
+}
+
+func NewJSONNodeWriter(w io.Writer) NodeWriter {
+	return &jsonNodeWriter{w: w}
+}
+
+func (nw *jsonNodeWriter) Write(n *Node) error {
+	bs, err := json.MarshalIndent(n, "    ", "  ")
+	if err != nil {
+		return fmt.Errorf("json encode error node %s (%s)", n.ID, err)
+	}
+
+	sep := ",\n    "
+	if nw.nnodes == 0 {
+		sep = "{\n  \"Items\": [\n    "
+	}
+	nw.nnodes++
+
+	_, err = io.WriteString(nw.w, sep)
+	if err != nil {
+		return err
+	}
+	_, err = nw.w.Write(bs)
+	return err
+}
+
+func (nw *jsonNodeWriter) Close() error {
+	// Write empty list as [] instead of null
+	end := "\n  ]\n}\n"
+	if nw.nnodes == 0 {
+		end = "{\n  \"Items\": []\n}\n"
+	}
+
+	_, err := io.WriteString(nw.w, end)
+	return err
+}
+
+type ndjsonNodeWriter struct {
+	enc *json.Encoder
+}
+
+func NewNDJSONNodeWriter(w io.Writer) NodeWriter {
+	return &ndjsonNodeWriter{json.NewEncoder(w)}
+}
+
+func (nw *ndjsonNodeWriter) Write(n *Node) error {
+	err := nw.enc.Encode(n)
+	if err != nil {
+		return fmt.Errorf("ndjson encode error node %s (%s)", n.ID, err)
+	}
+	return nil
+}
+
+func (nw *ndjsonNodeWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Typed link from one node to another.
+// Rel names the relation, Ex. blocks, parent, ref
+// FromID 'blocks' ToID, FromID's 'parent' is ToID
+type NodeLink struct {
+	FromID string
+	ToID   string
+	Rel    string
+}
+
+func (l *NodeLink) String() string {
+	return fmt.Sprintf("%s %s:%s", l.FromID, l.Rel, l.ToID)
+}
+
+// Parse csv list of rel:ID link targets.
+// Ex. "blocks:123,parent:456"
+func ParseLinkTargets(s string) ([]*NodeLink, error) {
+	var ls []*NodeLink
+	for _, target := range strings.Split(s, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		i := strings.Index(target, ":")
+		if i <= 0 || i == len(target)-1 {
+			return nil, fmt.Errorf("invalid link '%s', expected rel:ID", target)
+		}
+		ls = append(ls, &NodeLink{Rel: target[:i], ToID: target[i+1:]})
+	}
+	return ls, nil
+}
+
+// Add link fromID -> toID with relation rel.
+// Both nodes must exist.
+func (st *Store) AddNodeLink(fromID, toID, rel string) error {
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	for _, id := range []string{fromID, toID} {
+		exists, err := st.ExistsNodeID(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("link node ID %s doesn't exist", id)
+		}
+	}
+
+	var eb ErrorBag
+	var q string
+	if isSqlite(st) {
+		q = "INSERT OR IGNORE INTO nodelink (fromid, toid, rel) VALUES (?, ?, ?)"
+	} else {
+		q = "INSERT INTO nodelink (fromid, toid, rel) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	}
+	st.execSql(q, &eb, fromID, toID, rel)
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
+// Remove link fromID -> toID with relation rel.
+// Blank rel removes all links from fromID to toID.
+func (st *Store) RemoveNodeLink(fromID, toID, rel string) error {
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	var eb ErrorBag
+	var q string
+	if rel == "" {
+		if isSqlite(st) {
+			q = "DELETE FROM nodelink WHERE fromid = ? AND toid = ?"
+		} else {
+			q = "DELETE FROM nodelink WHERE fromid = $1 AND toid = $2"
+		}
+		st.execSql(q, &eb, fromID, toID)
+	} else {
+		if isSqlite(st) {
+			q = "DELETE FROM nodelink WHERE fromid = ? AND toid = ? AND rel = ?"
+		} else {
+			q = "DELETE FROM nodelink WHERE fromid = $1 AND toid = $2 AND rel = $3"
+		}
+		st.execSql(q, &eb, fromID, toID, rel)
+	}
+
+	if eb.HasErrors() {
+		return eb
+	}
+	return nil
+}
+
+func (st *Store) queryNodeLinks(col, id, rel string) ([]*NodeLink, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	q := fmt.Sprintf("SELECT fromid, toid, rel FROM nodelink WHERE %s = %s", col, st.sqlParam(1))
+	vals := []interface{}{id}
+	if rel != "" {
+		q += fmt.Sprintf(" AND rel = %s", st.sqlParam(2))
+		vals = append(vals, rel)
+	}
+	q += " ORDER BY rel, fromid, toid"
+
+	rows, err := st.conn().Query(q, vals...)
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+	defer rows.Close()
+
+	var ls []*NodeLink
+	for rows.Next() {
+		var l NodeLink
+		err := rows.Scan(&l.FromID, &l.ToID, &l.Rel)
+		if err != nil {
+			return nil, errSql(q, err)
+		}
+		ls = append(ls, &l)
+	}
+
+	return ls, nil
+}
+
+// Load links from node ID to other nodes.
+// Blank rel returns links of any relation.
+func (st *Store) LoadNodeLinks(id, rel string) ([]*NodeLink, error) {
+	return st.queryNodeLinks("fromid", id, rel)
+}
+
+// Load links from other nodes to node ID.
+// Blank rel returns links of any relation.
+func (st *Store) LoadNodeBacklinks(id, rel string) ([]*NodeLink, error) {
+	return st.queryNodeLinks("toid", id, rel)
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseLinkTargets(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"blocks:123", "[ blocks:123]", false},
+		{"blocks:123, parent:456,", "[ blocks:123  parent:456]", false},
+		{"", "[]", false},
+		{"123", "", true},
+		{":123", "", true},
+		{"blocks:", "", true},
+	}
+
+	for _, tt := range tests {
+		ls, err := ParseLinkTargets(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLinkTargets(%q) error %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got := fmt.Sprint(ls); !tt.wantErr && got != tt.want {
+			t.Errorf("ParseLinkTargets(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestNodeLinks(t *testing.T) {
+	st, ids := genStore(t, 3)
+	a, b, c := ids[0], ids[1], ids[2]
+
+	for _, l := range []*NodeLink{{a, b, "blocks"}, {a, c, "blocks"}, {a, b, "ref"}, {c, a, "parent"}, {a, b, "blocks"}} {
+		err := st.AddNodeLink(l.FromID, l.ToID, l.Rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := st.AddNodeLink(a, "nosuchid", "blocks")
+	if err == nil {
+		t.Errorf("linked to missing node")
+	}
+
+	links := func(ls []*NodeLink, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(ls)
+	}
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"links", links(st.LoadNodeLinks(a, "")), fmt.Sprintf("[%s blocks:%s %s blocks:%s %s ref:%s]", a, b, a, c, a, b)},
+		{"blocks links", links(st.LoadNodeLinks(a, "blocks")), fmt.Sprintf("[%s blocks:%s %s blocks:%s]", a, b, a, c)},
+		{"backlinks", links(st.LoadNodeBacklinks(a, "")), fmt.Sprintf("[%s parent:%s]", c, a)},
+		{"no links", links(st.LoadNodeLinks(b, "")), "[]"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+
+	err = st.RemoveNodeLink(a, b, "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := links(st.LoadNodeLinks(a, "")), fmt.Sprintf("[%s blocks:%s %s ref:%s]", a, c, a, b); got != want {
+		t.Errorf("after removing blocks link: %s, want %s", got, want)
+	}
+
+	err = st.RemoveNodeLink(a, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := links(st.LoadNodeLinks(a, "")), fmt.Sprintf("[%s ref:%s]", a, b); got != want {
+		t.Errorf("after removing all links to c: %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"bufio"
+	"e3/datafmt"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Node list streams.
+// A NodeReader decodes nodes one at a time from an input stream, and
+// a NodeWriter encodes nodes one at a time to an output stream, so a node
+// list never has to be held in memory as a whole.
+
+type NodeReader interface {
+	// Return next node, or io.EOF after the last node.
+	Next() (*Node, error)
+}
+
+type NodeWriter interface {
+	Write(n *Node) error
+
+	// Finish writing the node list, the underlying writer isn't closed.
+	Close() error
+}
+
+// Read all remaining nodes into a node list.
+func ReadAllNodes(nr NodeReader) (*NodeList, error) {
+	nl := &NodeList{}
+	for {
+		n, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		nl.Items = append(nl.Items, n)
+	}
+	return nl, nil
+}
+
+// Write nodes ns and close nw.
+func WriteAllNodes(nw NodeWriter, ns []*Node) error {
+	for _, n := range ns {
+		err := nw.Write(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nw.Close()
+}
+
+// Writer that keeps the first write error, and fails all writes after it.
+// Used with encoders that don't return write errors.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.w.Write(p)
+	if err != nil {
+		ew.err = err
+	}
+	return n, err
+}
+
+//
+// recj
+//
+
+type recjNodeReader struct {
+	dec *datafmt.Decoder
+}
+
+func NewRecjNodeReader(r io.Reader) NodeReader {
+	return &recjNodeReader{datafmt.NewDecoder(r)}
+}
+
+func (nr *recjNodeReader) Next() (*Node, error) {
+	recj, err := nr.dec.Next()
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("recj read error (%s)", err)
+	}
+	return nodeFromRecj(recj), nil
+}
+
+type recjNodeWriter struct {
+	enc *datafmt.Encoder
+}
+
+func NewRecjNodeWriter(w io.Writer) NodeWriter {
+	return &recjNodeWriter{datafmt.NewEncoder(w)}
+}
+
+func (nw *recjNodeWriter) Write(n *Node) error {
+	return nw.enc.Encode(n.toRecj())
+}
+
+func (nw *recjNodeWriter) Close() error {
+	return nil
+}
+
+//
+// table
+//
+
+// Table column widths depend on all rows, so nodes are buffered
+// and the table is written on Close().
+type tableNodeWriter struct {
+	w    io.Writer
+	cols []string
+	nl   NodeList
+}
+
+func NewTableNodeWriter(w io.Writer, cols []string) NodeWriter {
+	return &tableNodeWriter{w: w, cols: cols}
+}
+
+func (nw *tableNodeWriter) Write(n *Node) error {
+	nw.nl.Items = append(nw.nl.Items, n)
+	return nil
+}
+
+func (nw *tableNodeWriter) Close() error {
+	ew := &errWriter{w: nw.w}
+	nw.nl.WriteTableString(ew, nw.cols)
+	return ew.err
+}
+
+//
+// protobuf
+//
+
+// A pb node list stream is a NodeList message written one Items field
+// at a time: each node is written as field 1, length delimited.
+// Concatenated fields decode as a single NodeList, so streams can be
+// read with proto.Unmarshal(), and NodeLists read as streams.
+
+const _pbItemsTag = 1<<3 | 2
+
+// Max size of a single encoded node.
+const _pbMaxNodeSize = 64 << 20
+
+type pbNodeReader struct {
+	br *bufio.Reader
+}
+
+func NewPbNodeReader(r io.Reader) NodeReader {
+	return &pbNodeReader{bufio.NewReader(r)}
+}
+
+func (nr *pbNodeReader) Next() (*Node, error) {
+	for {
+		tag, err := binary.ReadUvarint(nr.br)
+		if err == io.EOF {
+			return nil, err
+		}
+		if err != nil {
+			return nil, pbStreamErr(err)
+		}
+
+		if tag == _pbItemsTag {
+			bs, err := nr.readBytes()
+			if err != nil {
+				return nil, err
+			}
+
+			n := &Node{}
+			err = proto.Unmarshal(bs, n)
+			if err != nil {
+				return nil, pbStreamErr(err)
+			}
+			return n, nil
+		}
+
+		// Skip unknown field
+		err = nr.skipField(tag & 7)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (nr *pbNodeReader) readBytes() ([]byte, error) {
+	size, err := binary.ReadUvarint(nr.br)
+	if err != nil {
+		return nil, pbStreamErr(noEOF(err))
+	}
+	if size > _pbMaxNodeSize {
+		return nil, pbStreamErr(fmt.Errorf("field size %d exceeds max %d", size, _pbMaxNodeSize))
+	}
+
+	bs := make([]byte, size)
+	_, err = io.ReadFull(nr.br, bs)
+	if err != nil {
+		return nil, pbStreamErr(noEOF(err))
+	}
+	return bs, nil
+}
+
+func (nr *pbNodeReader) skipField(wiretype uint64) error {
+	var err error
+	switch wiretype {
+	case 0:
+		_, err = binary.ReadUvarint(nr.br)
+	case 1:
+		_, err = io.CopyN(ioutil.Discard, nr.br, 8)
+	case 2:
+		_, err = nr.readBytes()
+	case 5:
+		_, err = io.CopyN(ioutil.Discard, nr.br, 4)
+	default:
+		return pbStreamErr(fmt.Errorf("unsupported wire type %d", wiretype))
+	}
+	if err != nil {
+		return pbStreamErr(noEOF(err))
+	}
+	return nil
+}
+
+// EOF within a field means the stream was cut short.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func pbStreamErr(err error) error {
+	return fmt.Errorf("protobuf read error (%s)", err)
+}
+
+type pbNodeWriter struct {
+	w io.Writer
+}
+
+func NewPbNodeWriter(w io.Writer) NodeWriter {
+	return &pbNodeWriter{w}
+}
+
+func (nw *pbNodeWriter) Write(n *Node) error {
+	bs, err := proto.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("protobuf error node %s (%s)", n.ID, err)
+	}
+
+	hdr := make([]byte, 2*binary.MaxVarintLen64)
+	i := binary.PutUvarint(hdr, _pbItemsTag)
+	i += binary.PutUvarint(hdr[i:], uint64(len(bs)))
+
+	_, err = nw.w.Write(hdr[:i])
+	if err != nil {
+		return err
+	}
+	_, err = nw.w.Write(bs)
+	return err
+}
+
+func (nw *pbNodeWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Deleted node.
+// Deleting a node moves it with its tags and custom fields to the nodetrash
+// table,
+// from which it can be restored until the trash is purged.
+type TrashedNode struct {
+	Deldt string
+	Node  *Node
+}
+
+const _trashCols = "id, hash, alias, title, assigned, body, tags, createdt, updatedt, deldt, fields"
+
+// Nodes trashed before custom fields have null fields.
+const _trashSelectCols = "id, hash, alias, title, assigned, body, tags, createdt, updatedt, deldt, COALESCE(fields, '')"
+
+func scanTrashedNode(scan func(dest ...interface{}) error) (*TrashedNode, error) {
+	tn := TrashedNode{Node: &Node{}}
+	n := tn.Node
+
+	var stags, sfields string
+	err := scan(&n.ID, &n.Hash, &n.Alias, &n.Title, &n.Assigned, &n.Body, &stags, &n.Createdt, &n.Updatedt, &tn.Deldt, &sfields)
+	if err != nil {
+		return nil, err
+	}
+	n.Tags = splitCsvTags(stags)
+	n.Fields, err = decodeFields(sfields)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tn, nil
+}
+
+// Move node ID and its tags to the trash, and remove it from the search index.
+// Returns false if node ID doesn't exist.
+func (st *Store) TrashNode(id string) (bool, error) {
+	return st.TrashNodeIfHash(id, "")
+}
+
+// Move node ID to the trash like TrashNode(), if its stored hash is hash.
+// The hash is checked by the delete itself, so a node changed by a
+// concurrent save is never trashed.
+// Returns ErrNodeChanged if the node's hash isn't hash. A blank hash
+// trashes the node whatever its hash.
+func (st *Store) TrashNodeIfHash(id, hash string) (bool, error) {
+	var ok bool
+	err := st.WithTx(func(tx *Store) error {
+		var err error
+		ok, err = tx.trashNode(id, hash)
+		return err
+	})
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = st.UnindexNode(id)
+	if err != nil {
+		return true, fmt.Errorf("node %s deleted, but not removed from search index (%s)", id, err)
+	}
+
+	return true, nil
+}
+
+// Move node ID to the trash. If ifHash isn't blank, the node is only moved
+// if its stored hash is ifHash.
+func (st *Store) trashNode(id, ifHash string) (bool, error) {
+	n, err := st.LoadNodeByID(id)
+	if err != nil {
+		return false, err
+	}
+	if n == nil {
+		return false, nil
+	}
+
+	sfields, err := encodeFields(n.Fields)
+	if err != nil {
+		return false, err
+	}
+
+	var eb ErrorBag
+	var q string
+
+	// Replace any earlier trashed node with the same ID.
+	q = fmt.Sprintf("DELETE FROM nodetrash WHERE id = %s", st.sqlParam(1))
+	st.execSql(q, &eb, id)
+
+	q = fmt.Sprintf("INSERT INTO nodetrash (%s) VALUES (%s)", _trashCols, st.sqlParams(11))
+	st.execSql(q, &eb, n.ID, n.Hash, n.Alias, n.Title, n.Assigned, n.Body, strings.Join(n.Tags, _tagSep), n.Createdt, n.Updatedt, isotimestr(time.Now()), sfields)
+
+	if eb.HasErrors() {
+		return false, eb
+	}
+
+	q = fmt.Sprintf("DELETE FROM nodetag WHERE id = %s", st.sqlParam(1))
+	st.execSql(q, &eb, id)
+	q = fmt.Sprintf("DELETE FROM nodefield WHERE id = %s", st.sqlParam(1))
+	st.execSql(q, &eb, id)
+	q = fmt.Sprintf("DELETE FROM nodechange WHERE id = %s", st.sqlParam(1))
+	st.execSql(q, &eb, id)
+	q = fmt.Sprintf("DELETE FROM node WHERE id = %s", st.sqlParam(1))
+	vals := []interface{}{id}
+	if ifHash != "" {
+		q += fmt.Sprintf(" AND hash = %s", st.sqlParam(2))
+		vals = append(vals, ifHash)
+	}
+	count := st.execSqlCount(q, &eb, vals...)
+
+	if eb.HasErrors() {
+		return false, eb
+	}
+	if count == 0 && ifHash != "" {
+		return false, ErrNodeChanged
+	}
+
+	return true, nil
+}
+
+// Load all trashed nodes, most recently deleted first.
+func (st *Store) LoadTrashedNodes() ([]*TrashedNode, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM nodetrash ORDER BY deldt desc, id desc", _trashSelectCols)
+	rows, err := st.conn().Query(q)
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+	defer rows.Close()
+
+	var tns []*TrashedNode
+	for rows.Next() {
+		tn, err := scanTrashedNode(rows.Scan)
+		if err != nil {
+			return nil, errSql(q, err)
+		}
+		tns = append(tns, tn)
+	}
+
+	return tns, nil
+}
+
+// Restore trashed node ID, with its original dates, tags and custom fields.
+// Returns false if node ID isn't in the trash.
+func (st *Store) RestoreTrashedNode(id string) (bool, error) {
+	var ok bool
+	err := st.WithTx(func(tx *Store) error {
+		var err error
+		ok, err = tx.restoreTrashedNode(id)
+		return err
+	})
+	return ok, err
+}
+
+func (st *Store) restoreTrashedNode(id string) (bool, error) {
+	if st.DB() == nil {
+		return false, dbnilErr()
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM nodetrash WHERE id = %s", _trashSelectCols, st.sqlParam(1))
+	row := st.conn().QueryRow(q, id)
+
+	tn, err := scanTrashedNode(row.Scan)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errSql(q, err)
+	}
+	n := tn.Node
+
+	exists, err := st.ExistsNodeID(id)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, fmt.Errorf("node ID %s already exists", id)
+	}
+
+	var eb ErrorBag
+	q = fmt.Sprintf("INSERT INTO node (id, hash, alias, title, assigned, body, createdt, updatedt) VALUES (%s)", st.sqlParams(8))
+	st.execSql(q, &eb, n.ID, n.Hash, n.Alias, n.Title, n.Assigned, n.Body, n.Createdt, n.Updatedt)
+	if eb.HasErrors() {
+		return false, eb
+	}
+
+	for _, tag := range n.Tags {
+		err = st.SaveNodeTag(n.ID, tag)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = st.saveNodeFields(n)
+	if err != nil {
+		return false, err
+	}
+
+	// Have the node indexed again.
+	err = st.MarkNodeChanged(n.ID)
+	if err != nil {
+		return false, err
+	}
+
+	q = fmt.Sprintf("DELETE FROM nodetrash WHERE id = %s", st.sqlParam(1))
+	st.execSql(q, &eb, id)
+	if eb.HasErrors() {
+		return false, eb
+	}
+
+	return true, nil
+}
+
+// Permanently delete nodes trashed before time t, along with their
+// revision history and links. The history and links of a node saved again
+// with a trashed node's ID since are kept, only its trashed copy is deleted.
+// Returns list of purged node IDs.
+func (st *Store) PurgeTrash(t time.Time) ([]string, error) {
+	var ids []string
+	err := st.WithTx(func(tx *Store) error {
+		var err error
+		ids, err = tx.purgeTrash(t)
+		return err
+	})
+	return ids, err
+}
+
+func (st *Store) purgeTrash(t time.Time) ([]string, error) {
+	if st.DB() == nil {
+		return nil, dbnilErr()
+	}
+
+	before := isotimestr(t)
+
+	q := fmt.Sprintf("SELECT id FROM nodetrash WHERE deldt < %s", st.sqlParam(1))
+	rows, err := st.conn().Query(q, before)
+	if err != nil {
+		return nil, errSql(q, err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, errSql(q, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	var eb ErrorBag
+	for _, id := range ids {
+		exists, err := st.ExistsNodeID(id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			q = fmt.Sprintf("DELETE FROM nodehist WHERE id = %s", st.sqlParam(1))
+			st.execSql(q, &eb, id)
+			q = fmt.Sprintf("DELETE FROM nodelink WHERE fromid = %s OR toid = %s", st.sqlParam(1), st.sqlParam(2))
+			st.execSql(q, &eb, id, id)
+		}
+		q = fmt.Sprintf("DELETE FROM nodetrash WHERE id = %s", st.sqlParam(1))
+		st.execSql(q, &eb, id)
+	}
+
+	if eb.HasErrors() {
+		return nil, eb
+	}
+	return ids, nil
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrashRestorePurge(t *testing.T) {
+	st, ids := genStore(t, 3)
+	a, b, c := ids[0], ids[1], ids[2]
+
+	n, err := st.LoadNodeByID(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetCustomField("priority", "high")
+	n, err = st.SaveNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.AddNodeLink(a, b, "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{a, c} {
+		ok, err := st.TrashNode(id)
+		if err != nil || !ok {
+			t.Fatalf("error trashing %s (%v)", id, err)
+		}
+	}
+	ok, err := st.TrashNode("nosuchid")
+	if err != nil || ok {
+		t.Errorf("trashing missing node: %v (%v)", ok, err)
+	}
+
+	exists, err := st.ExistsNodeID(a)
+	if err != nil || exists {
+		t.Errorf("trashed node %s exists (%v)", a, err)
+	}
+	tns, err := st.LoadTrashedNodes()
+	if err != nil || len(tns) != 2 {
+		t.Fatalf("%d trashed nodes (%v), want 2", len(tns), err)
+	}
+
+	ok, err = st.RestoreTrashedNode(a)
+	if err != nil || !ok {
+		t.Fatalf("error restoring %s (%v)", a, err)
+	}
+	restored, err := st.LoadNodeByID(a)
+	if err != nil || restored == nil {
+		t.Fatalf("restored node %s: %v (%v)", a, restored, err)
+	}
+	if restored.Hash != n.HashString() || restored.Createdt != n.Createdt || restored.Fields["priority"] != "high" ||
+		strings.Join(restored.Tags, ",") != strings.Join(n.Tags, ",") {
+		t.Errorf("restored %+v, trashed %+v", restored, n)
+	}
+	ok, err = st.RestoreTrashedNode(a)
+	if err != nil || ok {
+		t.Errorf("restoring node again: %v (%v)", ok, err)
+	}
+
+	// Purging trash before a time earlier than the deletes keeps them.
+	purged, err := st.PurgeTrash(time.Now().Add(-time.Hour))
+	if err != nil || len(purged) != 0 {
+		t.Errorf("purged %v (%v), want none", purged, err)
+	}
+
+	err = st.AddNodeLink(b, c, "ref")
+	if err == nil {
+		t.Errorf("linked to trashed node")
+	}
+	purged, err = st.PurgeTrash(time.Now().Add(time.Second))
+	if err != nil || strings.Join(purged, ",") != c {
+		t.Errorf("purged %v (%v), want %s", purged, err, c)
+	}
+	nrs, err := st.LoadNodeRevs(c)
+	if err != nil || len(nrs) != 0 {
+		t.Errorf("purged node has %d revisions (%v)", len(nrs), err)
+	}
+	ok, err = st.RestoreTrashedNode(c)
+	if err != nil || ok {
+		t.Errorf("restored purged node: %v (%v)", ok, err)
+	}
+
+	// Links of the restored node are kept.
+	ls, err := st.LoadNodeLinks(a, "")
+	if err != nil || len(ls) != 1 {
+		t.Errorf("restored node links %v (%v)", ls, err)
+	}
+}
+
+func TestTrashNodeIfHash(t *testing.T) {
+	st, ids := genStore(t, 1)
+
+	n, err := st.LoadNodeByID(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	basehash := n.Hash
+
+	n.Title = "Changed"
+	_, err = st.SaveNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := st.TrashNodeIfHash(ids[0], basehash)
+	if !errors.Is(err, ErrNodeChanged) || ok {
+		t.Fatalf("trashing changed node: %v (%v), want ErrNodeChanged", ok, err)
+	}
+	tns, err := st.LoadTrashedNodes()
+	if err != nil || len(tns) != 0 {
+		t.Errorf("%d trashed nodes (%v) after failed trash", len(tns), err)
+	}
+
+	n, err = st.LoadNodeByID(ids[0])
+	if err != nil || n == nil {
+		t.Fatalf("node after failed trash: %v (%v)", n, err)
+	}
+	ok, err = st.TrashNodeIfHash(ids[0], n.Hash)
+	if err != nil || !ok {
+		t.Errorf("error trashing with current hash (%v)", err)
+	}
+}
+
+// Purging a trashed node keeps the history and links of a node saved again
+// with its ID.
+func TestPurgeTrashLiveID(t *testing.T) {
+	st, ids := genStore(t, 2)
+	a, b := ids[0], ids[1]
+
+	n, err := st.LoadNodeByID(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := st.TrashNode(a)
+	if err != nil || !ok {
+		t.Fatalf("error trashing %s (%v)", a, err)
+	}
+
+	n.Title = "Saved again"
+	_, err = st.SaveNode(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.AddNodeLink(a, b, "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := st.PurgeTrash(time.Now().Add(time.Second))
+	if err != nil || strings.Join(purged, ",") != a {
+		t.Fatalf("purged %v (%v), want %s", purged, err, a)
+	}
+
+	tns, err := st.LoadTrashedNodes()
+	if err != nil || len(tns) != 0 {
+		t.Errorf("%d trashed nodes (%v) after purge", len(tns), err)
+	}
+	n, err = st.LoadNodeByID(a)
+	if err != nil || n == nil || n.Title != "Saved again" {
+		t.Fatalf("node saved again after purge: %v (%v)", n, err)
+	}
+	nrs, err := st.LoadNodeRevs(a)
+	if err != nil || len(nrs) != 2 {
+		t.Errorf("%d revisions (%v) after purge, want 2", len(nrs), err)
+	}
+	ls, err := st.LoadNodeLinks(a, "")
+	if err != nil || len(ls) != 1 {
+		t.Errorf("links %v (%v) after purge", ls, err)
+	}
+}
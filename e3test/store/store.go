@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/blevesearch/bleve"
 	_ "github.com/lib/pq"
@@ -18,6 +19,31 @@ type Store struct {
 	IndexDir string
 	Logger   *log.Logger
 	db       *sql.DB
+	tx       *sql.Tx
+	res      *storeRes
+
+	// Writes skip the schema version check, for changing the schema.
+	schemaWrite bool
+}
+
+// Resources opened on first use and kept open for the lifetime of the store.
+// Shared between a store and its transaction bound stores.
+type storeRes struct {
+	mu  sync.Mutex
+	idx bleve.Index
+
+	// Database schema version, read on first write, see checkWritable()
+	schemaMu      sync.Mutex
+	schemaChecked bool
+	schemaVersion int
+}
+
+// Methods common to *sql.DB and *sql.Tx
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 func NewStore(driver, dsname, indexdir string, logger *log.Logger) *Store {
@@ -30,6 +56,7 @@ func NewStore(driver, dsname, indexdir string, logger *log.Logger) *Store {
 		DSName:   dsname,
 		IndexDir: indexdir,
 		Logger:   logger,
+		res:      &storeRes{},
 	}
 }
 
@@ -39,6 +66,9 @@ func (st *Store) OpenDB() (*sql.DB, error) {
 }
 
 func (st *Store) DB() *sql.DB {
+	st.res.mu.Lock()
+	defer st.res.mu.Unlock()
+
 	if st.db != nil {
 		return st.db
 	}
@@ -51,28 +81,111 @@ func (st *Store) DB() *sql.DB {
 	return st.db
 }
 
+// Return the transaction this store is bound to (see WithTx()),
+// or the db if not in a transaction.
+func (st *Store) conn() sqlConn {
+	if st.tx != nil {
+		return st.tx
+	}
+
+	db := st.DB()
+	if db == nil {
+		return nil
+	}
+	return db
+}
+
+// Run fn within a database transaction.
+// fn is passed a store bound to the transaction. Everything done through
+// it is committed if fn returns nil, or rolled back if fn returns an error.
+// If st is already bound to a transaction, fn runs as part of it.
+func (st *Store) WithTx(fn func(txst *Store) error) error {
+	if st.tx != nil {
+		return fn(st)
+	}
+
+	if st.DB() == nil {
+		return dbnilErr()
+	}
+
+	tx, err := st.DB().Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction (%s)", err)
+	}
+
+	txst := &Store{
+		Driver:   st.Driver,
+		DSName:   st.DSName,
+		IndexDir: st.IndexDir,
+		Logger:   st.Logger,
+		db:       st.db,
+		tx:       tx,
+		res:      st.res,
+
+		schemaWrite: st.schemaWrite,
+	}
+
+	err = fn(txst)
+	if err != nil {
+		rberr := tx.Rollback()
+		if rberr != nil {
+			st.Logger.Printf("error rolling back transaction (%s)\n", rberr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing transaction (%s)", err)
+	}
+	return nil
+}
+
 func errSql(q string, err error) error {
 	return fmt.Errorf("%s (%s)", err, q)
 }
 
 // Execute sql command, with any error occuring added to ErrorBag
+// Fails if the store is read-only, see checkWritable().
 func (st *Store) execSql(q string, eb *ErrorBag, vals ...interface{}) {
-	s, err := st.DB().Prepare(q)
+	st.execSqlCount(q, eb, vals...)
+}
+
+// Execute sql command like execSql(), returning the number of rows
+// affected, 0 on error.
+func (st *Store) execSqlCount(q string, eb *ErrorBag, vals ...interface{}) int64 {
+	err := st.checkWritable()
+	if err != nil {
+		eb.Add(err)
+		return 0
+	}
+
+	s, err := st.conn().Prepare(q)
 	if err != nil {
 		eb.Add(errSql(q, err))
+		return 0
 	}
-	if err == nil {
-		_, err = s.Exec(vals...)
-		if err != nil {
-			eb.Add(errSql(q, err))
-		}
+	defer s.Close()
+
+	res, err := s.Exec(vals...)
+	if err != nil {
+		eb.Add(errSql(q, err))
+		return 0
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		eb.Add(errSql(q, err))
+		return 0
 	}
+	return n
 }
 
 func (st *Store) DropTables() error {
 	if st.DB() == nil {
 		return dbnilErr()
 	}
+	defer st.resetSchemaVersion()
+	st = st.schemaWriter()
 
 	var eb ErrorBag
 	var q string
@@ -83,6 +196,16 @@ func (st *Store) DropTables() error {
 	st.execSql(q, &eb)
 	q = "DROP TABLE nodetag"
 	st.execSql(q, &eb)
+	q = "DROP TABLE nodehist"
+	st.execSql(q, &eb)
+	q = "DROP TABLE nodelink"
+	st.execSql(q, &eb)
+	q = "DROP TABLE nodetrash"
+	st.execSql(q, &eb)
+	q = "DROP TABLE nodefield"
+	st.execSql(q, &eb)
+	q = "DROP TABLE schemaversion"
+	st.execSql(q, &eb)
 
 	if eb.HasErrors() {
 		return eb
@@ -90,36 +213,50 @@ func (st *Store) DropTables() error {
 	return nil
 }
 
+// Create tables, applying all pending schema migrations.
 func (st *Store) InitTables() error {
-	if st.DB() == nil {
-		return dbnilErr()
-	}
+	_, err := st.Migrate()
+	return err
+}
 
-	var eb ErrorBag
+// Return the store's search index, opening it on first use.
+// The index stays open until Close().
+func (st *Store) Index() (bleve.Index, error) {
+	st.res.mu.Lock()
+	defer st.res.mu.Unlock()
 
-	q :=
-		`CREATE TABLE IF NOT EXISTS node (
-			id TEXT PRIMARY KEY, 
-			hash TEXT,
-			alias TEXT,
-			title TEXT,
-			assigned TEXT,
-			body TEXT,
-			createdt TEXT,
-			updatedt TEXT)`
-	st.execSql(q, &eb)
+	if st.res.idx != nil {
+		return st.res.idx, nil
+	}
 
-	q =
-		`CREATE TABLE IF NOT EXISTS nodechange (
-			id TEXT PRIMARY KEY)`
-	st.execSql(q, &eb)
+	idx, err := search.BleveIndex(st.IndexDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't open bleve index (%s)", err)
+	}
+	st.res.idx = idx
+	return idx, nil
+}
 
-	q =
-		`CREATE TABLE IF NOT EXISTS nodetag (
-			id TEXT,
-			tag TEXT,
-			UNIQUE (id, tag))`
-	st.execSql(q, &eb)
+// Close search index and db.
+func (st *Store) Close() error {
+	st.res.mu.Lock()
+	defer st.res.mu.Unlock()
+
+	var eb ErrorBag
+	if st.res.idx != nil {
+		err := st.res.idx.Close()
+		if err != nil {
+			eb.Add(fmt.Errorf("error closing bleve index (%s)", err))
+		}
+		st.res.idx = nil
+	}
+	if st.db != nil {
+		err := st.db.Close()
+		if err != nil {
+			eb.Add(fmt.Errorf("error closing db (%s)", err))
+		}
+		st.db = nil
+	}
 
 	if eb.HasErrors() {
 		return eb
@@ -128,26 +265,66 @@ func (st *Store) InitTables() error {
 }
 
 func (st *Store) IndexNode(n *Node) error {
-	idx, err := search.BleveIndex(st.IndexDir)
+	idx, err := st.Index()
 	if err != nil {
-		return fmt.Errorf("can't open bleve index (%s)", err)
+		return err
 	}
-	defer idx.Close()
 
 	err = idx.Index(n.ID, *n)
 	return err
 }
 
-func (st *Store) SearchNodes(q string) ([]*Node, error) {
-	idx, err := search.BleveIndex(st.IndexDir)
+func (st *Store) UnindexNode(id string) error {
+	idx, err := st.Index()
 	if err != nil {
-		return nil, fmt.Errorf("can't open bleve index (%s)", err)
+		return err
+	}
+
+	err = idx.Delete(id)
+	return err
+}
+
+// Add nodes ns to search index and remove nodes delIDs from it,
+// committing them as a single batch.
+func (st *Store) IndexNodes(ns []*Node, delIDs []string) error {
+	idx, err := st.Index()
+	if err != nil {
+		return err
+	}
+
+	b := idx.NewBatch()
+	for _, n := range ns {
+		err := b.Index(n.ID, *n)
+		if err != nil {
+			return fmt.Errorf("error indexing node %s (%s)", n.ID, err)
+		}
+	}
+	for _, id := range delIDs {
+		b.Delete(id)
+	}
+
+	err = idx.Batch(b)
+	if err != nil {
+		return fmt.Errorf("error committing index batch (%s)", err)
+	}
+	return nil
+}
+
+// Search index for query string q.
+// Returns up to limit hits starting from offset, in ranking order.
+// limit <= 0 returns up to 10 hits.
+func (st *Store) SearchNodes(q string, limit, offset int) ([]*Node, error) {
+	idx, err := st.Index()
+	if err != nil {
+		return nil, err
 	}
-	defer idx.Close()
 
 	//query := bleve.NewMatchQuery(q)
 	query := bleve.NewQueryStringQuery(q)
-	req := bleve.NewSearchRequest(query)
+	if limit <= 0 {
+		limit = 10
+	}
+	req := bleve.NewSearchRequestOptions(query, limit, offset, false)
 	req.Fields = []string{"Title", "Body"}
 
 	results, err := idx.Search(req)
@@ -155,17 +332,15 @@ func (st *Store) SearchNodes(q string) ([]*Node, error) {
 		return nil, fmt.Errorf("bleve search error (%s)", err)
 	}
 
-	var ns []*Node
+	// Fetch all hits at once, keeping search ranking order.
+	var ids []string
 	for _, match := range results.Hits {
-		n, err := st.LoadNodeByID(match.ID)
-		if err != nil {
-			st.Logger.Printf("load search result node %s error (%s)\n", match.ID, err)
-			continue
-		}
+		ids = append(ids, match.ID)
+	}
 
-		if n != nil {
-			ns = append(ns, n)
-		}
+	ns, err := st.LoadNodesByIDs(ids)
+	if err != nil {
+		return nil, fmt.Errorf("load search result nodes error (%s)", err)
 	}
 
 	return ns, nil
@@ -19,6 +19,7 @@ func readOptions() (map[string]string, map[string]string, []string, error) {
 	fverbose := flag.Bool("verbose", false, "output info messages")
 
 	fhttp := flag.Bool("http", false, "http server")
+	fbgindex := flag.Bool("bgindex", false, "run background indexer with http server")
 	feval := flag.String("e", "", "run command")
 
 	flag.Parse()
@@ -39,6 +40,9 @@ func readOptions() (map[string]string, map[string]string, []string, error) {
 	if *fhttp {
 		options["http"] = ""
 	}
+	if *fbgindex {
+		options["bgindex"] = ""
+	}
 	options["eval"] = *feval
 
 	return options, aliases, flag.Args(), nil
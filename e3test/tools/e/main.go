@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"e3/cmdutil"
 	"e3/core"
+	"e3/osutil"
 	"e3/store"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -55,7 +61,12 @@ func main() {
 	st := store.NewStore(dbdriver, dsname, indexDir, logger)
 
 	if cmdutil.FlagOn(opts, "http") {
-		serveHttp(st, opts, aliases, logger)
+		err := serveHttp(st, opts, aliases, logger)
+		st.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "http server error (%s)\n", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
@@ -70,18 +81,151 @@ func main() {
 		os.Exit(1)
 	}
 
-	core.RunPipelineStmts(scmd, nil, nil, st, opts, aliases, logger)
+	pr := core.RunPipelineStmts(context.Background(), scmd, nil, nil, st, opts, aliases, core.RoleNone, logger)
+	st.Close()
+	if pr.Err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", pr.Err)
+		os.Exit(1)
+	}
 }
 
-func serveHttp(st *store.Store, opts, aliases map[string]string, logger *log.Logger) {
+const defaultListenAddr = ":8080"
+const defaultReadTimeout = 30 * time.Second
+const defaultWriteTimeout = 5 * time.Minute
+
+// Max time to wait for in-flight requests to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// Return duration conf setting k, or defaultDur if not set.
+func durationOpt(opts map[string]string, k string, defaultDur time.Duration) (time.Duration, error) {
+	if opts[k] == "" {
+		return defaultDur, nil
+	}
+	d, ok := cmdutil.ConvDuration(opts[k])
+	if !ok || d < 0 {
+		return 0, fmt.Errorf("invalid %s= setting '%s'", k, opts[k])
+	}
+	return d, nil
+}
+
+// Serve http until SIGINT or SIGTERM.
+//
+// Conf settings:
+// listen=       address to listen on, Ex. localhost:8080 (default :8080)
+// tlscert=      TLS certificate file, serves https if set
+// tlskey=       TLS key file, required with tlscert=
+// readtimeout=  max duration for reading a request, Ex. 30s
+// writetimeout= max duration for writing a response, Ex. 5m
+//
+// On signal, stops accepting new requests and waits for in-flight requests
+// and the background indexer to finish. Requests still running after
+// shutdownTimeout have their pipelines canceled, and are waited for before
+// returning, so the store can be closed.
+func serveHttp(st *store.Store, opts, aliases map[string]string, logger *log.Logger) error {
+	addr := opts["listen"]
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+	certFile := opts["tlscert"]
+	keyFile := opts["tlskey"]
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("tlscert= and tlskey= must be set together")
+	}
+
+	readTimeout, err := durationOpt(opts, "readtimeout", defaultReadTimeout)
+	if err != nil {
+		return err
+	}
+	writeTimeout, err := durationOpt(opts, "writetimeout", defaultWriteTimeout)
+	if err != nil {
+		return err
+	}
+
+	// An older schema leaves the store read-only, and migrate is admin-only
+	// over http, so it's applied before serving.
+	err = st.CheckSchemaCurrent()
+	if err != nil {
+		return err
+	}
+
 	e3c := core.NewE3C(st, opts, aliases, logger)
 
-	http.HandleFunc("/", e3c.HttpRoot)
-	http.HandleFunc("/cmd", e3c.HttpCmd)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", e3c.HttpRoot)
+	mux.HandleFunc("/cmd", e3c.HttpCmd)
+	mux.HandleFunc("/nodes", e3c.HttpNodes)
+	mux.HandleFunc("/nodes/", e3c.HttpNodes)
+	mux.HandleFunc("/search", e3c.HttpSearch)
+	mux.HandleFunc("/tags", e3c.HttpTags)
+
+	// Requests run with a context canceled once shutdown times out.
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	defer reqCancel()
+
+	var handlers sync.WaitGroup
+	srv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			mux.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		ErrorLog:     logger,
+		BaseContext: func(net.Listener) context.Context {
+			return reqCtx
+		},
+	}
+
+	ctx, cancel := osutil.SignalContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-	fmt.Println("Serving http at localhost:8080...")
-	err := http.ListenAndServe(":8080", nil)
+	// -bgindex keeps the search index updated while serving
+	watchDone := make(chan struct{})
+	if cmdutil.FlagOn(opts, "bgindex") {
+		go func() {
+			e3c.WatchIndex(ctx, 0, 0)
+			close(watchDone)
+		}()
+	} else {
+		close(watchDone)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		if certFile != "" {
+			fmt.Printf("Serving https at %s...\n", addr)
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			fmt.Printf("Serving http at %s...\n", addr)
+			err = srv.ListenAndServe()
+		}
+		serveErr <- err
+	}()
+
+	select {
+	case err = <-serveErr:
+		// Server failed to start, Ex. address in use
+		cancel()
+		<-watchDone
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Printf("Shutting down http server...\n")
+	sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer scancel()
+
+	err = srv.Shutdown(sctx)
 	if err != nil {
-		logger.Fatal(err)
+		logger.Printf("Shutdown error (%s), canceling running requests\n", err)
+		reqCancel()
+		srv.Close()
 	}
+	handlers.Wait()
+	<-watchDone
+
+	return nil
 }